@@ -0,0 +1,181 @@
+package gdec
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+)
+
+// Checkpoints of a whole D, for migrating processes, blue/green
+// deploys, or reproducing production state in tests.  A checkpoint
+// has the D's addr, ticks, non-scratch relations, and the changes
+// pending for the next tick, including received network tuples, in
+// the encoding of BinaryCodec.  Lattices within tuples must have
+// registered types, see RegisterType().
+
+var checkpointMagic = []byte("gdecD1")
+
+// Safe to call while the D is Run(), but not during a tick.
+func (d *D) Checkpoint(w io.Writer) error {
+	d.tickM.Lock()
+	defer d.tickM.Unlock()
+
+	names := map[Relation]string{}
+	relations := []interface{}{}
+	for name, r := range d.Relations {
+		names[r] = name
+		if relationScratch(r) {
+			continue
+		}
+		tuples, err := relationToWire(r)
+		if err != nil {
+			return fmt.Errorf("checkpoint of: %s, err: %v", name, err)
+		}
+		relations = append(relations, []interface{}{name, tuples})
+	}
+
+	d.inboxM.Lock()
+	pending := append([]relationChange(nil), d.next...)
+	for _, x := range d.inbox {
+		if r := d.inboxRelation(x); r != nil {
+			pending = append(pending, relationChange{r, x.tuple, true})
+		}
+	}
+	d.inboxM.Unlock()
+
+	next := []interface{}{}
+	for _, c := range pending {
+		name, ok := names[c.into]
+		if !ok {
+			return fmt.Errorf("checkpoint of a change to an undeclared relation: %#v", c.into)
+		}
+		x, err := changeToWire(name, c)
+		if err != nil {
+			return err
+		}
+		next = append(next, x)
+	}
+
+	b, err := binaryAppend(append([]byte(nil), checkpointMagic...),
+		[]interface{}{d.Addr, d.ticks, relations, next})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// Rebuilds a D from a checkpoint, where initFn declares the D's
+// relations and joins, like the *Init() funcs that built the original.
+func RestoreD(r io.Reader, initFn func(d *D) *D) (*D, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(b, checkpointMagic) {
+		return nil, fmt.Errorf("RestoreD: not a checkpoint")
+	}
+	v, rest, err := binaryRead(b[len(checkpointMagic):])
+	if err != nil {
+		return nil, err
+	}
+	c, _ := v.([]interface{})
+	if len(rest) > 0 || len(c) != 4 {
+		return nil, fmt.Errorf("RestoreD: bad checkpoint")
+	}
+	addr, _ := c[0].(string)
+	ticks, err := wireInt(c[1])
+	if err != nil {
+		return nil, err
+	}
+	relations, _ := c[2].([]interface{})
+	next, _ := c[3].([]interface{})
+
+	d := initFn(NewD(addr))
+	d.ticks = ticks
+	for _, x := range relations {
+		nt, _ := x.([]interface{})
+		if len(nt) != 2 {
+			return nil, fmt.Errorf("RestoreD: bad relation: %#v", x)
+		}
+		name, _ := nt[0].(string)
+		r := d.Relations[name]
+		if r == nil {
+			return nil, fmt.Errorf("RestoreD: undeclared relation: %s", name)
+		}
+		if err := relationFromWire(d, r, nt[1]); err != nil {
+			return nil, fmt.Errorf("RestoreD of: %s, err: %v", name, err)
+		}
+	}
+	for _, x := range next {
+		r, c, err := changeFromWire(d, x)
+		if err != nil {
+			return nil, err
+		}
+		if r == nil {
+			return nil, fmt.Errorf("RestoreD: change to an undeclared relation: %#v", x)
+		}
+		d.next = append(d.next, c)
+	}
+	return d, nil
+}
+
+// Returns the tuples of a snapshot of a relation as wire values.
+func relationToWire(r Relation) ([]interface{}, error) {
+	s := r.(Lattice).Snapshot().(Relation)
+	tuples := []interface{}{}
+	for x := range s.Scan() {
+		v, err := toWire(reflect.ValueOf(x), false)
+		if err != nil {
+			return nil, err
+		}
+		tuples = append(tuples, v)
+	}
+	return tuples, nil
+}
+
+func relationFromWire(d *D, r Relation, w interface{}) error {
+	tuples, err := tuplesFromWire(d, r.TupleType(), w)
+	if err != nil {
+		return err
+	}
+	for _, x := range tuples {
+		r.DirectAdd(x)
+	}
+	return nil
+}
+
+func changeToWire(name string, c relationChange) (interface{}, error) {
+	v, err := toWire(reflect.ValueOf(c.arg), false)
+	if err != nil {
+		return nil, fmt.Errorf("can't encode change to: %s, err: %v", name, err)
+	}
+	return []interface{}{name, c.add, v}, nil
+}
+
+// Returns a nil Relation when the change's relation isn't declared.
+func changeFromWire(d *D, w interface{}) (Relation, relationChange, error) {
+	c, _ := w.([]interface{})
+	if len(c) != 3 {
+		return nil, relationChange{}, fmt.Errorf("bad change: %#v", w)
+	}
+	name, _ := c[0].(string)
+	r := d.Relations[name]
+	if r == nil {
+		return nil, relationChange{}, nil
+	}
+	if add, _ := c[1].(bool); add {
+		tuples, err := tuplesFromWire(d, r.TupleType(), []interface{}{c[2]})
+		if err != nil {
+			return nil, relationChange{}, err
+		}
+		return r, relationChange{r, tuples[0], true}, nil
+	}
+	l, err := fromWire(d, reflect.TypeOf(r), c[2])
+	if err != nil {
+		return nil, relationChange{}, err
+	}
+	return r, relationChange{r, l.Interface(), false}, nil
+}
@@ -0,0 +1,57 @@
+package gdec
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCheckpoint(t *testing.T) {
+	initFn := func(d *D) *D { return KVInit(ShortestPathInit(d, ""), "") }
+	d := initFn(NewD("a"))
+	links := d.Relations["ShortestPathLink"]
+	put := d.Relations["KVPut"]
+	d.AddNext(links, &ShortestPathLink{"a", "b", 1})
+	d.AddNext(put, &KVPut{ReqId: 1, Addr: "a", Key: "k", Val: NewLSetOne(d, "x")})
+	d.Tick()
+	d.AddNext(links, &ShortestPathLink{"b", "c", 2}) // Pending.
+	d.Receive("KVPut", []interface{}{
+		&KVPut{ReqId: 2, Addr: "a", Key: "k", Val: NewLSetOne(d, "y")}})
+
+	var buf bytes.Buffer
+	if err := d.Checkpoint(&buf); err != nil {
+		t.Fatalf("expected checkpoint, got: %v", err)
+	}
+	r, err := RestoreD(bytes.NewReader(buf.Bytes()), initFn)
+	if err != nil {
+		t.Fatalf("expected restore, got: %v", err)
+	}
+	if r.Addr != "a" || r.ticks != d.ticks || len(r.next) != len(d.next)+1 {
+		t.Errorf("expected addr, ticks and pending changes, got: %v, %v, %v",
+			r.Addr, r.ticks, r.next)
+	}
+	if x := r.Relations["ShortestPath"].(*LSet); x.Size() != 1 {
+		t.Errorf("expected restored paths, got: %#v", x.m)
+	}
+	if x := r.Relations["KVPut"].(*LSet); x.Size() != 0 {
+		t.Errorf("expected scratch relations to not be restored, got: %#v", x.m)
+	}
+
+	d.Tick()
+	r.Tick()
+	for _, name := range []string{"ShortestPath", "kvMap"} {
+		a, b := d.Relations[name].(Lattice), r.Relations[name].(Lattice)
+		if !LatticeEqual(a, b) {
+			t.Errorf("expected equal %s, got: %#v, %#v", name, a, b)
+		}
+	}
+	if x, _ := r.Relations["kvMap"].(*LMap).At("k").(*LSet); x == nil || x.Size() != 2 {
+		t.Errorf("expected merged val, got: %#v", x)
+	}
+
+	if _, err := RestoreD(bytes.NewReader([]byte("junk")), initFn); err == nil {
+		t.Errorf("expected error restoring junk")
+	}
+	if _, err := RestoreD(bytes.NewReader(buf.Bytes()), func(d *D) *D { return d }); err == nil {
+		t.Errorf("expected error restoring undeclared relations")
+	}
+}
@@ -0,0 +1,263 @@
+// Command gdec-repl loads a registered program into a D, or attaches
+// to a running node's HTTP gateway, to inspect and drive it.
+//
+//	gdec-repl -program Raft -addr a
+//	gdec-repl -attach http://localhost:8080
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/steveyen/gdec"
+)
+
+const usage = `commands:
+  programs            lists the registered programs
+  relations, ls       lists relations
+  dump NAME           shows a relation's contents
+  insert NAME JSON    adds a tuple, or an array of tuples, at the next tick
+  tick [N]            ticks N times, then shows the joins with outputs,
+                      summed over those ticks
+  joins               shows the joins, with their outputs during the last tick
+  help
+  quit, exit
+`
+
+func main() {
+	program := flag.String("program", "", "registered program to load, like KV or Raft")
+	addr := flag.String("addr", "", "addr of the loaded D")
+	prefix := flag.String("prefix", "", "relation name prefix of the loaded program")
+	attach := flag.String("attach", "", "URL of a running node's HTTP gateway")
+	flag.Parse()
+
+	var r *repl
+	switch {
+	case *attach != "":
+		r = attachREPL(*attach, os.Stdout)
+	case *program != "":
+		m := gdec.ModuleByName(*program)
+		if m == nil {
+			fmt.Fprintf(os.Stderr, "unknown program: %s, programs: %s\n",
+				*program, strings.Join(gdec.ModuleNames(), ", "))
+			os.Exit(2)
+		}
+		r = localREPL(m.Init(gdec.NewD(*addr), *prefix), os.Stdout)
+	default:
+		fmt.Fprintf(os.Stderr, "either -program or -attach is needed, programs: %s\n",
+			strings.Join(gdec.ModuleNames(), ", "))
+		os.Exit(2)
+	}
+
+	in := bufio.NewScanner(os.Stdin)
+	in.Buffer(nil, 1<<20)
+	for {
+		fmt.Print("gdec> ")
+		if !in.Scan() {
+			fmt.Println()
+			return
+		}
+		quit, err := r.exec(in.Text())
+		if err != nil {
+			fmt.Printf("error: %v\n", err)
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// Both local and attached D's are driven through the HTTP gateway's
+// API, where a local D's gateway is invoked in-process.
+type repl struct {
+	out     io.Writer
+	client  *http.Client
+	base    string
+	gateway *gdec.HTTPGateway // Nil when attached.
+}
+
+func localREPL(d *gdec.D, out io.Writer) *repl {
+	g := gdec.NewHTTPGateway(d)
+	g.PostExternals = true
+	return &repl{out: out, gateway: g, base: "http://local",
+		client: &http.Client{Transport: handlerTransport{g}}}
+}
+
+func attachREPL(url string, out io.Writer) *repl {
+	return &repl{out: out, base: strings.TrimSuffix(url, "/"), client: http.DefaultClient}
+}
+
+type handlerTransport struct{ h http.Handler }
+
+func (t handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	w := httptest.NewRecorder()
+	t.h.ServeHTTP(w, req)
+	return w.Result(), nil
+}
+
+// Returns true on a quit command.
+func (r *repl) exec(line string) (bool, error) {
+	fields := strings.Fields(line)
+	if len(fields) <= 0 {
+		return false, nil
+	}
+	cmd, args := fields[0], fields[1:]
+	switch cmd {
+	case "quit", "exit":
+		return true, nil
+	case "help", "?":
+		fmt.Fprint(r.out, usage)
+	case "programs":
+		fmt.Fprintln(r.out, strings.Join(gdec.ModuleNames(), "\n"))
+	case "relations", "ls":
+		return false, r.relations()
+	case "dump":
+		if len(args) != 1 {
+			return false, fmt.Errorf("usage: dump NAME")
+		}
+		return false, r.dump(args[0])
+	case "insert":
+		if len(args) < 2 {
+			return false, fmt.Errorf("usage: insert NAME JSON")
+		}
+		tuples := strings.TrimSpace(line) // The JSON's the rest of the line.
+		for _, f := range fields[:2] {
+			tuples = strings.TrimSpace(strings.TrimPrefix(tuples, f))
+		}
+		return false, r.insert(args[0], tuples)
+	case "tick":
+		n := 1
+		if len(args) > 0 {
+			var err error
+			if n, err = strconv.Atoi(args[0]); err != nil || n < 1 {
+				return false, fmt.Errorf("usage: tick [N]")
+			}
+		}
+		return false, r.tick(n)
+	case "joins":
+		return false, r.joins(false)
+	default:
+		return false, fmt.Errorf("unknown command: %s, see: help", cmd)
+	}
+	return false, nil
+}
+
+func (r *repl) get(path string, v interface{}) error {
+	res, err := r.client.Get(r.base + path)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(b)))
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func (r *repl) relations() error {
+	var rels []*gdec.GatewayRelation
+	if err := r.get("/relations", &rels); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(r.out, 0, 8, 2, ' ', 0)
+	for _, x := range rels {
+		flags := []string{}
+		if x.Scratch {
+			flags = append(flags, "scratch")
+		}
+		if x.Channel {
+			flags = append(flags, "channel")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", x.Name, x.Kind, x.TupleType,
+			strings.Join(flags, ","))
+	}
+	return w.Flush()
+}
+
+func (r *repl) dump(name string) error {
+	var v interface{}
+	if err := r.get("/relations/"+name, &v); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(r.out, "%s\n", b)
+	return nil
+}
+
+func (r *repl) insert(name string, tuples string) error {
+	res, err := r.client.Post(r.base+"/relations/"+name, "application/json",
+		bytes.NewBufferString(tuples))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusAccepted {
+		b, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(b)))
+	}
+	fmt.Fprintln(r.out, "ok, at the next tick")
+	return nil
+}
+
+func (r *repl) tick(n int) error {
+	if r.gateway == nil {
+		return fmt.Errorf("attached nodes tick themselves")
+	}
+	var total []gdec.JoinStat
+	for i := 0; i < n; i++ {
+		r.gateway.Tick()
+		var stats []gdec.JoinStat
+		if err := r.get("/joins", &stats); err != nil {
+			return err
+		}
+		if total == nil {
+			total = stats
+			continue
+		}
+		for j := range stats {
+			if j < len(total) {
+				total[j].Fired += stats[j].Fired
+			}
+		}
+	}
+	return r.printJoins(total, true)
+}
+
+func (r *repl) joins(firedOnly bool) error {
+	var stats []gdec.JoinStat
+	if err := r.get("/joins", &stats); err != nil {
+		return err
+	}
+	return r.printJoins(stats, firedOnly)
+}
+
+func (r *repl) printJoins(stats []gdec.JoinStat, firedOnly bool) error {
+	w := tabwriter.NewWriter(r.out, 0, 8, 2, ' ', 0)
+	for _, s := range stats {
+		if firedOnly && s.Fired <= 0 {
+			continue
+		}
+		dest := s.Into
+		if dest == "" {
+			dest = strings.Join(s.Writes, ",")
+		}
+		fmt.Fprintf(w, "%s\t%s\t-> %s\tfired: %d\n", s.Name,
+			strings.Join(s.Sources, " * "), dest, s.Fired)
+	}
+	return w.Flush()
+}
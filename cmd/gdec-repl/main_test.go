@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/steveyen/gdec"
+)
+
+func expectExec(t *testing.T, r *repl, out *bytes.Buffer, line string, expects ...string) {
+	out.Reset()
+	if _, err := r.exec(line); err != nil {
+		t.Fatalf("line: %s, expected no err, got: %v", line, err)
+	}
+	for _, s := range expects {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("line: %s, expected: %q, got: %s", line, s, out.String())
+		}
+	}
+}
+
+func TestLocal(t *testing.T) {
+	out := &bytes.Buffer{}
+	r := localREPL(gdec.ModuleByName("ShortestPath").Init(gdec.NewD(""), ""), out)
+	expectExec(t, r, out, "programs", "KV\n", "Raft\n")
+	expectExec(t, r, out, "ls", "ShortestPathLink  LSet")
+	expectExec(t, r, out, `insert ShortestPathLink {"From": "a", "To": "b", "Cost": 1}`, "ok")
+	expectExec(t, r, out, `insert ShortestPathLink [{"From": "b", "To": "c", "Cost": 2}]`, "ok")
+	expectExec(t, r, out, "tick", "-> ShortestPath", "fired: ")
+	expectExec(t, r, out, "dump ShortestPath", `"Next": "b"`)
+	expectExec(t, r, out, "tick 2", "#1  ShortestPathLink * ShortestPath  -> ShortestPath  fired: 2")
+	expectExec(t, r, out, "joins", "#1  ShortestPathLink * ShortestPath  -> ShortestPath  fired: 1")
+
+	for _, line := range []string{"nope", "dump", "dump nope", "insert nope {}",
+		"insert ShortestPathLink {", "tick x"} {
+		if _, err := r.exec(line); err == nil {
+			t.Errorf("line: %s, expected err", line)
+		}
+	}
+	if quit, _ := r.exec("quit"); !quit {
+		t.Errorf("expected quit")
+	}
+}
+
+func TestAttach(t *testing.T) {
+	g := gdec.NewHTTPGateway(gdec.TallyInit(gdec.NewD(""), ""))
+	g.PostExternals = true
+	s := httptest.NewServer(g)
+	defer s.Close()
+
+	out := &bytes.Buffer{}
+	r := attachREPL(s.URL+"/", out)
+	expectExec(t, r, out, "ls", "TallyVote", "TallyDone   LBool  bool    scratch")
+	expectExec(t, r, out, `insert TallyNeed 1`, "ok")
+	expectExec(t, r, out, `insert TallyVote "a"`, "ok")
+	if _, err := r.exec("tick"); err == nil {
+		t.Errorf("expected attached tick to fail")
+	}
+	g.Tick()
+	expectExec(t, r, out, "dump TallyDone", "true")
+	expectExec(t, r, out, "joins", "#0  TallyVote  -> tallyTotal")
+}
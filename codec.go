@@ -0,0 +1,807 @@
+package gdec
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+)
+
+// Encodes tuples for the wire.  Decoding needs the tuple type, such
+// as a channel's, while values in interface fields, like Lattice's,
+// and the element types of LSet's are identified by registered ids.
+type Codec interface {
+	Id() byte // Identifies the codec in frames and datagrams.
+	Encode(tuples []interface{}) ([]byte, error)
+	// Struct tuples are decoded as pointers, like in relations.
+	Decode(d *D, t reflect.Type, b []byte) ([]interface{}, error)
+}
+
+var (
+	JSONCodec   Codec = jsonCodec{}
+	GobCodec    Codec = gobCodec{}
+	BinaryCodec Codec = binaryCodec{}
+)
+
+func CodecById(id byte) Codec {
+	for _, c := range []Codec{JSONCodec, GobCodec, BinaryCodec} {
+		if c.Id() == id {
+			return c
+		}
+	}
+	return nil
+}
+
+var codecTypes = struct {
+	m    sync.Mutex
+	byId map[uint64]reflect.Type
+	ids  map[reflect.Type]uint64
+}{
+	byId: map[uint64]reflect.Type{},
+	ids:  map[reflect.Type]uint64{},
+}
+
+// Registers the type of x under an id, for values of x's type in
+// interface fields, and for LSet's of x's type.  Ids below 100 are
+// reserved for gdec.
+func RegisterType(id uint64, x interface{}) {
+	t := reflect.TypeOf(x)
+	codecTypes.m.Lock()
+	defer codecTypes.m.Unlock()
+	if o, ok := codecTypes.byId[id]; ok && o != t {
+		panic(fmt.Sprintf("codec type id: %d, registered for: %v, and: %v", id, o, t))
+	}
+	if o, ok := codecTypes.ids[t]; ok && o != id {
+		panic(fmt.Sprintf("codec type: %v, registered as: %d, and: %d", t, o, id))
+	}
+	codecTypes.byId[id] = t
+	codecTypes.ids[t] = id
+}
+
+func codecTypeId(t reflect.Type) (uint64, error) {
+	codecTypes.m.Lock()
+	id, ok := codecTypes.ids[t]
+	codecTypes.m.Unlock()
+	if !ok {
+		return 0, fmt.Errorf("codec: unregistered type: %v", t)
+	}
+	return id, nil
+}
+
+func codecTypeById(id uint64) (reflect.Type, error) {
+	codecTypes.m.Lock()
+	t, ok := codecTypes.byId[id]
+	codecTypes.m.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("codec: unregistered type id: %d", id)
+	}
+	return t, nil
+}
+
+func init() {
+	RegisterType(1, &LMap{})
+	RegisterType(2, &LSet{})
+	RegisterType(3, &LMax{})
+	RegisterType(4, &LMaxString{})
+	RegisterType(5, &LBool{})
+	RegisterType(10, "")
+	RegisterType(11, 0)
+	RegisterType(12, int64(0))
+	RegisterType(13, uint64(0))
+	RegisterType(14, float64(0))
+	RegisterType(15, false)
+	RegisterType(16, []byte(nil))
+
+	gob.Register([]interface{}{})
+	gob.Register(map[string]interface{}{})
+}
+
+// ------------------------------------------------------------------------
+
+// Tuples are first converted to wire values, made of nil, bool,
+// int64, uint64, float64, string, []byte, []interface{} and
+// map[string]interface{}, which the codecs then serialize.  Structs
+// are maps of their exported fields when named, or else lists.
+// Interface values are [type id, value] lists.  Lattices are lists or
+// maps of their contents, where an LSet is [element type id, elements].
+
+func toWire(v reflect.Value, named bool) (interface{}, error) {
+	switch v.Kind() {
+	case reflect.Invalid:
+		return nil, nil
+	case reflect.Interface:
+		if v.IsNil() {
+			return nil, nil
+		}
+		id, err := codecTypeId(v.Elem().Type())
+		if err != nil {
+			return nil, err
+		}
+		w, err := toWire(v.Elem(), named)
+		return []interface{}{id, w}, err
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil, nil
+		}
+		if l, ok := v.Interface().(Lattice); ok {
+			return latticeToWire(l, named)
+		}
+		return toWire(v.Elem(), named)
+	case reflect.Struct:
+		t := v.Type()
+		m := map[string]interface{}{}
+		l := []interface{}{}
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).PkgPath != "" { // Unexported.
+				continue
+			}
+			w, err := toWire(v.Field(i), named)
+			if err != nil {
+				return nil, err
+			}
+			m[t.Field(i).Name] = w
+			l = append(l, w)
+		}
+		if named {
+			return m, nil
+		}
+		return l, nil
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil, nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return append([]byte(nil), v.Bytes()...), nil
+		}
+		fallthrough
+	case reflect.Array:
+		l := make([]interface{}, v.Len())
+		for i := range l {
+			w, err := toWire(v.Index(i), named)
+			if err != nil {
+				return nil, err
+			}
+			l[i] = w
+		}
+		return l, nil
+	case reflect.Map:
+		if v.IsNil() {
+			return nil, nil
+		}
+		if v.Type().Key().Kind() == reflect.String {
+			m := map[string]interface{}{}
+			for _, k := range v.MapKeys() {
+				w, err := toWire(v.MapIndex(k), named)
+				if err != nil {
+					return nil, err
+				}
+				m[k.String()] = w
+			}
+			return m, nil
+		}
+		l := []interface{}{}
+		for _, k := range v.MapKeys() {
+			kw, err := toWire(k, named)
+			if err != nil {
+				return nil, err
+			}
+			vw, err := toWire(v.MapIndex(k), named)
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, []interface{}{kw, vw})
+		}
+		return l, nil
+	case reflect.Bool:
+		return v.Bool(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint(), nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	case reflect.String:
+		return v.String(), nil
+	}
+	return nil, fmt.Errorf("codec: unsupported type: %v", v.Type())
+}
+
+func latticeToWire(l Lattice, named bool) (interface{}, error) {
+	switch x := l.(type) {
+	case *LMap:
+		m := map[string]interface{}{}
+		var err error
+		x.each(func(k string, v Lattice) {
+			if err == nil {
+				m[k], err = toWire(reflect.ValueOf(&v).Elem(), named)
+			}
+		})
+		return m, err
+	case *LSet:
+		et := x.t
+		if et.Kind() == reflect.Ptr && et.Elem().Kind() == reflect.Struct {
+			et = et.Elem() // Like from NewLSetOne(), decoded as pointers anyway.
+		}
+		id, err := codecTypeId(et)
+		if err != nil {
+			return nil, err
+		}
+		l := []interface{}{}
+		x.each(func(v interface{}) {
+			if err == nil {
+				var w interface{}
+				w, err = toWire(reflect.ValueOf(v), named)
+				l = append(l, w)
+			}
+		})
+		return []interface{}{id, l}, err
+	case *LMax:
+		return int64(x.v), nil
+	case *LMaxString:
+		return x.v, nil
+	case *LBool:
+		return x.v, nil
+	}
+	return nil, fmt.Errorf("codec: unsupported lattice: %T", l)
+}
+
+func fromWire(d *D, t reflect.Type, w interface{}) (reflect.Value, error) {
+	bad := func() (reflect.Value, error) {
+		return reflect.Value{}, fmt.Errorf("codec: can't decode: %#v, into: %v", w, t)
+	}
+	if w == nil {
+		return reflect.Zero(t), nil
+	}
+	switch t.Kind() {
+	case reflect.Interface:
+		l, ok := w.([]interface{})
+		if !ok || len(l) != 2 {
+			return bad()
+		}
+		id, err := wireUint(l[0])
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		et, err := codecTypeById(id)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		if !et.AssignableTo(t) {
+			return bad()
+		}
+		ev, err := fromWire(d, et, l[1])
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		if ev.Kind() == reflect.Ptr && ev.IsNil() { // Not a nil interface.
+			return bad()
+		}
+		v := reflect.New(t).Elem()
+		v.Set(ev)
+		return v, nil
+	case reflect.Ptr:
+		if t.Implements(reflect.TypeOf((*Lattice)(nil)).Elem()) {
+			l, err := latticeFromWire(d, t, w)
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			return reflect.ValueOf(l), nil
+		}
+		ev, err := fromWire(d, t.Elem(), w)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		p := reflect.New(t.Elem())
+		p.Elem().Set(ev)
+		return p, nil
+	case reflect.Struct:
+		v := reflect.New(t).Elem()
+		m, named := w.(map[string]interface{})
+		l, _ := w.([]interface{})
+		if !named && l == nil {
+			return bad()
+		}
+		j := 0
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).PkgPath != "" {
+				continue
+			}
+			var fw interface{}
+			if named {
+				fw = m[t.Field(i).Name]
+			} else if j < len(l) {
+				fw = l[j]
+			}
+			j++
+			fv, err := fromWire(d, t.Field(i).Type, fw)
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			v.Field(i).Set(fv)
+		}
+		return v, nil
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 && t.Kind() == reflect.Slice {
+			switch b := w.(type) {
+			case []byte:
+				return reflect.ValueOf(append([]byte(nil), b...)).Convert(t), nil
+			case string: // From JSON.
+				x, err := base64.StdEncoding.DecodeString(b)
+				if err != nil {
+					return reflect.Value{}, err
+				}
+				return reflect.ValueOf(x).Convert(t), nil
+			}
+		}
+		l, ok := w.([]interface{})
+		if !ok {
+			return bad()
+		}
+		var v reflect.Value
+		if t.Kind() == reflect.Slice {
+			v = reflect.MakeSlice(t, len(l), len(l))
+		} else if len(l) == t.Len() {
+			v = reflect.New(t).Elem()
+		} else {
+			return bad()
+		}
+		for i, x := range l {
+			ev, err := fromWire(d, t.Elem(), x)
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			v.Index(i).Set(ev)
+		}
+		return v, nil
+	case reflect.Map:
+		v := reflect.MakeMap(t)
+		if m, ok := w.(map[string]interface{}); ok && t.Key().Kind() == reflect.String {
+			for k, x := range m {
+				ev, err := fromWire(d, t.Elem(), x)
+				if err != nil {
+					return reflect.Value{}, err
+				}
+				v.SetMapIndex(reflect.ValueOf(k).Convert(t.Key()), ev)
+			}
+			return v, nil
+		}
+		l, ok := w.([]interface{})
+		if !ok {
+			return bad()
+		}
+		for _, x := range l {
+			kv, ok := x.([]interface{})
+			if !ok || len(kv) != 2 {
+				return bad()
+			}
+			k, err := fromWire(d, t.Key(), kv[0])
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			ev, err := fromWire(d, t.Elem(), kv[1])
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			v.SetMapIndex(k, ev)
+		}
+		return v, nil
+	case reflect.Bool:
+		b, ok := w.(bool)
+		if !ok {
+			return bad()
+		}
+		return reflect.ValueOf(b).Convert(t), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := wireInt(w)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		return reflect.ValueOf(i).Convert(t), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := wireUint(w)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		return reflect.ValueOf(u).Convert(t), nil
+	case reflect.Float32, reflect.Float64:
+		f, err := wireFloat(w)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		return reflect.ValueOf(f).Convert(t), nil
+	case reflect.String:
+		s, ok := w.(string)
+		if !ok {
+			return bad()
+		}
+		return reflect.ValueOf(s).Convert(t), nil
+	}
+	return bad()
+}
+
+func latticeFromWire(d *D, t reflect.Type, w interface{}) (Lattice, error) {
+	bad := fmt.Errorf("codec: can't decode: %#v, into: %v", w, t)
+	switch t {
+	case reflect.TypeOf(&LMap{}):
+		m, ok := w.(map[string]interface{})
+		if !ok {
+			return nil, bad
+		}
+		l := d.NewLMap()
+		for k, x := range m {
+			v, err := fromWire(d, reflect.TypeOf((*Lattice)(nil)).Elem(), x)
+			if err != nil {
+				return nil, err
+			}
+			if !v.IsNil() {
+				l.m.Put(k, v.Interface().(Lattice))
+			}
+		}
+		return l, nil
+	case reflect.TypeOf(&LSet{}):
+		x, ok := w.([]interface{})
+		if !ok || len(x) != 2 {
+			return nil, bad
+		}
+		id, err := wireUint(x[0])
+		if err != nil {
+			return nil, err
+		}
+		et, err := codecTypeById(id)
+		if err != nil {
+			return nil, err
+		}
+		elems, _ := x[1].([]interface{})
+		l := d.NewLSet(et)
+		for _, e := range elems {
+			if e == nil {
+				return nil, bad
+			}
+			v, err := fromWire(d, et, e)
+			if err != nil {
+				return nil, err
+			}
+			if et.Kind() == reflect.Struct { // Like tuples in relations.
+				p := reflect.New(et)
+				p.Elem().Set(v)
+				v = p
+			}
+			if _, err := lsetKey(v.Interface()); err != nil {
+				return nil, fmt.Errorf("codec: bad LSet element: %v", err)
+			}
+			l.DirectAdd(v.Interface())
+		}
+		return l, nil
+	case reflect.TypeOf(&LMax{}):
+		i, err := wireInt(w)
+		if err != nil {
+			return nil, err
+		}
+		l := d.NewLMax()
+		l.v = int(i)
+		return l, nil
+	case reflect.TypeOf(&LMaxString{}):
+		s, ok := w.(string)
+		if !ok {
+			return nil, bad
+		}
+		l := d.NewLMaxString()
+		l.v = s
+		return l, nil
+	case reflect.TypeOf(&LBool{}):
+		b, ok := w.(bool)
+		if !ok {
+			return nil, bad
+		}
+		l := d.NewLBool()
+		l.v = b
+		return l, nil
+	}
+	return nil, fmt.Errorf("codec: unsupported lattice: %v", t)
+}
+
+func wireInt(w interface{}) (int64, error) {
+	switch x := w.(type) {
+	case int64:
+		return x, nil
+	case uint64:
+		return int64(x), nil
+	case float64:
+		return int64(x), nil
+	case json.Number:
+		return x.Int64()
+	}
+	return 0, fmt.Errorf("codec: not an int: %#v", w)
+}
+
+func wireUint(w interface{}) (uint64, error) {
+	switch x := w.(type) {
+	case int64:
+		return uint64(x), nil
+	case uint64:
+		return x, nil
+	case float64:
+		return uint64(x), nil
+	case json.Number:
+		var u uint64
+		_, err := fmt.Sscan(string(x), &u)
+		return u, err
+	}
+	return 0, fmt.Errorf("codec: not a uint: %#v", w)
+}
+
+func wireFloat(w interface{}) (float64, error) {
+	switch x := w.(type) {
+	case int64:
+		return float64(x), nil
+	case uint64:
+		return float64(x), nil
+	case float64:
+		return x, nil
+	case json.Number:
+		return x.Float64()
+	}
+	return 0, fmt.Errorf("codec: not a float: %#v", w)
+}
+
+func tuplesToWire(tuples []interface{}, named bool) ([]interface{}, error) {
+	res := make([]interface{}, len(tuples))
+	for i, x := range tuples {
+		w, err := toWire(reflect.ValueOf(x), named)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = w
+	}
+	return res, nil
+}
+
+func tuplesFromWire(d *D, t reflect.Type, w interface{}) ([]interface{}, error) {
+	l, ok := w.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("codec: expected a list of tuples, got: %#v", w)
+	}
+	res := make([]interface{}, len(l))
+	for i, x := range l {
+		if x == nil {
+			return nil, fmt.Errorf("codec: nil tuple, type: %v", t)
+		}
+		v, err := fromWire(d, t, x)
+		if err != nil {
+			return nil, err
+		}
+		if t.Kind() == reflect.Struct {
+			p := reflect.New(t)
+			p.Elem().Set(v)
+			v = p
+		}
+		if _, err := lsetKey(v.Interface()); err != nil {
+			return nil, fmt.Errorf("codec: bad tuple: %v", err)
+		}
+		res[i] = v.Interface()
+	}
+	return res, nil
+}
+
+// ------------------------------------------------------------------------
+
+// JSON with structs as objects, so it's readable and accepts tuples
+// written by hand, such as for the HTTPGateway.
+type jsonCodec struct{}
+
+func (c jsonCodec) Id() byte { return 1 }
+
+func (c jsonCodec) Encode(tuples []interface{}) ([]byte, error) {
+	w, err := tuplesToWire(tuples, true)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(w)
+}
+
+func (c jsonCodec) Decode(d *D, t reflect.Type, b []byte) ([]interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var w interface{}
+	if err := dec.Decode(&w); err != nil {
+		return nil, err
+	}
+	return tuplesFromWire(d, t, w)
+}
+
+type gobCodec struct{}
+
+func (c gobCodec) Id() byte { return 2 }
+
+func (c gobCodec) Encode(tuples []interface{}) ([]byte, error) {
+	w, err := tuplesToWire(tuples, false)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = gob.NewEncoder(&buf).Encode(w)
+	return buf.Bytes(), err
+}
+
+func (c gobCodec) Decode(d *D, t reflect.Type, b []byte) ([]interface{}, error) {
+	var w []interface{}
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&w); err != nil {
+		return nil, err
+	}
+	return tuplesFromWire(d, t, w)
+}
+
+// Compact binary, where each wire value is a tag byte followed by
+// varints, lengths and contents, and structs are lists of fields.
+type binaryCodec struct{}
+
+const (
+	binNil = byte(iota)
+	binFalse
+	binTrue
+	binInt
+	binUint
+	binFloat
+	binString
+	binBytes
+	binList
+	binMap
+)
+
+func (c binaryCodec) Id() byte { return 3 }
+
+func (c binaryCodec) Encode(tuples []interface{}) ([]byte, error) {
+	w, err := tuplesToWire(tuples, false)
+	if err != nil {
+		return nil, err
+	}
+	return binaryAppend(nil, w)
+}
+
+func (c binaryCodec) Decode(d *D, t reflect.Type, b []byte) ([]interface{}, error) {
+	w, rest, err := binaryRead(b)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("codec: %d trailing bytes", len(rest))
+	}
+	return tuplesFromWire(d, t, w)
+}
+
+func binaryAppend(b []byte, w interface{}) ([]byte, error) {
+	var tmp [binary.MaxVarintLen64]byte
+	uvarint := func(b []byte, u uint64) []byte {
+		return append(b, tmp[:binary.PutUvarint(tmp[:], u)]...)
+	}
+	switch x := w.(type) {
+	case nil:
+		return append(b, binNil), nil
+	case bool:
+		if x {
+			return append(b, binTrue), nil
+		}
+		return append(b, binFalse), nil
+	case int64:
+		b = append(b, binInt)
+		return append(b, tmp[:binary.PutVarint(tmp[:], x)]...), nil
+	case uint64:
+		return uvarint(append(b, binUint), x), nil
+	case float64:
+		return uvarint(append(b, binFloat), math.Float64bits(x)), nil
+	case string:
+		return append(uvarint(append(b, binString), uint64(len(x))), x...), nil
+	case []byte:
+		return append(uvarint(append(b, binBytes), uint64(len(x))), x...), nil
+	case []interface{}:
+		b = uvarint(append(b, binList), uint64(len(x)))
+		var err error
+		for _, e := range x {
+			if b, err = binaryAppend(b, e); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case map[string]interface{}:
+		b = uvarint(append(b, binMap), uint64(len(x)))
+		var err error
+		for k, e := range x {
+			b = append(uvarint(b, uint64(len(k))), k...)
+			if b, err = binaryAppend(b, e); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("codec: unsupported wire value: %#v", w)
+}
+
+func binaryRead(b []byte) (interface{}, []byte, error) {
+	short := fmt.Errorf("codec: short binary value")
+	uvarint := func(b []byte) (uint64, []byte, error) {
+		u, n := binary.Uvarint(b)
+		if n <= 0 {
+			return 0, nil, short
+		}
+		return u, b[n:], nil
+	}
+	str := func(b []byte) ([]byte, []byte, error) {
+		n, b, err := uvarint(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		if uint64(len(b)) < n {
+			return nil, nil, short
+		}
+		return b[:n], b[n:], nil
+	}
+	if len(b) <= 0 {
+		return nil, nil, short
+	}
+	tag, b := b[0], b[1:]
+	switch tag {
+	case binNil:
+		return nil, b, nil
+	case binFalse:
+		return false, b, nil
+	case binTrue:
+		return true, b, nil
+	case binInt:
+		i, n := binary.Varint(b)
+		if n <= 0 {
+			return nil, nil, short
+		}
+		return i, b[n:], nil
+	case binUint:
+		return uvarint(b)
+	case binFloat:
+		u, b, err := uvarint(b)
+		return math.Float64frombits(u), b, err
+	case binString:
+		s, b, err := str(b)
+		return string(s), b, err
+	case binBytes:
+		s, b, err := str(b)
+		return append([]byte(nil), s...), b, err
+	case binList:
+		n, b, err := uvarint(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		if n > uint64(len(b)) { // Each element takes at least a byte.
+			return nil, nil, short
+		}
+		l := make([]interface{}, n)
+		for i := range l {
+			if l[i], b, err = binaryRead(b); err != nil {
+				return nil, nil, err
+			}
+		}
+		return l, b, nil
+	case binMap:
+		n, b, err := uvarint(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		if n > uint64(len(b)) {
+			return nil, nil, short
+		}
+		m := make(map[string]interface{}, n)
+		for i := uint64(0); i < n; i++ {
+			var k []byte
+			if k, b, err = str(b); err != nil {
+				return nil, nil, err
+			}
+			if m[string(k)], b, err = binaryRead(b); err != nil {
+				return nil, nil, err
+			}
+		}
+		return m, b, nil
+	}
+	return nil, nil, fmt.Errorf("codec: unknown binary tag: %d", tag)
+}
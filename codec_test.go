@@ -0,0 +1,202 @@
+package gdec
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type codecTestElem struct {
+	Name string
+	N    int
+}
+
+type codecTestTuple struct {
+	Addr  string `gdec:"addr"`
+	N     int
+	U     uint8
+	F     float64
+	B     []byte
+	M     map[string]int
+	Pairs map[int][2]int64
+	P     *codecTestElem
+	Val   Lattice
+	Set   *LSet
+}
+
+func init() {
+	RegisterType(1000, codecTestElem{})
+}
+
+func codecTestLattices(d *D) []Lattice {
+	nested := d.NewLMap()
+	nested.DirectAdd(&LMapEntry{"strs", NewLSetOne(d, "a")})
+	nested.At("strs").(*LSet).DirectAdd("b")
+	nested.DirectAdd(&LMapEntry{"elems", NewLSetOne(d, &codecTestElem{"x", 1})})
+	nested.DirectAdd(&LMapEntry{"max", NewLMax(d, -7)})
+	inner := d.NewLMap()
+	inner.DirectAdd(&LMapEntry{"on", NewLBool(d, true)})
+	nested.DirectAdd(&LMapEntry{"inner", inner})
+	s := d.NewLMaxString()
+	s.DirectAdd("hi")
+	return []Lattice{
+		nested,
+		d.NewLMap(),
+		d.NewLSet(reflect.TypeOf(0)),
+		NewLSetOne(d, 42),
+		NewLMax(d, 3),
+		s,
+		NewLBool(d, false),
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	d := NewD("")
+	for _, c := range []Codec{JSONCodec, GobCodec, BinaryCodec} {
+		if CodecById(c.Id()) != c {
+			t.Errorf("expected codec by id: %v", c.Id())
+		}
+		for _, l := range codecTestLattices(d) {
+			in := &codecTestTuple{
+				Addr:  "a",
+				N:     -1,
+				U:     255,
+				F:     1.5,
+				B:     []byte{0, 1, 2},
+				M:     map[string]int{"x": 1},
+				Pairs: map[int][2]int64{3: {4, 5}},
+				P:     &codecTestElem{"p", 2},
+				Val:   l,
+				Set:   NewLSetOne(d, "s"),
+			}
+			b, err := c.Encode([]interface{}{in, &codecTestTuple{}})
+			if err != nil {
+				t.Fatalf("codec %d: expected encode, got: %v", c.Id(), err)
+			}
+			out, err := c.Decode(d, reflect.TypeOf(codecTestTuple{}), b)
+			if err != nil || len(out) != 2 {
+				t.Fatalf("codec %d: expected decode, got: %v, %v", c.Id(), out, err)
+			}
+			got := out[0].(*codecTestTuple)
+			if !LatticeEqual(got.Val, in.Val) || !LatticeEqual(got.Set, in.Set) {
+				t.Errorf("codec %d: expected lattices to round-trip, got: %#v", c.Id(), got)
+			}
+			got.Val, got.Set, in.Val, in.Set = nil, nil, nil, nil
+			if !reflect.DeepEqual(got, in) {
+				t.Errorf("codec %d: expected %#v, got: %#v", c.Id(), in, got)
+			}
+			if z := out[1].(*codecTestTuple); z.Val != nil || z.P != nil || z.M != nil {
+				t.Errorf("codec %d: expected zero tuple, got: %#v", c.Id(), z)
+			}
+		}
+	}
+}
+
+func TestCodecDecodedLattices(t *testing.T) {
+	d := NewD("")
+	b, err := BinaryCodec.Encode([]interface{}{codecTestLattices(d)[0]})
+	if err != nil {
+		t.Fatalf("expected encode, got: %v", err)
+	}
+	out, err := BinaryCodec.Decode(d, reflect.TypeOf((*LMap)(nil)), b)
+	if err != nil {
+		t.Fatalf("expected decode, got: %v", err)
+	}
+	m := out[0].(*LMap)
+	if x := m.At("elems").(*LSet); !x.Contains(&codecTestElem{"x", 1}) {
+		t.Errorf("expected struct elements as pointers, got: %#v", x.m)
+	}
+	m.At("max").(*LMax).DirectAdd(10)
+	if m.At("max").(*LMax).Int() != 10 || !LatticeEqual(m.Snapshot(), m) {
+		t.Errorf("expected a usable lattice, got: %#v", m)
+	}
+}
+
+func TestCodecErrors(t *testing.T) {
+	d := NewD("")
+	type unregistered struct{ X int }
+	l := NewLSetOne(d, &unregistered{1})
+	if _, err := JSONCodec.Encode([]interface{}{&KVPut{Val: l}}); err == nil {
+		t.Errorf("expected error for an unregistered LSet type")
+	}
+	tt := reflect.TypeOf(KVPut{})
+	for _, bad := range []string{`[{"Val":[999,1]}]`, `[{"Val":[3,"x"]}]`, `[{"Key":1}]`, `{}`} {
+		if _, err := JSONCodec.Decode(d, tt, []byte(bad)); err == nil {
+			t.Errorf("expected error decoding: %s", bad)
+		}
+	}
+	// Malformed input from a peer is an error, rather than a panic.
+	for _, bad := range []string{`[{"Val":[2,[1,[null]]]}]`, `[{"Val":[2,null]}]`,
+		`[{"Val":[1,{"k":[2,[1,[null]]]}]}]`} {
+		if _, err := JSONCodec.Decode(d, tt, []byte(bad)); err == nil {
+			t.Errorf("expected error decoding: %s", bad)
+		}
+	}
+	d.DeclareChannel("codecTestChannel", KVPut{})
+	if _, err := decodeTuples(d, JSONCodec, "codecTestChannel",
+		[]byte(`[{"Key":"k","Val":[2,[10,["a",null]]]}]`)); err == nil {
+		t.Errorf("expected error decoding a nil LSet element")
+	}
+	if _, err := decodeTuples(d, JSONCodec, "codecTestChannel", []byte(`[null]`)); err == nil {
+		t.Errorf("expected error decoding a nil tuple")
+	}
+	nan, _ := BinaryCodec.Encode([]interface{}{&codecTestTuple{F: math.NaN()}})
+	if _, err := BinaryCodec.Decode(d, reflect.TypeOf(codecTestTuple{}), nan); err == nil {
+		t.Errorf("expected error decoding a tuple that can't be keyed")
+	}
+
+	b, _ := BinaryCodec.Encode([]interface{}{&KVPut{Key: "k", Val: NewLMax(d, 1)}})
+	for i := 0; i < len(b); i++ {
+		if _, err := BinaryCodec.Decode(d, tt, b[:i]); err == nil {
+			t.Errorf("expected error decoding a truncated value, at: %d", i)
+		}
+	}
+}
+
+func TestKVClientTCP(t *testing.T) {
+	server := KVInit(NewD("127.0.0.1:0"), "")
+	ts, err := NewTCPTransport(server)
+	if err != nil {
+		t.Fatalf("expected listen, got: %v", err)
+	}
+	defer ts.Close()
+	ts.Codec = BinaryCodec
+	client := NewD("127.0.0.1:0")
+	c := NewKVClient(client, "", server.Addr)
+	tc, err := NewTCPTransport(client)
+	if err != nil {
+		t.Fatalf("expected listen, got: %v", err)
+	}
+	defer tc.Close()
+	c.ServerAddr = server.Addr
+
+	stop := make(chan bool)
+	stopped := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				close(stopped)
+				return
+			case <-time.After(time.Millisecond):
+				server.Tick()
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+
+	ctx := context.Background()
+	val := codecTestLattices(client)[0]
+	if err := c.Put(ctx, "k", val); err != nil {
+		t.Fatalf("expected put to work, got: %v", err)
+	}
+	v, err := c.Get(ctx, "k")
+	if err != nil || !LatticeEqual(v, val) {
+		t.Errorf("expected nested lattice over TCP, got: %#v, %v", v, err)
+	}
+}
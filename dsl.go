@@ -0,0 +1,773 @@
+package gdec
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A small rule language, parsed into joins on a D.  Each rule is:
+//
+//   head <= sources [where cond] [select projection]
+//
+// where <= adds to the head during the tick, and <+ during the next
+// tick, like IntoAsync().  Sources are relation names, joined by *,
+// each optionally aliased with "as".  The projection is an expression,
+// or {Field: expr, ...} to build a head struct tuple, and may be left
+// out when there's one source of the head's tuple type.  For example:
+//
+//   ShortestPath <= ShortestPathLink as l * ShortestPath as p
+//     where l.To == p.From
+//     select {From: l.From, To: p.To, Next: l.To, Cost: l.Cost + p.Cost}
+//
+//   TallyDone <= select size(tallyTotal) >= TallyNeed
+//
+// Expressions have int, float, string and bool literals, source
+// fields, the values of LMax, LMaxString and LBool relations, size()
+// of an LSet or LMap, parentheses and the operators of Go: || && ==
+// != < <= > >= + - * / % and unary ! -.  Rules are type checked
+// against the relations' tuple types.  Heads may be LSet's, LMax's,
+// LMaxString's or LBool's.  Comments start with // or #.
+//
+// An integer / or % by zero, or a value that overflows its field or
+// head, such as 300 for an int8, has no value, so the rule gives
+// nothing for that join, as if its where were false.
+
+// Parses rules, with relation names given without the prefix, and
+// declares their joins, or declares nothing on an error.
+func (d *D) Rules(prefix string, src string) error {
+	toks, err := dslLex(src)
+	if err != nil {
+		return err
+	}
+	p := &dslParser{d: d, prefix: prefix, toks: toks}
+	var rules []*dslRule
+	for !p.at(dslEOF, "") {
+		if p.at(dslOp, ";") {
+			p.pos++
+			continue
+		}
+		r, err := p.rule()
+		if err != nil {
+			return err
+		}
+		rules = append(rules, r)
+	}
+	for _, r := range rules {
+		r.declare(d)
+	}
+	return nil
+}
+
+type dslTokKind int
+
+const (
+	dslEOF dslTokKind = iota
+	dslIdent
+	dslInt
+	dslFloat
+	dslString
+	dslOp
+)
+
+type dslTok struct {
+	kind dslTokKind
+	text string
+	line int
+}
+
+var dslOps = []string{"<=", "<+", ">=", "==", "!=", "&&", "||",
+	"<", ">", "+", "-", "*", "/", "%", "!", "(", ")", "{", "}", ",", ":", ".", ";"}
+
+func dslLex(src string) ([]dslTok, error) {
+	var toks []dslTok
+	line := 1
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#' || strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case c == '_' || unicode.IsLetter(rune(c)):
+			j := i
+			for j < len(src) && (src[j] == '_' || unicode.IsLetter(rune(src[j])) ||
+				unicode.IsDigit(rune(src[j]))) {
+				j++
+			}
+			toks = append(toks, dslTok{dslIdent, src[i:j], line})
+			i = j
+		case unicode.IsDigit(rune(c)):
+			j, kind := i, dslInt
+			for j < len(src) && (unicode.IsDigit(rune(src[j])) || src[j] == '.') {
+				if src[j] == '.' {
+					kind = dslFloat
+				}
+				j++
+			}
+			toks = append(toks, dslTok{kind, src[i:j], line})
+			i = j
+		case c == '"':
+			j := i + 1
+			for j < len(src) && src[j] != '"' && src[j] != '\n' {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) || src[j] != '"' {
+				return nil, fmt.Errorf("rules line %d: unterminated string", line)
+			}
+			s, err := strconv.Unquote(src[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("rules line %d: bad string: %v", line, err)
+			}
+			toks = append(toks, dslTok{dslString, s, line})
+			i = j + 1
+		default:
+			op := ""
+			for _, o := range dslOps {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("rules line %d: unexpected char: %q", line, c)
+			}
+			toks = append(toks, dslTok{dslOp, op, line})
+			i += len(op)
+		}
+	}
+	return append(toks, dslTok{dslEOF, "", line}), nil
+}
+
+// The types of expression values, which are int64, float64, string
+// or bool during evaluation.
+type dslType int
+
+const (
+	dslTInvalid dslType = iota
+	dslTInt
+	dslTFloat
+	dslTString
+	dslTBool
+)
+
+func (t dslType) String() string {
+	return [...]string{"invalid", "int", "float", "string", "bool"}[t]
+}
+
+func dslTypeOf(t reflect.Type) dslType {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return dslTInt
+	case reflect.Float32, reflect.Float64:
+		return dslTFloat
+	case reflect.String:
+		return dslTString
+	case reflect.Bool:
+		return dslTBool
+	}
+	return dslTInvalid
+}
+
+// True when a value of type from may be stored as type to.
+func dslAssignable(from, to dslType) bool {
+	return from == to || (from == dslTInt && to == dslTFloat)
+}
+
+func dslValue(v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
+	case reflect.String:
+		return v.String()
+	case reflect.Bool:
+		return v.Bool()
+	}
+	return nil
+}
+
+func dslToFloat(x interface{}) float64 {
+	if i, ok := x.(int64); ok {
+		return float64(i)
+	}
+	return x.(float64)
+}
+
+// Args are the join's tuples, as pointers.
+type dslExpr struct {
+	t    dslType
+	eval func(args []reflect.Value) interface{}
+}
+
+type dslSource struct {
+	alias string
+	r     Relation
+}
+
+type dslRule struct {
+	head    Relation
+	async   bool
+	sources []dslSource
+	where   *dslExpr
+	make    func(args []reflect.Value) interface{}
+	reads   []Relation
+}
+
+// Panicked by an expression without a value, see Rules().
+type dslUndefined struct {
+	reason string
+}
+
+// Declares the rule's join, whose select func returns a pointer to the
+// head's tuple, or nil when the where is false.
+func (r *dslRule) declare(d *D) {
+	ins := make([]reflect.Type, len(r.sources))
+	vars := make([]interface{}, 0, len(r.sources)+1)
+	for i, s := range r.sources {
+		ins[i] = reflect.PtrTo(s.r.TupleType())
+		vars = append(vars, s.r)
+	}
+	ht := r.head.TupleType()
+	out := reflect.PtrTo(ht)
+	fn := reflect.MakeFunc(reflect.FuncOf(ins, []reflect.Type{out}, false),
+		func(args []reflect.Value) (res []reflect.Value) {
+			res = []reflect.Value{reflect.Zero(out)}
+			defer func() {
+				if x := recover(); x != nil {
+					if _, ok := x.(dslUndefined); !ok {
+						panic(x)
+					}
+				}
+			}()
+			if r.where != nil && !r.where.eval(args).(bool) {
+				return res
+			}
+			v := reflect.ValueOf(r.make(args))
+			if v.Type() != out {
+				p := reflect.New(ht)
+				p.Elem().Set(v)
+				v = p
+			}
+			res[0] = v
+			return res
+		})
+	jd := d.Join(append(vars, fn.Interface())...).Reads(r.reads...)
+	if r.async {
+		jd.IntoAsync(r.head)
+	} else {
+		jd.Into(r.head)
+	}
+}
+
+// Converts a value to a field or head type, where a value that
+// overflows the type is undefined.
+func dslConvert(x interface{}, t reflect.Type) reflect.Value {
+	z := reflect.Zero(t)
+	overflow := false
+	switch i := x.(type) {
+	case int64:
+		switch t.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			overflow = z.OverflowInt(i)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			overflow = i < 0 || z.OverflowUint(uint64(i))
+		}
+	case float64:
+		if t.Kind() == reflect.Float32 {
+			overflow = z.OverflowFloat(i)
+		}
+	}
+	if overflow {
+		panic(dslUndefined{fmt.Sprintf("%v overflows: %v", x, t)})
+	}
+	return reflect.ValueOf(x).Convert(t)
+}
+
+type dslParser struct {
+	d      *D
+	prefix string
+	toks   []dslTok
+	pos    int
+	cur    *dslRule // The rule being parsed.
+}
+
+func (p *dslParser) peek() dslTok { return p.toks[p.pos] }
+
+func (p *dslParser) at(kind dslTokKind, text string) bool {
+	t := p.peek()
+	return t.kind == kind && (text == "" || t.text == text)
+}
+
+func (p *dslParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("rules line %d: %s", p.peek().line, fmt.Sprintf(format, args...))
+}
+
+func (p *dslParser) expect(kind dslTokKind, text string) (dslTok, error) {
+	t := p.peek()
+	if !p.at(kind, text) {
+		if t.kind == dslEOF {
+			return t, p.errorf("unexpected end, expected: %q", text)
+		}
+		return t, p.errorf("unexpected: %q", t.text)
+	}
+	p.pos++
+	return t, nil
+}
+
+func (p *dslParser) relation(name string) (Relation, error) {
+	r := p.d.Relations[p.prefix+name]
+	if r == nil {
+		return nil, p.errorf("unknown relation: %s", name)
+	}
+	return r, nil
+}
+
+func (p *dslParser) rule() (*dslRule, error) {
+	t, err := p.expect(dslIdent, "")
+	if err != nil {
+		return nil, err
+	}
+	head, err := p.relation(t.text)
+	if err != nil {
+		return nil, err
+	}
+	switch head.(type) {
+	case *LSet, *LMax, *LMaxString, *LBool:
+	default:
+		return nil, p.errorf("unsupported head relation: %s, of: %T", t.text, head)
+	}
+	r := &dslRule{head: head}
+	p.cur = r
+	if p.at(dslOp, "<+") {
+		r.async = true
+	} else if !p.at(dslOp, "<=") {
+		return nil, p.errorf("expected <= or <+ after: %s", t.text)
+	}
+	p.pos++
+
+	if !p.at(dslIdent, "where") && !p.at(dslIdent, "select") {
+		for {
+			t, err := p.expect(dslIdent, "")
+			if err != nil {
+				return nil, err
+			}
+			s := dslSource{alias: t.text}
+			if s.r, err = p.relation(t.text); err != nil {
+				return nil, err
+			}
+			if p.at(dslIdent, "as") {
+				p.pos++
+				a, err := p.expect(dslIdent, "")
+				if err != nil {
+					return nil, err
+				}
+				s.alias = a.text
+			}
+			for _, o := range r.sources {
+				if o.alias == s.alias {
+					return nil, p.errorf("duplicate source: %s, needs an alias", s.alias)
+				}
+			}
+			r.sources = append(r.sources, s)
+			if !p.at(dslOp, "*") {
+				break
+			}
+			p.pos++
+		}
+	}
+
+	if p.at(dslIdent, "where") {
+		p.pos++
+		if r.where, err = p.expr(); err != nil {
+			return nil, err
+		}
+		if r.where.t != dslTBool {
+			return nil, p.errorf("where should be bool, not: %v", r.where.t)
+		}
+	}
+
+	ht := head.TupleType()
+	if !p.at(dslIdent, "select") {
+		if len(r.sources) != 1 || r.sources[0].r.TupleType() != ht {
+			return nil, p.errorf("select needed, as sources don't match head: %v", ht)
+		}
+		if ht.Kind() == reflect.Struct {
+			r.make = func(args []reflect.Value) interface{} { return args[0].Interface() }
+		} else {
+			r.make = func(args []reflect.Value) interface{} { return args[0].Elem().Interface() }
+		}
+		return r, nil
+	}
+	p.pos++
+
+	if p.at(dslOp, "{") {
+		if ht.Kind() != reflect.Struct {
+			return nil, p.errorf("{...} select needs a struct head, not: %v", ht)
+		}
+		return r, p.projection(ht)
+	}
+	e, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if !dslAssignable(e.t, dslTypeOf(ht)) {
+		return nil, p.errorf("select of: %v, doesn't match head: %v", e.t, ht)
+	}
+	r.make = func(args []reflect.Value) interface{} {
+		return dslConvert(e.eval(args), ht).Interface()
+	}
+	return r, nil
+}
+
+func (p *dslParser) projection(ht reflect.Type) error {
+	p.pos++ // The "{".
+	type field struct {
+		index []int
+		t     reflect.Type
+		e     *dslExpr
+	}
+	var fields []field
+	for !p.at(dslOp, "}") {
+		if len(fields) > 0 {
+			if _, err := p.expect(dslOp, ","); err != nil {
+				return err
+			}
+			if p.at(dslOp, "}") {
+				break
+			}
+		}
+		t, err := p.expect(dslIdent, "")
+		if err != nil {
+			return err
+		}
+		sf, ok := ht.FieldByName(t.text)
+		if !ok || sf.PkgPath != "" {
+			return p.errorf("no field: %s, in: %v", t.text, ht)
+		}
+		if _, err := p.expect(dslOp, ":"); err != nil {
+			return err
+		}
+		e, err := p.expr()
+		if err != nil {
+			return err
+		}
+		if !dslAssignable(e.t, dslTypeOf(sf.Type)) {
+			return p.errorf("field: %s, of: %v, can't be: %v", t.text, sf.Type, e.t)
+		}
+		fields = append(fields, field{sf.Index, sf.Type, e})
+	}
+	p.pos++
+	p.cur.make = func(args []reflect.Value) interface{} {
+		v := reflect.New(ht)
+		for _, f := range fields {
+			v.Elem().FieldByIndex(f.index).Set(dslConvert(f.e.eval(args), f.t))
+		}
+		return v.Interface()
+	}
+	return nil
+}
+
+var dslPrecedence = map[string]int{
+	"||": 1, "&&": 2,
+	"==": 3, "!=": 3, "<": 3, "<=": 3, ">": 3, ">=": 3,
+	"+": 4, "-": 4, "*": 5, "/": 5, "%": 5,
+}
+
+func (p *dslParser) expr() (*dslExpr, error) {
+	return p.binary(1)
+}
+
+func (p *dslParser) binary(prec int) (*dslExpr, error) {
+	x, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		op := t.text
+		if t.kind != dslOp || dslPrecedence[op] < prec {
+			return x, nil
+		}
+		p.pos++
+		y, err := p.binary(dslPrecedence[op] + 1)
+		if err != nil {
+			return nil, err
+		}
+		if x, err = p.binaryOp(op, x, y); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *dslParser) binaryOp(op string, x, y *dslExpr) (*dslExpr, error) {
+	xe, ye := x.eval, y.eval
+	numeric := (x.t == dslTInt || x.t == dslTFloat) && (y.t == dslTInt || y.t == dslTFloat)
+	float := numeric && (x.t == dslTFloat || y.t == dslTFloat)
+	mismatch := p.errorf("mismatched types: %v %s %v", x.t, op, y.t)
+	switch op {
+	case "||", "&&":
+		if x.t != dslTBool || y.t != dslTBool {
+			return nil, mismatch
+		}
+		if op == "||" {
+			return &dslExpr{dslTBool, func(a []reflect.Value) interface{} {
+				return xe(a).(bool) || ye(a).(bool)
+			}}, nil
+		}
+		return &dslExpr{dslTBool, func(a []reflect.Value) interface{} {
+			return xe(a).(bool) && ye(a).(bool)
+		}}, nil
+	case "==", "!=":
+		if x.t != y.t && !numeric {
+			return nil, mismatch
+		}
+		return &dslExpr{dslTBool, func(a []reflect.Value) interface{} {
+			var eq bool
+			if float {
+				eq = dslToFloat(xe(a)) == dslToFloat(ye(a))
+			} else {
+				eq = xe(a) == ye(a)
+			}
+			return eq == (op == "==")
+		}}, nil
+	case "<", "<=", ">", ">=":
+		if !numeric && (x.t != dslTString || y.t != dslTString) {
+			return nil, mismatch
+		}
+		return &dslExpr{dslTBool, func(a []reflect.Value) interface{} {
+			var c int
+			xv, yv := xe(a), ye(a)
+			if float {
+				c = dslCompare(dslToFloat(xv) < dslToFloat(yv), dslToFloat(xv) > dslToFloat(yv))
+			} else if x.t == dslTInt {
+				c = dslCompare(xv.(int64) < yv.(int64), xv.(int64) > yv.(int64))
+			} else {
+				c = strings.Compare(xv.(string), yv.(string))
+			}
+			switch op {
+			case "<":
+				return c < 0
+			case "<=":
+				return c <= 0
+			case ">":
+				return c > 0
+			}
+			return c >= 0
+		}}, nil
+	}
+	// Arithmetic.
+	if op == "+" && x.t == dslTString && y.t == dslTString {
+		return &dslExpr{dslTString, func(a []reflect.Value) interface{} {
+			return xe(a).(string) + ye(a).(string)
+		}}, nil
+	}
+	if !numeric || (op == "%" && float) {
+		return nil, mismatch
+	}
+	if float {
+		return &dslExpr{dslTFloat, func(a []reflect.Value) interface{} {
+			xv, yv := dslToFloat(xe(a)), dslToFloat(ye(a))
+			switch op {
+			case "+":
+				return xv + yv
+			case "-":
+				return xv - yv
+			case "*":
+				return xv * yv
+			}
+			return xv / yv
+		}}, nil
+	}
+	return &dslExpr{dslTInt, func(a []reflect.Value) interface{} {
+		xv, yv := xe(a).(int64), ye(a).(int64)
+		switch op {
+		case "+":
+			return xv + yv
+		case "-":
+			return xv - yv
+		case "*":
+			return xv * yv
+		}
+		if yv == 0 {
+			panic(dslUndefined{"division by zero"})
+		}
+		if op == "/" {
+			return xv / yv
+		}
+		return xv % yv
+	}}, nil
+}
+
+func dslCompare(less, greater bool) int {
+	if less {
+		return -1
+	}
+	if greater {
+		return 1
+	}
+	return 0
+}
+
+func (p *dslParser) unary() (*dslExpr, error) {
+	if p.at(dslOp, "!") || p.at(dslOp, "-") {
+		op := p.peek().text
+		p.pos++
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		xe := x.eval
+		if op == "!" {
+			if x.t != dslTBool {
+				return nil, p.errorf("! of: %v", x.t)
+			}
+			return &dslExpr{dslTBool, func(a []reflect.Value) interface{} { return !xe(a).(bool) }}, nil
+		}
+		switch x.t {
+		case dslTInt:
+			return &dslExpr{dslTInt, func(a []reflect.Value) interface{} { return -xe(a).(int64) }}, nil
+		case dslTFloat:
+			return &dslExpr{dslTFloat, func(a []reflect.Value) interface{} { return -xe(a).(float64) }}, nil
+		}
+		return nil, p.errorf("- of: %v", x.t)
+	}
+	return p.primary()
+}
+
+func (p *dslParser) primary() (*dslExpr, error) {
+	t := p.peek()
+	p.pos++
+	switch t.kind {
+	case dslInt:
+		v, err := strconv.ParseInt(t.text, 10, 64)
+		if err != nil {
+			return nil, p.errorf("bad int: %s", t.text)
+		}
+		return &dslExpr{dslTInt, func([]reflect.Value) interface{} { return v }}, nil
+	case dslFloat:
+		v, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, p.errorf("bad float: %s", t.text)
+		}
+		return &dslExpr{dslTFloat, func([]reflect.Value) interface{} { return v }}, nil
+	case dslString:
+		v := t.text
+		return &dslExpr{dslTString, func([]reflect.Value) interface{} { return v }}, nil
+	case dslOp:
+		if t.text == "(" {
+			x, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			_, err = p.expect(dslOp, ")")
+			return x, err
+		}
+	case dslIdent:
+		switch t.text {
+		case "true", "false":
+			v := t.text == "true"
+			return &dslExpr{dslTBool, func([]reflect.Value) interface{} { return v }}, nil
+		case "size":
+			return p.size()
+		}
+		for i, s := range p.cur.sources {
+			if s.alias == t.text {
+				return p.field(i, s)
+			}
+		}
+		return p.relationValue(t.text)
+	}
+	p.pos--
+	if t.kind == dslEOF {
+		return nil, p.errorf("unexpected end of expression")
+	}
+	return nil, p.errorf("unexpected: %q", t.text)
+}
+
+// A source's tuple, or a field of it, via alias.Field.Field...
+func (p *dslParser) field(i int, s dslSource) (*dslExpr, error) {
+	t := s.r.TupleType()
+	var index []int
+	for p.at(dslOp, ".") {
+		p.pos++
+		f, err := p.expect(dslIdent, "")
+		if err != nil {
+			return nil, err
+		}
+		if t.Kind() != reflect.Struct {
+			return nil, p.errorf("no field: %s, in: %v", f.text, t)
+		}
+		sf, ok := t.FieldByName(f.text)
+		if !ok || sf.PkgPath != "" {
+			return nil, p.errorf("no field: %s, in: %v", f.text, t)
+		}
+		index = append(index, sf.Index...)
+		t = sf.Type
+	}
+	dt := dslTypeOf(t)
+	if dt == dslTInvalid {
+		return nil, p.errorf("unsupported type: %v, of: %s", t, s.alias)
+	}
+	return &dslExpr{dt, func(a []reflect.Value) interface{} {
+		return dslValue(a[i].Elem().FieldByIndex(index))
+	}}, nil
+}
+
+// The value of an LMax, LMaxString or LBool.
+func (p *dslParser) relationValue(name string) (*dslExpr, error) {
+	var e *dslExpr
+	switch x := p.d.Relations[p.prefix+name].(type) {
+	case *LMax:
+		e = &dslExpr{dslTInt, func([]reflect.Value) interface{} { return int64(x.Int()) }}
+	case *LMaxString:
+		e = &dslExpr{dslTString, func([]reflect.Value) interface{} { return x.String() }}
+	case *LBool:
+		e = &dslExpr{dslTBool, func([]reflect.Value) interface{} { return x.Bool() }}
+	case nil:
+		return nil, p.errorf("unknown name: %s", name)
+	default:
+		return nil, p.errorf("relation: %s, of: %T, isn't a value, but may be a source", name, x)
+	}
+	p.cur.reads = append(p.cur.reads, p.d.Relations[p.prefix+name])
+	return e, nil
+}
+
+func (p *dslParser) size() (*dslExpr, error) {
+	if _, err := p.expect(dslOp, "("); err != nil {
+		return nil, err
+	}
+	t, err := p.expect(dslIdent, "")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.expect(dslOp, ")"); err != nil {
+		return nil, err
+	}
+	r, err := p.relation(t.text)
+	if err != nil {
+		return nil, err
+	}
+	p.cur.reads = append(p.cur.reads, r)
+	switch x := r.(type) {
+	case *LSet:
+		return &dslExpr{dslTInt, func([]reflect.Value) interface{} { return int64(x.Size()) }}, nil
+	case *LMap:
+		return &dslExpr{dslTInt, func([]reflect.Value) interface{} { return int64(x.Size()) }}, nil
+	}
+	return nil, p.errorf("size() of: %s, which is a: %T", t.text, r)
+}
@@ -0,0 +1,193 @@
+package gdec
+
+import (
+	"strings"
+	"testing"
+)
+
+// Like ShortestPathInit(), but with rules.
+func dslShortestPathInit(d *D, prefix string) *D {
+	d.External(d.DeclareLSet(prefix+"ShortestPathLink", ShortestPathLink{}))
+	d.DeclareLSet(prefix+"ShortestPath", ShortestPath{})
+	err := d.Rules(prefix, `
+		ShortestPath <= ShortestPathLink as l
+			select {From: l.From, To: l.To, Cost: l.Cost}
+
+		ShortestPath <= ShortestPathLink as l * ShortestPath as p
+			where l.To == p.From
+			select {From: l.From, To: p.To, Next: l.To, Cost: l.Cost + p.Cost}
+	`)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// Like TallyInit(), but with rules.
+func dslTallyInit(d *D, prefix string) *D {
+	d.Input(d.DeclareLSet(prefix+"TallyVote", "voterString"))
+	d.External(d.DeclareLMax(prefix + "TallyNeed"))
+	d.Output(d.DeclareLBool(prefix + "TallyDone"))
+	d.DeclareLSet(prefix+"tallyTotal", "voterString")
+	err := d.Rules(prefix, `
+		tallyTotal <= TallyVote
+		TallyDone <= select size(tallyTotal) >= TallyNeed
+	`)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func TestDSLShortestPath(t *testing.T) {
+	for _, prefix := range []string{"", "sp/"} {
+		d0 := ShortestPathInit(NewD(""), prefix)
+		d1 := dslShortestPathInit(NewD(""), prefix)
+		for _, d := range []*D{d0, d1} {
+			links := d.Relations[prefix+"ShortestPathLink"]
+			d.AddNext(links, &ShortestPathLink{"a", "b", 1})
+			d.AddNext(links, &ShortestPathLink{"b", "c", 2})
+			d.AddNext(links, &ShortestPathLink{"c", "d", 3})
+			d.AddNext(links, &ShortestPathLink{"a", "c", 9})
+			d.Tick()
+		}
+		p0 := d0.Relations[prefix+"ShortestPath"].(*LSet)
+		p1 := d1.Relations[prefix+"ShortestPath"].(*LSet)
+		if p1.Size() != 8 || !LatticeEqual(p0, p1) {
+			t.Errorf("expected the same paths, got: %d vs %d", p0.Size(), p1.Size())
+		}
+		if !p1.Contains(&ShortestPath{"a", "d", "b", 6}) {
+			t.Errorf("expected a path through b")
+		}
+		if err := d1.Validate(); err != nil {
+			t.Errorf("expected valid rules, got: %v", err)
+		}
+	}
+}
+
+func TestDSLTally(t *testing.T) {
+	d := dslTallyInit(NewD(""), "")
+	done := d.Relations["TallyDone"].(*LBool)
+	d.AddNext(d.Relations["TallyNeed"], 2)
+	d.AddNext(d.Relations["TallyVote"], "a")
+	d.Tick()
+	if done.Bool() {
+		t.Errorf("expected not done")
+	}
+	d.AddNext(d.Relations["TallyVote"], "b")
+	d.Tick()
+	if !done.Bool() {
+		t.Errorf("expected done")
+	}
+	if err := d.Validate(); err != nil {
+		t.Errorf("expected valid rules, got: %v", err)
+	}
+}
+
+type dslTestTuple struct {
+	N int8
+	F float64
+	S string
+	B bool
+}
+
+func TestDSLExpressions(t *testing.T) {
+	d := NewD("")
+	in := d.DeclareLSet("in", dslTestTuple{})
+	out := d.DeclareLSet("out", dslTestTuple{})
+	strs := d.DeclareLSet("strs", "")
+	max := d.DeclareLMax("max")
+	name := d.DeclareLMaxString("name")
+	err := d.Rules("", `
+		out <= in as x where x.N % 2 == 0 && !x.B || x.F > 2.5 # Comment.
+			select {N: -x.N * (1 + 2), F: x.N / 2, S: x.S + name, B: x.S < "m"};
+		strs <+ in as x where x.S != "" select x.S + "!"
+		max <= in as x select x.N
+	`)
+	if err != nil {
+		t.Fatalf("expected rules, got: %v", err)
+	}
+	d.AddNext(name, "_n")
+	d.AddNext(in, &dslTestTuple{N: 4, S: "a"})
+	d.AddNext(in, &dslTestTuple{N: 5, F: 3, S: "z", B: true})
+	d.AddNext(in, &dslTestTuple{N: 7})
+	d.Tick()
+	if out.Size() != 2 || !out.Contains(&dslTestTuple{-12, 2, "a_n", true}) ||
+		!out.Contains(&dslTestTuple{-15, 2, "z_n", false}) {
+		t.Errorf("expected projections, got: %#v", out.m)
+	}
+	if max.Int() != 7 || strs.Size() != 0 {
+		t.Errorf("expected max, and no async strs yet, got: %v, %v", max.Int(), strs.Size())
+	}
+	d.Tick()
+	if strs.Size() != 2 || !strs.Contains("a!") {
+		t.Errorf("expected async strs, got: %#v", strs.m)
+	}
+}
+
+func TestDSLUndefined(t *testing.T) {
+	d := NewD("")
+	in := d.DeclareLSet("in", dslTestTuple{})
+	out := d.DeclareLSet("out", dslTestTuple{})
+	max := d.DeclareLMax("max")
+	n := 0
+	d.OnError = func(e *TupleError) { n++ }
+	err := d.Rules("", `
+		out <= in as x where 10 / x.N > 1 select {N: x.N * 100, S: x.S}
+		max <+ in as x select 7 % x.N
+	`)
+	if err != nil {
+		t.Fatalf("expected rules, got: %v", err)
+	}
+	for _, s := range d.JoinStats() {
+		if s.Into == "" || len(s.Writes) != 0 {
+			t.Errorf("expected joins into the heads, got: %#v", s)
+		}
+	}
+	d.AddNext(in, &dslTestTuple{N: 0, S: "zero"})
+	d.AddNext(in, &dslTestTuple{N: 1, S: "one"})
+	d.AddNext(in, &dslTestTuple{N: 2, S: "two"})
+	d.Tick()
+	d.Tick()
+	if out.Size() != 1 || !out.Contains(&dslTestTuple{N: 100, S: "one"}) {
+		t.Errorf("expected no tuples for x / 0 or an int8 overflow, got: %#v", out.m)
+	}
+	if max.Int() != 1 || n != 0 {
+		t.Errorf("expected no value for x %% 0, and no errors, got: %v, %v", max.Int(), n)
+	}
+}
+
+func TestDSLErrors(t *testing.T) {
+	for _, c := range []struct{ rules, err string }{
+		{`nope <= in`, "unknown relation: nope"},
+		{`out <= in as x select {Nope: 1}`, "no field: Nope"},
+		{`out <= in as x select {N: x.S}`, "field: N, of: int8, can't be: string"},
+		{`out <= in as x where x.N select x`, "where should be bool"},
+		{`out <= in as x where x.N + "s" > 1 select x`, "mismatched types: int + string"},
+		{`out <= in * in`, "duplicate source: in"},
+		{`out <= in * strs`, "select needed"},
+		{`max <= in as x select x.S`, "select of: string, doesn't match"},
+		{`max <= select in`, "isn't a value"},
+		{`max <= select size(max)`, "size() of: max"},
+		{`out <= in as x where x.Y`, "no field: Y"},
+		{`out <= in as x where (x.B`, "unexpected end"},
+		{`out in`, "expected <= or <+"},
+		{`out <= in as x where x.S == "a`, "unterminated string"},
+		{`out <= in @`, "unexpected char"},
+		{`m <= in`, "unsupported head relation"},
+	} {
+		d := NewD("")
+		d.DeclareLSet("in", dslTestTuple{})
+		d.DeclareLSet("out", dslTestTuple{})
+		d.DeclareLSet("strs", "")
+		d.DeclareLMax("max")
+		d.DeclareLMap("m")
+		err := d.Rules("", "out <= in\n"+c.rules)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("rules: %s, expected err: %s, got: %v", c.rules, c.err, err)
+		}
+		if len(d.Joins) != 0 {
+			t.Errorf("expected no joins on an error")
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package gdec
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Declaration mistakes, like a redeclared relation or a select func
+// that doesn't match its sources, panic unless D.CollectErrors is
+// set, in which case they're collected for D.Err(), and the broken
+// declaration is ignored.
+//
+// Runtime mistakes, like a nil tuple, a tuple of the wrong type or a
+// select func that panics, such as on a bad tuple from the network,
+// and failures of the WAL or a DiskStorage, panic unless D.OnError is
+// set or an error relation is declared via DeclareErrors(), in which
+// case the offending tuple is dropped.  Tuples from the network that
+// don't decode, or are of the wrong type, are only ever reported, as
+// peers shouldn't be able to crash a D.
+
+// Describes a tuple that could not be added to a relation, or on
+// which a join's select func failed.
+type TupleError struct {
+	Relation string // Relation name, join name for select funcs, or "WAL".
+	Tuple    string
+	Err      string
+}
+
+func (e *TupleError) Error() string {
+	return fmt.Sprintf("relation: %s, tuple: %s, err: %s", e.Relation, e.Tuple, e.Err)
+}
+
+// Returns the collected declaration errors, or nil.
+func (d *D) Err() error {
+	return errors.Join(d.errs...)
+}
+
+func (d *D) declError(format string, args ...interface{}) {
+	err := fmt.Errorf(format, args...)
+	if !d.CollectErrors {
+		panic(err.Error())
+	}
+	d.errs = append(d.errs, err)
+}
+
+// Declares a scratch relation of *TupleError, which receives each
+// runtime error during the tick it happens, so rules may react.
+func (d *D) DeclareErrors(name string) *LSet {
+	r := d.DeclareLSet(name, TupleError{})
+	r.DeclareScratch()
+	d.errRelation = r
+	return r
+}
+
+func (d *D) handlesErrors() bool {
+	return d.OnError != nil || d.errRelation != nil
+}
+
+// Invokes f, returning any panic as an error, but only if the D
+// handles errors, so that otherwise panics keep their stacks.
+func (d *D) catch(f func()) (err error) {
+	if !d.handlesErrors() {
+		f()
+		return nil
+	}
+	defer func() {
+		if x := recover(); x != nil {
+			err = fmt.Errorf("%v", x)
+		}
+	}()
+	f()
+	return nil
+}
+
+// Reports an error outside of catch(), panicking like it would.
+func (d *D) runtimeError(name string, tuple interface{}, err error) {
+	if !d.handlesErrors() {
+		panic(err.Error())
+	}
+	d.tupleError(name, tuple, err)
+}
+
+func (d *D) tupleError(name string, tuple interface{}, err error) {
+	d.reportError(&TupleError{Relation: name, Tuple: fmt.Sprintf("%#v", tuple), Err: err.Error()})
+}
+
+func (d *D) reportError(e *TupleError) {
+	if d.seenErrs[*e] { // As the fixpoint repeats joins.
+		return
+	}
+	if d.seenErrs == nil {
+		d.seenErrs = map[TupleError]bool{}
+	}
+	d.seenErrs[*e] = true
+	if d.OnError != nil {
+		d.OnError(e)
+	}
+	if d.errRelation != nil {
+		d.tupleErrs = append(d.tupleErrs, e)
+	}
+}
+
+// Adds pending runtime errors to the error relation, outside of any
+// join's Scan().  Returns true if the error relation changed.
+func (d *D) flushErrors() bool {
+	changed := false
+	for _, e := range d.tupleErrs {
+		c := relationChange{d.errRelation, e, true}
+		if w := d.watch(d.errRelation); w != nil {
+			changed = w.apply(d, c) || changed
+		} else {
+			changed = d.applyChange(c) || changed
+		}
+	}
+	d.tupleErrs = d.tupleErrs[:0]
+	return changed
+}
+
+func (d *D) relationName(r Relation) string {
+	for name, x := range d.Relations {
+		if x == r {
+			return name
+		}
+	}
+	return fmt.Sprintf("%T", r)
+}
@@ -0,0 +1,191 @@
+package gdec
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type errorsTestTuple struct {
+	X int
+}
+
+func TestDeclarationErrors(t *testing.T) {
+	d := NewD("")
+	d.CollectErrors = true
+	a := d.DeclareLSet("a", errorsTestTuple{})
+	b := d.DeclareLSet("b", "")
+	d.DeclareLSet("a", "")
+	d.Join(a, func(x *string) *string { return x }).Into(b)
+	d.Join(a, func(x *errorsTestTuple) *errorsTestTuple { return x }).Into(b)
+	d.Join(a, b).Into(b)
+	d.Join(a, nil)
+	d.Join(a).Into(a) // Fine.
+	d.DeclarePersistent(NewD("").DeclareLSet("c", ""))
+	err := d.Err()
+	if err == nil {
+		t.Fatalf("expected errors")
+	}
+	for _, s := range []string{"redeclared", "param #0", "does not match",
+		"unexpected Into()", "nil passed", "DeclarePersistent() of an undeclared"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("expected error about: %s, got: %v", s, err)
+		}
+	}
+	d.AddNext(a, &errorsTestTuple{1})
+	d.Tick()
+	if a.Size() != 1 || b.Size() != 0 {
+		t.Errorf("expected invalid joins to not run, got: %v, %v", a.Size(), b.Size())
+	}
+
+	d = NewD("")
+	if d.Err() != nil {
+		t.Errorf("expected no errors")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected a panic without CollectErrors")
+		}
+	}()
+	d.DeclareLSet("a", "")
+	d.DeclareLSet("a", "")
+}
+
+func TestRuntimeErrors(t *testing.T) {
+	d := KVInit(NewD("r"), "")
+	errs := d.DeclareErrors("errors")
+	var got []*TupleError
+	d.OnError = func(e *TupleError) { got = append(got, e) }
+	var watched []interface{}
+	d.Watch(errs, func(added []interface{}) { watched = added })
+
+	put := d.Relations["KVPut"]
+	d.AddNext(put, nil)
+	d.AddNext(d.Relations["kvMap"], "not an entry")
+	d.Receive("KVPut", []interface{}{"not a put"}) // Rejected as it's received.
+	d.AddNext(put, &KVPut{ReqId: 2, Addr: "r", ClientAddr: "c", Key: "k", Val: NewLMax(d, 1)})
+	d.Tick()
+	if len(got) != 3 || errs.Size() != len(got) || len(watched) != len(got) {
+		t.Errorf("expected errors, got: %v, %v, %v", got, errs.Size(), len(watched))
+	}
+	for _, e := range got {
+		if e.Relation == "" || e.Err == "" || e.Error() == "" {
+			t.Errorf("expected descriptive error, got: %#v", e)
+		}
+	}
+	if v, _ := d.Relations["kvMap"].(*LMap).At("k").(*LMax); v == nil || v.Int() != 1 {
+		t.Errorf("expected good tuples to be processed, got: %#v", v)
+	}
+	d.Tick()
+	if errs.Size() != 0 {
+		t.Errorf("expected scratch errors, got: %v", errs.Size())
+	}
+}
+
+func TestRuntimeErrorsNotStored(t *testing.T) {
+	d := NewD("")
+	a := d.DeclareLSet("a", errorsTestTuple{})
+	m := d.DeclareLMap("m")
+	n := 0
+	d.OnError = func(e *TupleError) { n++ }
+	d.Join(a, func(x *errorsTestTuple) {})
+	d.AddNext(a, "wrong")
+	d.AddNext(a, &errorsTestTuple{2})
+	d.AddNext(m, &LMapEntry{"k", nil})
+	d.AddNext(m, &LMapEntry{"k", (*LSet)(nil)})
+	d.AddNext(m, d.NewLSet(reflect.TypeOf(""))) // A merge of the wrong lattice.
+	for i := 0; i < 3; i++ {
+		d.Tick()
+	}
+	if n != 4 || a.Size() != 1 || m.Size() != 0 {
+		t.Errorf("expected bad tuples rejected once, got: %v, %v, %v", n, a.Size(), m.Size())
+	}
+}
+
+func TestRuntimeErrorsSideEffects(t *testing.T) {
+	d := NewD("")
+	a := d.DeclareLSet("a", errorsTestTuple{})
+	b := d.DeclareLSet("b", errorsTestTuple{})
+	c := d.DeclareLSet("c", errorsTestTuple{})
+	var got []*TupleError
+	d.OnError = func(e *TupleError) { got = append(got, e) }
+	d.Join(a, func(x *errorsTestTuple) {
+		d.Add(b, x)
+		if x.X == 2 {
+			d.Add(c, x) // Not declared.
+		}
+		if x.X == 3 {
+			d.Add(b, "wrong")
+		}
+	}).Writes(b)
+	for i := 1; i <= 3; i++ {
+		d.AddNext(a, &errorsTestTuple{i})
+	}
+	d.Tick()
+	if len(got) != 2 || !strings.Contains(got[0].Err+got[1].Err, "undeclared relation: c") ||
+		!strings.Contains(got[0].Err+got[1].Err, "tuple of type: string") {
+		t.Errorf("expected side-effect errors, got: %v", got)
+	}
+	if b.Size() != 1 || c.Size() != 0 {
+		t.Errorf("expected only the good call's writes, got: %v, %v", b.Size(), c.Size())
+	}
+
+	// Without Writes(), side-effects are left to Validate().
+	d.Join(a, func(x *errorsTestTuple) { d.Add(c, x) })
+	d.AddNext(a, &errorsTestTuple{4})
+	got = nil
+	d.Tick()
+	if len(got) != 2 || c.Size() != 4 {
+		t.Errorf("expected unchecked writes, got: %v, %v", got, c.Size())
+	}
+}
+
+func TestRuntimeErrorsIO(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gdec-errors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := NewD("")
+	a := d.DeclarePersistent(d.DeclareLSet("a", "")).(*LSet)
+	m := d.DeclareLMap("m")
+	var got []*TupleError
+	d.OnError = func(e *TupleError) { got = append(got, e) }
+	w, err := d.OpenWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	s, err := d.DeclareDiskStorage(m, filepath.Join(dir, "m"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	w.f.Close()
+	s.f.Close()
+	d.AddNext(a, "x")
+	d.AddNext(m, &LMapEntry{"k", NewLMax(d, 1)})
+	d.Tick()
+	if len(got) != 2 || got[0].Relation != "m" || got[1].Relation != "WAL" {
+		t.Errorf("expected storage and WAL errors, got: %v", got)
+	}
+
+	// Bad input from the network is reported, rather than a panic.
+	c := d.DeclareChannel("c", KVPut{})
+	got = nil
+	d.OnError = func(e *TupleError) { got = append(got, e) }
+	tuples, err := decodeTuples(d, JSONCodec, "c", []byte(`[{"Val":[2,[1,[null]]]}]`))
+	if err == nil {
+		t.Errorf("expected a decode error, got: %#v", tuples)
+	}
+	d.receiveError("c", err)
+	d.Receive("c", []interface{}{&KVGet{}})
+	d.Tick()
+	if len(got) < 2 || got[0].Relation != "c" || got[1].Relation != "c" || c.Size() != 0 {
+		t.Errorf("expected network errors, got: %v", got)
+	}
+}
@@ -6,6 +6,8 @@ type KVPut struct {
 	ClientAddr string
 	Key        string
 	Val        Lattice
+	Time       int64 // Unix nanos, where 0 means when received.
+	Expires    int64 // Unix nanos, where 0 means never.
 }
 
 type KVPutResponse struct {
@@ -22,11 +24,21 @@ type KVGet struct {
 }
 
 type KVGetResponse struct {
-	ReqId       int64 `gdec:"key"`
-	Addr        string
+	ReqId       int64  `gdec:"key"`
+	Addr        string `gdec:"addr"`
 	ReplicaAddr string
 	Key         string
 	Val         Lattice
+	Expires     int64 // Unix nanos, where 0 means never.
+}
+
+// Deletes are acked with a KVPutResponse.
+type KVDelete struct {
+	ReqId      int64  `gdec:"key"`
+	Addr       string `gdec:"key,addr"`
+	ClientAddr string
+	Key        string
+	Time       int64 // Unix nanos, where 0 means when received.
 }
 
 func KVProtocolInit(d *D, prefix string) *D {
@@ -34,11 +46,25 @@ func KVProtocolInit(d *D, prefix string) *D {
 	d.DeclareChannel(prefix+"KVPutResponse", KVPutResponse{})
 	d.DeclareChannel(prefix+"KVGet", KVGet{})
 	d.DeclareChannel(prefix+"KVGetResponse", KVGetResponse{})
+	d.DeclareChannel(prefix+"KVDelete", KVDelete{})
 	return d
 }
 
+// The ports of KVProtocolInit(), plus the extra ports.
+func kvProtocolPorts(extra map[string]PortKind) map[string]PortKind {
+	res := map[string]PortKind{"KVPut": PortChannel, "KVPutResponse": PortChannel,
+		"KVGet": PortChannel, "KVGetResponse": PortChannel, "KVDelete": PortChannel}
+	for name, k := range extra {
+		res[name] = k
+	}
+	return res
+}
+
+var kvPorts = map[string]PortKind{"KVMember": PortExternal, "KVTombstone": PortChannel}
+
 // Simple KV replica that merges the values for a key, which works for
-// monotonically increasing LMap's.
+// monotonically increasing LMap's.  Puts may expire, and deletes leave
+// tombstones, see KVDeleteInit().
 
 func KVInit(d *D, prefix string) *D {
 	KVProtocolInit(d, prefix)
@@ -50,18 +76,30 @@ func KVInit(d *D, prefix string) *D {
 
 	kvmap := d.DeclareLMap(prefix + "kvMap")
 
+	d.External(d.DeclareLSet(prefix+"KVMember", "addrString")) // All replicas.
+
+	KVDeleteInit(d, prefix)
+
+	putTime := d.Relations[prefix+"kvPutTime"]
+	expires := d.Relations[prefix+"kvExpires"]
+	tombstone := d.Relations[prefix+"kvTombstone"]
+
 	d.Join(kvput, func(k *KVPut) *KVPutResponse {
 		return &KVPutResponse{k.ReqId, k.ClientAddr, d.Addr}
 	}).IntoAsync(kvputr)
 
 	d.Join(kvget, func(k *KVGet) *KVGetResponse {
+		_, expires := kvEntryTimes(d, prefix, k.Key)
+		if kvExpired(d, expires) {
+			return &KVGetResponse{k.ReqId, k.ClientAddr, d.Addr, k.Key, nil, 0}
+		}
 		return &KVGetResponse{k.ReqId, k.ClientAddr, d.Addr, k.Key,
-			kvmap.At(k.Key)}
-	}).IntoAsync(kvgetr)
+			snapshotLattice(kvmap.At(k.Key)), expires}
+	}).Reads(kvmap, expires).IntoAsync(kvgetr)
 
-	d.Join(kvput, func(k *KVPut) *LMapEntry {
-		return &LMapEntry{k.Key, k.Val}
-	}).Into(kvmap)
+	d.Join(kvput, func(k *KVPut) {
+		kvMergeEntry(d, prefix, k.Key, k.Val, kvStamp(d, k.Time), k.Expires)
+	}).Reads(tombstone).Writes(kvmap, putTime, expires)
 
 	return d
 }
@@ -74,6 +112,7 @@ type KVReplReq struct {
 type KVReplMap struct {
 	Addr  string `gdec:"key,addr"`
 	KVMap *LMap
+	Times map[string][2]int64 // Key: kvMap key, val: put time, expires.
 }
 
 func ReplicatedKVInit(d *D, prefix string) *D {
@@ -83,19 +122,47 @@ func ReplicatedKVInit(d *D, prefix string) *D {
 	kvreplMap := d.DeclareChannel(prefix+"KVReplMap", KVReplMap{})
 
 	kvmap := d.Relations[prefix+"kvMap"].(*LMap)
+	putTime := d.Relations[prefix+"kvPutTime"]
+	expires := d.Relations[prefix+"kvExpires"]
+	tombstone := d.Relations[prefix+"kvTombstone"]
 
 	d.Join(kvreplReq, func(r *KVReplReq) *KVReplMap {
-		return &KVReplMap{r.TargetAddr, kvmap.Snapshot().(*LMap)}
-	}).IntoAsync(kvreplMap)
-
-	d.JoinFlat(kvreplMap, func(r *KVReplMap) *LMap {
-		return r.KVMap
-	}).Into(kvmap)
+		m := &KVReplMap{r.TargetAddr, kvmap.Snapshot().(*LMap),
+			map[string][2]int64{}}
+		m.KVMap.each(func(k string, v Lattice) {
+			t, expires := kvEntryTimes(d, prefix, k)
+			m.Times[k] = [2]int64{t, expires}
+		})
+		return m
+	}).Reads(kvmap, putTime, expires).IntoAsync(kvreplMap)
+
+	d.Join(kvreplMap, func(r *KVReplMap) {
+		r.KVMap.each(func(k string, v Lattice) {
+			kvMergeEntry(d, prefix, k, v, r.Times[k][0], r.Times[k][1])
+		})
+	}).Reads(tombstone).Writes(kvmap, putTime, expires)
+
+	KVAntiEntropyInit(d, prefix) // Cheaper than KVReplReq for large maps.
 
 	return d
 }
 
+var KVModule = &Module{"KV", KVInit, kvProtocolPorts(kvPorts)}
+
+var ReplicatedKVModule = &Module{"ReplicatedKV", ReplicatedKVInit,
+	kvProtocolPorts(map[string]PortKind{
+		"KVMember":       PortExternal,
+		"KVTombstone":    PortChannel,
+		"KVReplReq":      PortChannel,
+		"KVReplMap":      PortChannel,
+		"KVMerkleDigest": PortChannel,
+		"KVMerkleLeaf":   PortChannel,
+		"KVMerkleEntry":  PortChannel,
+	})}
+
 func init() {
 	KVInit(NewD(""), "")
 	ReplicatedKVInit(NewD(""), "")
+	RegisterModule(KVModule)
+	RegisterModule(ReplicatedKVModule)
 }
@@ -0,0 +1,166 @@
+package gdec
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrKVTimeout = errors.New("KVClient: timeout")
+
+// Client of the KV protocol, which owns its own D to send requests
+// and receive responses through a transport.  Each attempt uses a new
+// ReqId, which is safe to retry, as puts merge lattices.
+//
+// With an empty ServerAddr, requests are left unaddressed, for
+// routing by rules like KVRingInit() on the client's D.  The client
+// ticks its D while waiting, and the D may also be Run() elsewhere.
+type KVClient struct {
+	D          *D
+	Prefix     string
+	ServerAddr string
+
+	Timeout      time.Duration // Per attempt.
+	Retries      int           // Attempts after the first one.
+	PollInterval time.Duration // Between ticks of D while waiting.
+
+	m         sync.Mutex // Protects the fields below.
+	lastReqId int64
+	waiting   map[int64]bool
+	responses map[int64]interface{} // Key: ReqId, val: response.
+}
+
+func NewKVClient(d *D, prefix string, serverAddr string) *KVClient {
+	if d.Relations[prefix+"KVPut"] == nil {
+		KVProtocolInit(d, prefix)
+	}
+
+	c := &KVClient{
+		D:            d,
+		Prefix:       prefix,
+		ServerAddr:   serverAddr,
+		Timeout:      time.Second,
+		Retries:      2,
+		PollInterval: time.Millisecond,
+		lastReqId:    time.Now().UnixNano(), // Unique across restarts.
+		waiting:      map[int64]bool{},
+		responses:    map[int64]interface{}{},
+	}
+
+	respond := func(reqId int64, res interface{}) {
+		c.m.Lock()
+		defer c.m.Unlock()
+		if c.waiting[reqId] && c.responses[reqId] == nil {
+			c.responses[reqId] = res
+		}
+	}
+
+	d.Join(d.Relations[prefix+"KVPutResponse"], func(r *KVPutResponse) {
+		if r.Addr == d.Addr {
+			respond(r.ReqId, r)
+		}
+	})
+
+	d.Join(d.Relations[prefix+"KVGetResponse"], func(r *KVGetResponse) {
+		if r.Addr == d.Addr {
+			respond(r.ReqId, r)
+		}
+	})
+
+	return c
+}
+
+func (c *KVClient) Put(ctx context.Context, key string, val Lattice) error {
+	return c.PutTTL(ctx, key, val, 0)
+}
+
+// A ttl of 0 means the put never expires.
+func (c *KVClient) PutTTL(ctx context.Context, key string, val Lattice,
+	ttl time.Duration) error {
+	now := time.Now()
+	var expires int64
+	if ttl > 0 {
+		expires = now.Add(ttl).UnixNano()
+	}
+	_, err := c.request(ctx, func(reqId int64) {
+		c.D.Inject(c.D.Relations[c.Prefix+"KVPut"], &KVPut{ReqId: reqId,
+			Addr: c.ServerAddr, ClientAddr: c.D.Addr, Key: key,
+			Val: val.Snapshot(), Time: now.UnixNano(), Expires: expires})
+	})
+	return err
+}
+
+func (c *KVClient) Delete(ctx context.Context, key string) error {
+	now := time.Now()
+	_, err := c.request(ctx, func(reqId int64) {
+		c.D.Inject(c.D.Relations[c.Prefix+"KVDelete"], &KVDelete{ReqId: reqId,
+			Addr: c.ServerAddr, ClientAddr: c.D.Addr, Key: key,
+			Time: now.UnixNano()})
+	})
+	return err
+}
+
+// Returns nil for a missing key.
+func (c *KVClient) Get(ctx context.Context, key string) (Lattice, error) {
+	res, err := c.request(ctx, func(reqId int64) {
+		c.D.Inject(c.D.Relations[c.Prefix+"KVGet"], &KVGet{ReqId: reqId,
+			Addr: c.ServerAddr, ClientAddr: c.D.Addr, Key: key})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return snapshotLattice(res.(*KVGetResponse).Val), nil
+}
+
+// Sends a request with a new ReqId per attempt, and ticks D until
+// there's a response to any of the attempts.
+func (c *KVClient) request(ctx context.Context, send func(reqId int64)) (
+	interface{}, error) {
+	reqIds := []int64{}
+	defer func() {
+		c.m.Lock()
+		for _, reqId := range reqIds {
+			delete(c.waiting, reqId)
+			delete(c.responses, reqId)
+		}
+		c.m.Unlock()
+	}()
+
+	for attempt := 0; attempt <= c.Retries; attempt++ {
+		c.m.Lock()
+		c.lastReqId++
+		reqId := c.lastReqId
+		reqIds = append(reqIds, reqId)
+		c.waiting[reqId] = true
+		c.m.Unlock()
+		send(reqId)
+
+		deadline := time.Now().Add(c.Timeout)
+		for time.Now().Before(deadline) {
+			c.D.Tick()
+			c.m.Lock()
+			var res interface{}
+			for _, reqId := range reqIds {
+				if res == nil {
+					res = c.responses[reqId]
+				}
+			}
+			c.m.Unlock()
+			if res != nil {
+				return res, nil
+			}
+
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(c.PollInterval):
+			}
+		}
+	}
+	return nil, ErrKVTimeout
+}
+
+func init() {
+	NewKVClient(NewD(""), "", "")
+}
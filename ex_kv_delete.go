@@ -0,0 +1,226 @@
+package gdec
+
+import (
+	"time"
+)
+
+// Deletes and expiring puts for KV replicas.  A delete leaves a
+// tombstone that hides older puts, and replicas gossip tombstones to
+// their KVMember's, along with the vector of replicas known to have
+// the tombstone, until their vector is full.  Replicas with a full
+// vector instead reply to gossip from replicas without one.  After a
+// grace period for late puts, full tombstones are garbage collected,
+// and remembered for another grace period, so that stale gossip
+// doesn't resurrect them.
+//
+// A key's value is whole, so a delete older than the key's last put
+// is ignored, and a put older than the key's tombstone is ignored.  A
+// key expires once all the puts merged into it have expired.
+//
+// Deleted and expired entries are removed from kvMap in place, which
+// neither watches nor a WAL see, so kvMap and the relations here
+// mustn't be declared persistent, as replaying a WAL would resurrect
+// deleted values.  Instead, Checkpoint() a KV, which snapshots it
+// after its removals.  To see deletes, watch kvTombstone.
+
+type KVTombstone struct {
+	Addr  string `gdec:"addr"`
+	From  string
+	Key   string
+	Time  int64
+	Acked []string // Replicas known to have the tombstone.
+}
+
+type KVTombstoneAck struct {
+	Key  string
+	Time int64
+	Addr string
+}
+
+type KVTombstoneCollected struct {
+	Key  string
+	Time int64
+	At   int64 // When collected.
+}
+
+// How often replicas expire entries, and gossip and collect tombstones.
+var KVSweepInterval = time.Second
+
+// How long tombstones and expired entries are kept, at least.
+var KVTombstoneGrace = time.Minute
+
+const kvNever = int(^uint(0) >> 1)
+
+func KVDeleteInit(d *D, prefix string) *D {
+	kvdel := d.Relations[prefix+"KVDelete"]
+	kvputr := d.Relations[prefix+"KVPutResponse"]
+	kvmap := d.Relations[prefix+"kvMap"].(*LMap)
+	member := d.Relations[prefix+"KVMember"].(*LSet)
+
+	putTime := d.DeclareLMap(prefix + "kvPutTime")     // Val: LMax of Unix nanos.
+	expires := d.DeclareLMap(prefix + "kvExpires")     // Val: LMax of Unix nanos.
+	tombstone := d.DeclareLMap(prefix + "kvTombstone") // Val: LMax of Unix nanos.
+	acked := d.DeclareLSet(prefix+"kvTombstoneAck", KVTombstoneAck{})
+	collected := d.DeclareLSet(prefix+"kvTombstoneCollected", KVTombstoneCollected{})
+
+	gossip := d.DeclareChannel(prefix+"KVTombstone", KVTombstone{})
+	sweep := d.DeclarePeriodic(prefix+"kvSweep", KVSweepInterval)
+
+	ackers := func(key string, t int64) []string {
+		res := []string{}
+		for x := range acked.Scan() {
+			if a := x.(*KVTombstoneAck); a.Key == key && a.Time == t {
+				res = append(res, a.Addr)
+			}
+		}
+		return res
+	}
+
+	full := func(a []string) bool {
+		res := true
+		member.each(func(x interface{}) {
+			res = res && containsString(a, x.(string))
+		})
+		return res
+	}
+
+	addTombstone := func(key string, t int64, ackers ...string) {
+		if ts, _ := tombstone.At(key).(*LMax); ts != nil && int64(ts.Int()) > t {
+			return
+		}
+		gone := false
+		collected.each(func(x interface{}) {
+			c := x.(*KVTombstoneCollected)
+			gone = gone || (c.Key == key && c.Time >= t)
+		})
+		if gone {
+			return
+		}
+		d.Add(tombstone, &LMapEntry{key, NewLMax(d, int(t))})
+		d.Add(acked, &KVTombstoneAck{key, t, d.Addr})
+		for _, a := range ackers {
+			d.Add(acked, &KVTombstoneAck{key, t, a})
+		}
+		if pt, _ := putTime.At(key).(*LMax); pt == nil || int64(pt.Int()) <= t {
+			kvmap.remove(key)
+		}
+	}
+
+	d.Join(kvdel, func(k *KVDelete) {
+		addTombstone(k.Key, kvStamp(d, k.Time))
+	}).Reads(tombstone, collected, putTime).Writes(tombstone, acked, kvmap)
+
+	d.Join(kvdel, func(k *KVDelete) *KVPutResponse {
+		return &KVPutResponse{k.ReqId, k.ClientAddr, d.Addr}
+	}).IntoAsync(kvputr)
+
+	d.Join(gossip, func(g *KVTombstone) {
+		if g.Addr != d.Addr {
+			return
+		}
+		theirs := append([]string{g.From}, g.Acked...)
+		addTombstone(g.Key, g.Time, theirs...)
+		mine := append(ackers(g.Key, g.Time), d.Addr)
+		for _, a := range theirs {
+			if !containsString(mine, a) {
+				mine = append(mine, a)
+			}
+		}
+		if full(mine) && !full(theirs) {
+			d.AddNext(gossip, &KVTombstone{g.From, d.Addr, g.Key, g.Time, mine})
+		}
+	}).Reads(tombstone, collected, putTime, acked, member).
+		Writes(tombstone, acked, kvmap, gossip)
+
+	swept := int64(-1)
+
+	d.Join(sweep, func(p *bool) {
+		if !*p || swept == d.ticks { // Collection isn't monotonic, so once per tick.
+			return
+		}
+		swept = d.ticks
+
+		now := int(d.Now().UnixNano())
+		old := now - int(KVTombstoneGrace)
+
+		expires.each(func(k string, v Lattice) {
+			if x := v.(*LMax).Int(); x <= now {
+				kvmap.remove(k)
+				if x <= old {
+					expires.remove(k)
+					putTime.remove(k)
+				}
+			}
+		})
+
+		tombstone.each(func(k string, v Lattice) {
+			t := int64(v.(*LMax).Int())
+			a := ackers(k, t)
+			if !full(a) {
+				for x := range member.Scan() {
+					if m := x.(string); m != d.Addr {
+						d.AddNext(gossip, &KVTombstone{m, d.Addr, k, t, a})
+					}
+				}
+			} else if int(t) <= old {
+				tombstone.remove(k)
+				for _, m := range a {
+					acked.remove(&KVTombstoneAck{k, t, m})
+				}
+				d.Add(collected, &KVTombstoneCollected{k, t, int64(now)})
+			}
+		})
+
+		collected.each(func(x interface{}) {
+			if c := x.(*KVTombstoneCollected); int(c.At) <= old {
+				collected.remove(c)
+			}
+		})
+	}).Reads(expires, tombstone, acked, member, collected).
+		Writes(kvmap, expires, putTime, tombstone, acked, collected, gossip)
+
+	return d
+}
+
+// Merges a put, or an entry from another replica, unless it's older
+// than the key's tombstone or has expired.
+func kvMergeEntry(d *D, prefix string, key string, val Lattice, t, expires int64) {
+	if snapshotLattice(val) == nil || kvExpired(d, expires) {
+		return
+	}
+	ts, _ := d.Relations[prefix+"kvTombstone"].(*LMap).At(key).(*LMax)
+	if ts != nil && int64(ts.Int()) >= t {
+		return
+	}
+	if expires == 0 {
+		expires = int64(kvNever)
+	}
+	d.Add(d.Relations[prefix+"kvMap"], &LMapEntry{key, val})
+	d.Add(d.Relations[prefix+"kvPutTime"], &LMapEntry{key, NewLMax(d, int(t))})
+	d.Add(d.Relations[prefix+"kvExpires"], &LMapEntry{key, NewLMax(d, int(expires))})
+}
+
+// Returns a key's last put time and expiry, where 0 means never.
+func kvEntryTimes(d *D, prefix string, key string) (int64, int64) {
+	var t, expires int64
+	if x, _ := d.Relations[prefix+"kvPutTime"].(*LMap).At(key).(*LMax); x != nil {
+		t = int64(x.Int())
+	}
+	if x, _ := d.Relations[prefix+"kvExpires"].(*LMap).At(key).(*LMax); x != nil &&
+		x.Int() != kvNever {
+		expires = int64(x.Int())
+	}
+	return t, expires
+}
+
+func kvExpired(d *D, expires int64) bool {
+	return expires != 0 && expires <= d.Now().UnixNano()
+}
+
+// Stamps a request that has no time with the current tick's time.
+func kvStamp(d *D, t int64) int64 {
+	if t != 0 {
+		return t
+	}
+	return d.Now().UnixNano()
+}
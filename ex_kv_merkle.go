@@ -0,0 +1,244 @@
+package gdec
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"time"
+)
+
+// Anti-entropy between replicas, where replicas exchange Merkle tree
+// digests of their kvMap, descend only into differing subtrees, and at
+// the leaves ship only the differing entries.  The tree has a fixed
+// shape, where a key's leaf comes from the hash of the key, and it's
+// kept up to date as kvMap changes, so a round of anti-entropy doesn't
+// rehash the whole map.
+
+const (
+	kvMerkleFanout = 16
+	kvMerkleDepth  = 3 // Levels below the root, so 4096 leaves.
+)
+
+// How often replicas start anti-entropy with their members.
+var KVAntiEntropyInterval = 10 * time.Second
+
+// Digests of the children of a tree node, sent so the receiver can
+// compare them against its own children.
+type KVMerkleDigest struct {
+	Addr     string `gdec:"addr"`
+	From     string
+	Level    int
+	Index    int
+	Children []uint64
+}
+
+// Hashes of the entries of a leaf, sent once a leaf's digest differs.
+type KVMerkleLeaf struct {
+	Addr   string `gdec:"addr"`
+	From   string
+	Index  int
+	Reply  bool
+	Hashes map[string]uint64 // Key: kvMap key, val: entry hash.
+}
+
+type KVMerkleEntry struct {
+	Addr    string `gdec:"addr"`
+	From    string
+	Key     string
+	Hash    uint64 // Distinguishes entries, as Val's aren't marshaled.
+	Val     Lattice
+	Time    int64
+	Expires int64
+}
+
+type kvMerkleTree struct {
+	levels [][]uint64          // Digests, where levels[0] is the root.
+	leaves []map[string]uint64 // Entry hashes, by leaf index.
+	dirty  map[int]bool        // Leaves whose ancestors need rehashing.
+}
+
+func KVAntiEntropyInit(d *D, prefix string) *D {
+	kvmap := d.Relations[prefix+"kvMap"].(*LMap)
+	member := d.Relations[prefix+"KVMember"].(*LSet)
+
+	periodic := d.DeclarePeriodic(prefix+"kvAntiEntropy", KVAntiEntropyInterval)
+
+	mdigest := d.DeclareChannel(prefix+"KVMerkleDigest", KVMerkleDigest{})
+	mleaf := d.DeclareChannel(prefix+"KVMerkleLeaf", KVMerkleLeaf{})
+	mentry := d.DeclareChannel(prefix+"KVMerkleEntry", KVMerkleEntry{})
+
+	tree := newKVMerkleTree()
+	kvmap.observe(tree.update)
+	getTree := func() *kvMerkleTree {
+		tree.rehash()
+		return tree
+	}
+
+	d.Join(periodic, member, func(p *bool, m *string) *KVMerkleDigest {
+		if !*p || *m == d.Addr {
+			return nil
+		}
+		return &KVMerkleDigest{Addr: *m, From: d.Addr,
+			Children: getTree().children(0, 0)}
+	}).IntoAsync(mdigest)
+
+	d.Join(mdigest, func(r *KVMerkleDigest) {
+		if r.Addr != d.Addr {
+			return
+		}
+		t := getTree()
+		mine := t.children(r.Level, r.Index)
+		for i, h := range mine {
+			if i >= len(r.Children) || h == r.Children[i] {
+				continue
+			}
+			child := r.Index*kvMerkleFanout + i
+			if r.Level+1 < kvMerkleDepth {
+				d.AddNext(mdigest, &KVMerkleDigest{Addr: r.From, From: d.Addr,
+					Level: r.Level + 1, Index: child,
+					Children: t.children(r.Level+1, child)})
+			} else {
+				d.AddNext(mleaf, &KVMerkleLeaf{Addr: r.From, From: d.Addr,
+					Index: child, Hashes: t.leaf(child)})
+			}
+		}
+	}).Writes(mdigest, mleaf)
+
+	d.Join(mleaf, func(r *KVMerkleLeaf) {
+		if r.Addr != d.Addr {
+			return
+		}
+		mine := getTree().leaf(r.Index)
+		for k, h := range mine {
+			if r.Hashes[k] != h {
+				v := kvmap.At(k)
+				t, expires := kvEntryTimes(d, prefix, k)
+				d.AddNext(mentry, &KVMerkleEntry{Addr: r.From, From: d.Addr,
+					Key: k, Hash: h, Val: v.Snapshot(), Time: t, Expires: expires})
+			}
+		}
+		if r.Reply {
+			return
+		}
+		for k, h := range r.Hashes {
+			if mine[k] != h {
+				d.AddNext(mleaf, &KVMerkleLeaf{Addr: r.From, From: d.Addr,
+					Index: r.Index, Reply: true, Hashes: mine})
+				return
+			}
+		}
+	}).Writes(mentry, mleaf)
+
+	d.Join(mentry, func(r *KVMerkleEntry) {
+		if r.Addr == d.Addr {
+			kvMergeEntry(d, prefix, r.Key, r.Val, r.Time, r.Expires)
+		}
+	}).Reads(d.Relations[prefix+"kvTombstone"]).Writes(kvmap,
+		d.Relations[prefix+"kvPutTime"], d.Relations[prefix+"kvExpires"])
+
+	return d
+}
+
+func newKVMerkleTree() *kvMerkleTree {
+	numLeaves := 1
+	for i := 0; i < kvMerkleDepth; i++ {
+		numLeaves *= kvMerkleFanout
+	}
+	t := &kvMerkleTree{
+		levels: make([][]uint64, kvMerkleDepth+1),
+		leaves: make([]map[string]uint64, numLeaves),
+		dirty:  map[int]bool{},
+	}
+	for i := range t.leaves {
+		t.leaves[i] = map[string]uint64{}
+	}
+	t.levels[kvMerkleDepth] = make([]uint64, numLeaves)
+	for l := kvMerkleDepth - 1; l >= 0; l-- {
+		below := t.levels[l+1]
+		level := make([]uint64, len(below)/kvMerkleFanout)
+		for i := range level {
+			level[i] = kvMerkleHashDigests(below[i*kvMerkleFanout : (i+1)*kvMerkleFanout])
+		}
+		t.levels[l] = level
+	}
+	return t
+}
+
+// Updates a leaf for a changed kvMap entry, or a removed one when v
+// is nil, leaving its ancestors to rehash().
+func (t *kvMerkleTree) update(k string, v Lattice) {
+	i := kvMerkleLeafIndex(k, len(t.leaves))
+	leafLevel := t.levels[kvMerkleDepth]
+	if old, ok := t.leaves[i][k]; ok {
+		leafLevel[i] ^= old
+		delete(t.leaves[i], k)
+	}
+	if v != nil {
+		h := kvMerkleEntryHash(k, v)
+		t.leaves[i][k] = h
+		leafLevel[i] ^= h
+	}
+	t.dirty[i] = true
+}
+
+// Rehashes only the ancestors of updated leaves.
+func (t *kvMerkleTree) rehash() {
+	dirty := t.dirty
+	for l := kvMerkleDepth - 1; l >= 0 && len(dirty) > 0; l-- {
+		parents := map[int]bool{}
+		for i := range dirty {
+			parents[i/kvMerkleFanout] = true
+		}
+		below := t.levels[l+1]
+		for i := range parents {
+			t.levels[l][i] = kvMerkleHashDigests(below[i*kvMerkleFanout : (i+1)*kvMerkleFanout])
+		}
+		dirty = parents
+	}
+	t.dirty = map[int]bool{}
+}
+
+// Returns copies, as the tree changes while tuples are in flight.
+func (t *kvMerkleTree) children(level, index int) []uint64 {
+	if level < 0 || level >= kvMerkleDepth ||
+		index < 0 || index >= len(t.levels[level]) {
+		return nil
+	}
+	return append([]uint64(nil),
+		t.levels[level+1][index*kvMerkleFanout:(index+1)*kvMerkleFanout]...)
+}
+
+func (t *kvMerkleTree) leaf(index int) map[string]uint64 {
+	if index < 0 || index >= len(t.leaves) {
+		return nil
+	}
+	res := make(map[string]uint64, len(t.leaves[index]))
+	for k, h := range t.leaves[index] {
+		res[k] = h
+	}
+	return res
+}
+
+func kvMerkleLeafIndex(key string, numLeaves int) int {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return int(h.Sum64() % uint64(numLeaves))
+}
+
+func kvMerkleEntryHash(key string, val Lattice) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], LatticeHash(val))
+	h.Write(b[:])
+	return h.Sum64()
+}
+
+func kvMerkleHashDigests(digests []uint64) uint64 {
+	h := fnv.New64a()
+	var b [8]byte
+	for _, x := range digests {
+		binary.BigEndian.PutUint64(b[:], x)
+		h.Write(b[:])
+	}
+	return h.Sum64()
+}
@@ -0,0 +1,461 @@
+package gdec
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// A client request that a coordinator has fanned out to replicas.
+type KVQuorumReq struct {
+	Id         int64 // ReqId of the fanned out requests.
+	ReqId      int64 // Client's ReqId.
+	ClientAddr string
+	Put        bool
+	Key        string
+}
+
+// A put or delete that a replica hasn't acked yet, replayed until it
+// does.
+type KVHint struct {
+	Id      int64  // ReqId of the fanned out put or delete.
+	Addr    string // Replica.
+	Key     string
+	Hash    uint64 // Distinguishes hints, as Val's aren't marshaled.
+	Val     Lattice
+	Time    int64
+	Expires int64
+	Delete  bool // Without a Val.
+}
+
+type KVHintAck struct {
+	Id   int64
+	Addr string
+}
+
+// A replica's answer to a fanned out get.
+type KVQuorumReplicaVal struct {
+	Id      int64
+	Replica string
+	Key     string
+	Hash    uint64
+}
+
+// How often a coordinator replays puts to replicas that haven't acked,
+// and collects finished requests.
+var KVHintReplayInterval = 5 * time.Second
+
+// How long a coordinator keeps a request after it was last received
+// or met its quorum, for read repair of late replica answers.
+var KVQuorumLinger = 30 * time.Second
+
+// Coordinator that fans out client puts and gets to N replicas, which
+// run KVInit(), and responds to the client only once W replicas have
+// acked a put or R replicas have answered a get, merging their lattices.
+// Deletes are fanned out like puts.  Requests without a time are
+// stamped by the coordinator, so that replicas agree on their order.
+// Each key has its own N replicas, see kvQuorumTargets().
+//
+// Coordinator and replicas speak the same KV protocol, so requests and
+// responses addressed to the coordinator are the ones it handles, while
+// the rest are its own fan out on the way to replicas or clients.
+//
+// Puts and deletes are kept as persistent hints until each replica
+// acks them, and are replayed periodically, so a replica that was
+// unreachable catches up when it's back (hinted handoff), even across
+// coordinator restarts once the D has a WAL.  Acked hints are then
+// collected.  Replicas that answer a get with a stale value get the
+// merged value put back to them (read repair).
+func QuorumKVInit(d *D, prefix string) *D {
+	KVProtocolInit(d, prefix)
+
+	kvput := d.Relations[prefix+"KVPut"]
+	kvputr := d.Relations[prefix+"KVPutResponse"]
+	kvget := d.Relations[prefix+"KVGet"]
+	kvgetr := d.Relations[prefix+"KVGetResponse"]
+	kvdel := d.Relations[prefix+"KVDelete"]
+
+	replica := d.External(d.DeclareLSet(prefix+"KVQuorumReplica", "addrString")).(*LSet)
+	n := d.External(d.DeclareLMax(prefix + "KVQuorumN")).(*LMax) // 0 means all replicas.
+	r := d.External(d.DeclareLMax(prefix + "KVQuorumR"))
+	w := d.External(d.DeclareLMax(prefix + "KVQuorumW"))
+
+	received := d.Scratch(d.DeclareLSet(prefix+"kvQuorumReceived", KVQuorumReq{}))
+	pending := d.DeclareLSet(prefix+"kvQuorumPending", KVQuorumReq{})
+	done := d.DeclareLSet(prefix+"kvQuorumDone", KVQuorumReq{})
+	vals := d.DeclareLMap(prefix + "kvQuorumVal")           // Key: id, val: merged Lattice.
+	valExpires := d.DeclareLMap(prefix + "kvQuorumExpires") // Key: id, val: LMax.
+	at := d.DeclareLMap(prefix + "kvQuorumAt")              // Key: id, val: LMax unix nanos.
+
+	hint := d.DeclarePersistent(d.DeclareLSet(prefix+"kvHint", KVHint{})).(*LSet)
+	hintAck := d.DeclarePersistent(d.DeclareLSet(prefix+"kvHintAck", KVHintAck{})).(*LSet)
+	hintReplay := d.DeclarePeriodic(prefix+"kvHintReplay", KVHintReplayInterval)
+
+	replicaVal := d.DeclareLSet(prefix+"kvQuorumReplicaVal", KVQuorumReplicaVal{})
+	repaired := d.DeclareLSet(prefix+"kvReadRepaired", KVQuorumReplicaVal{})
+
+	tallyPut := d.Instantiate(MultiTallyModule, prefix+"kvQuorumPut")
+	tallyPutVote := tallyPut.LSet("MultiTallyVote")
+	tallyPutNeed := tallyPut.LMax("MultiTallyNeed")
+	tallyPutDone := tallyPut.LMap("MultiTallyDone")
+	tallyPutTotal := tallyPut.Relation("multiTallyTotal").(*LMap)
+
+	tallyGet := d.Instantiate(MultiTallyModule, prefix+"kvQuorumGet")
+	tallyGetVote := tallyGet.LSet("MultiTallyVote")
+	tallyGetNeed := tallyGet.LMax("MultiTallyNeed")
+	tallyGetDone := tallyGet.LMap("MultiTallyDone")
+	tallyGetTotal := tallyGet.Relation("multiTallyTotal").(*LMap)
+
+	d.Join(w).Into(tallyPutNeed)
+	d.Join(r).Into(tallyGetNeed)
+
+	targets := func(key string) []string { return kvQuorumTargets(replica, n.Int(), key) }
+
+	// Remember client requests.
+	d.Join(kvput, func(k *KVPut) *KVQuorumReq {
+		if k.Addr != d.Addr {
+			return nil
+		}
+		return &KVQuorumReq{kvQuorumId(k.ClientAddr, k.ReqId), k.ReqId,
+			k.ClientAddr, true, k.Key}
+	}).Into(received)
+
+	d.Join(kvget, func(k *KVGet) *KVQuorumReq {
+		if k.Addr != d.Addr {
+			return nil
+		}
+		return &KVQuorumReq{kvQuorumId(k.ClientAddr, k.ReqId), k.ReqId,
+			k.ClientAddr, false, k.Key}
+	}).Into(received)
+
+	d.Join(kvdel, func(k *KVDelete) *KVQuorumReq {
+		if k.Addr != d.Addr {
+			return nil
+		}
+		return &KVQuorumReq{kvQuorumId(k.ClientAddr, k.ReqId), k.ReqId,
+			k.ClientAddr, true, k.Key}
+	}).Into(received)
+
+	d.Join(received).Into(pending)
+	d.Join(received, func(p *KVQuorumReq) *LMapEntry {
+		return &LMapEntry{kvQuorumKey(p.Id), NewLMax(d, int(d.Now().UnixNano()))}
+	}).Into(at)
+
+	// Fan out to replicas, remembering puts as hints.
+	fanout := func(k *KVPut, a *string) *KVPut {
+		if k.Addr != d.Addr || !containsString(targets(k.Key), *a) {
+			return nil
+		}
+		return &KVPut{ReqId: kvQuorumId(k.ClientAddr, k.ReqId), Addr: *a,
+			ClientAddr: d.Addr, Key: k.Key, Val: k.Val,
+			Time: kvStamp(d, k.Time), Expires: k.Expires}
+	}
+
+	d.Join(kvput, replica, fanout).IntoAsync(kvput)
+
+	d.Join(kvput, replica, func(k *KVPut, a *string) *KVHint {
+		f := fanout(k, a)
+		if f == nil || snapshotLattice(f.Val) == nil {
+			return nil
+		}
+		return &KVHint{f.ReqId, f.Addr, f.Key, LatticeHash(f.Val),
+			f.Val.Snapshot(), f.Time, f.Expires, false}
+	}).Into(hint)
+
+	fanoutDelete := func(k *KVDelete, a *string) *KVDelete {
+		if k.Addr != d.Addr || !containsString(targets(k.Key), *a) {
+			return nil
+		}
+		return &KVDelete{ReqId: kvQuorumId(k.ClientAddr, k.ReqId), Addr: *a,
+			ClientAddr: d.Addr, Key: k.Key, Time: kvStamp(d, k.Time)}
+	}
+
+	d.Join(kvdel, replica, fanoutDelete).IntoAsync(kvdel)
+
+	d.Join(kvdel, replica, func(k *KVDelete, a *string) *KVHint {
+		f := fanoutDelete(k, a)
+		if f == nil {
+			return nil
+		}
+		return &KVHint{Id: f.ReqId, Addr: f.Addr, Key: f.Key, Time: f.Time, Delete: true}
+	}).Into(hint)
+
+	d.Join(hintReplay, hint, func(p *bool, h *KVHint) *KVPut {
+		if !*p || h.Delete || hintAck.Contains(&KVHintAck{h.Id, h.Addr}) {
+			return nil
+		}
+		return &KVPut{ReqId: h.Id, Addr: h.Addr, ClientAddr: d.Addr,
+			Key: h.Key, Val: h.Val, Time: h.Time, Expires: h.Expires}
+	}).Reads(hintAck).IntoAsync(kvput)
+
+	d.Join(hintReplay, hint, func(p *bool, h *KVHint) *KVDelete {
+		if !*p || !h.Delete || hintAck.Contains(&KVHintAck{h.Id, h.Addr}) {
+			return nil
+		}
+		return &KVDelete{ReqId: h.Id, Addr: h.Addr, ClientAddr: d.Addr,
+			Key: h.Key, Time: h.Time}
+	}).Reads(hintAck).IntoAsync(kvdel)
+
+	// Only acks of hints are kept, and acked hints are collected with
+	// their acks.  After a restart, the WAL may bring back some, which
+	// are collected again.
+	hinted := func(id int64, addr string) bool {
+		res := false
+		hint.each(func(x interface{}) {
+			h := x.(*KVHint)
+			res = res || (h.Id == id && h.Addr == addr)
+		})
+		return res
+	}
+
+	hintsCollected := int64(-1)
+
+	d.Join(hintReplay, func(p *bool) {
+		if !*p || hintsCollected == d.ticks { // Collection isn't monotonic, so once per tick.
+			return
+		}
+		hintsCollected = d.ticks
+
+		hint.each(func(x interface{}) {
+			h := x.(*KVHint)
+			if a := (&KVHintAck{h.Id, h.Addr}); hintAck.Contains(a) {
+				hint.remove(h)
+				hintAck.remove(a)
+			}
+		})
+	}).Reads(hint, hintAck).Writes(hint, hintAck)
+
+	d.Join(kvget, replica, func(k *KVGet, a *string) *KVGet {
+		if k.Addr != d.Addr || !containsString(targets(k.Key), *a) {
+			return nil
+		}
+		return &KVGet{ReqId: kvQuorumId(k.ClientAddr, k.ReqId), Addr: *a,
+			ClientAddr: d.Addr, Key: k.Key}
+	}).IntoAsync(kvget)
+
+	// Gather replica responses.
+	d.Join(kvputr, func(k *KVPutResponse) *MultiTallyVote {
+		if k.Addr != d.Addr {
+			return nil
+		}
+		return &MultiTallyVote{kvQuorumKey(k.ReqId), k.ReplicaAddr}
+	}).Into(tallyPutVote)
+
+	d.Join(kvgetr, func(k *KVGetResponse) *MultiTallyVote {
+		if k.Addr != d.Addr {
+			return nil
+		}
+		return &MultiTallyVote{kvQuorumKey(k.ReqId), k.ReplicaAddr}
+	}).Into(tallyGetVote)
+
+	d.Join(kvputr, func(k *KVPutResponse) *KVHintAck {
+		if k.Addr != d.Addr || !hinted(k.ReqId, k.ReplicaAddr) {
+			return nil
+		}
+		return &KVHintAck{k.ReqId, k.ReplicaAddr}
+	}).Reads(hint).Into(hintAck)
+
+	d.Join(kvgetr, func(k *KVGetResponse) *KVQuorumReplicaVal {
+		if k.Addr != d.Addr {
+			return nil
+		}
+		return &KVQuorumReplicaVal{k.ReqId, k.ReplicaAddr, k.Key,
+			LatticeHash(snapshotLattice(k.Val))}
+	}).Into(replicaVal)
+
+	d.Join(kvgetr, func(k *KVGetResponse) *LMapEntry {
+		if k.Addr != d.Addr || snapshotLattice(k.Val) == nil {
+			return nil
+		}
+		return &LMapEntry{kvQuorumKey(k.ReqId), k.Val.Snapshot()}
+	}).Into(vals)
+
+	d.Join(kvgetr, func(k *KVGetResponse) *LMapEntry {
+		if k.Addr != d.Addr || snapshotLattice(k.Val) == nil {
+			return nil
+		}
+		expires := k.Expires
+		if expires == 0 {
+			expires = int64(kvNever)
+		}
+		return &LMapEntry{kvQuorumKey(k.ReqId), NewLMax(d, int(expires))}
+	}).Into(valExpires)
+
+	// Respond to clients, once, when there's a quorum.
+	quorumExpires := func(id int64) int64 {
+		x, _ := valExpires.At(kvQuorumKey(id)).(*LMax)
+		if x == nil || x.Int() == kvNever {
+			return 0
+		}
+		return int64(x.Int())
+	}
+
+	met := func(p *KVQuorumReq) bool {
+		tdone := tallyGetDone
+		if p.Put {
+			tdone = tallyPutDone
+		}
+		ok, _ := tdone.At(kvQuorumKey(p.Id)).(*LBool)
+		return !done.Contains(p) && ok != nil && ok.Bool()
+	}
+
+	d.Join(pending, func(p *KVQuorumReq) *KVPutResponse {
+		if !p.Put || !met(p) {
+			return nil
+		}
+		return &KVPutResponse{p.ReqId, p.ClientAddr, d.Addr}
+	}).Reads(tallyPutDone, tallyGetDone, done).IntoAsync(kvputr)
+
+	d.Join(pending, func(p *KVQuorumReq) *KVGetResponse {
+		if p.Put || !met(p) {
+			return nil
+		}
+		return &KVGetResponse{p.ReqId, p.ClientAddr, d.Addr, p.Key,
+			snapshotLattice(vals.At(kvQuorumKey(p.Id))), quorumExpires(p.Id)}
+	}).Reads(tallyPutDone, tallyGetDone, done, vals, valExpires).IntoAsync(kvgetr)
+
+	d.Join(pending, func(p *KVQuorumReq) *KVQuorumReq {
+		if !met(p) {
+			return nil
+		}
+		return p
+	}).Reads(tallyPutDone, tallyGetDone, done).IntoAsync(done)
+
+	d.Join(pending, func(p *KVQuorumReq) *LMapEntry {
+		if !met(p) {
+			return nil
+		}
+		return &LMapEntry{kvQuorumKey(p.Id), NewLMax(d, int(d.Now().UnixNano()))}
+	}).Reads(tallyPutDone, tallyGetDone, done).IntoAsync(at)
+
+	// Read repair, once a get has its quorum, including for replicas
+	// that answer afterwards.  Repairs are older than any delete.
+	readRepair := func(rv *KVQuorumReplicaVal) *KVQuorumReplicaVal {
+		ok, _ := tallyGetDone.At(kvQuorumKey(rv.Id)).(*LBool)
+		merged := snapshotLattice(vals.At(kvQuorumKey(rv.Id)))
+		if ok == nil || !ok.Bool() || merged == nil {
+			return nil
+		}
+		r := &KVQuorumReplicaVal{rv.Id, rv.Replica, rv.Key, LatticeHash(merged)}
+		if r.Hash == rv.Hash || repaired.Contains(r) {
+			return nil
+		}
+		return r
+	}
+
+	d.Join(replicaVal, func(rv *KVQuorumReplicaVal) *KVPut {
+		r := readRepair(rv)
+		if r == nil {
+			return nil
+		}
+		return &KVPut{ReqId: r.Id, Addr: r.Replica, ClientAddr: d.Addr,
+			Key: r.Key, Val: snapshotLattice(vals.At(kvQuorumKey(r.Id))),
+			Time: 1, Expires: quorumExpires(r.Id)}
+	}).Reads(tallyGetDone, vals, valExpires, repaired).IntoAsync(kvput)
+
+	d.Join(replicaVal, readRepair).Reads(tallyGetDone, vals, repaired).IntoAsync(repaired)
+
+	// Collect requests that lingered, met or not, where a client retry
+	// starts over, along with what's left of requests no longer pending.
+	collected := int64(-1)
+
+	d.Join(hintReplay, func(p *bool) {
+		if !*p || collected == d.ticks { // Collection isn't monotonic, so once per tick.
+			return
+		}
+		collected = d.ticks
+
+		old := int(d.Now().Add(-KVQuorumLinger).UnixNano())
+		live := map[string]bool{}
+		pending.each(func(x interface{}) {
+			p := x.(*KVQuorumReq)
+			k := kvQuorumKey(p.Id)
+			if t, _ := at.At(k).(*LMax); t == nil || t.Int() < old {
+				pending.remove(p)
+				done.remove(p)
+			} else {
+				live[k] = true
+			}
+		})
+
+		for _, m := range []*LMap{at, vals, valExpires, tallyPutTotal, tallyGetTotal} {
+			m.each(func(k string, v Lattice) {
+				if !live[k] {
+					m.remove(k)
+				}
+			})
+		}
+		for _, s := range []*LSet{replicaVal, repaired} {
+			s.each(func(x interface{}) {
+				if !live[kvQuorumKey(x.(*KVQuorumReplicaVal).Id)] {
+					s.remove(x)
+				}
+			})
+		}
+	}).Reads(pending, at).Writes(pending, done, at, vals, valExpires,
+		tallyPutTotal, tallyGetTotal, replicaVal, repaired)
+
+	return d
+}
+
+var QuorumKVModule = &Module{"QuorumKV", QuorumKVInit,
+	kvProtocolPorts(map[string]PortKind{
+		"KVQuorumReplica": PortExternal,
+		"KVQuorumN":       PortExternal,
+		"KVQuorumR":       PortExternal,
+		"KVQuorumW":       PortExternal,
+	})}
+
+func init() {
+	QuorumKVInit(NewD(""), "")
+	RegisterModule(QuorumKVModule)
+}
+
+// Fanned out requests need ReqId's that are unique across clients.
+func kvQuorumId(clientAddr string, reqId int64) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(kvOpId(clientAddr, reqId)))
+	return int64(h.Sum64() >> 1)
+}
+
+func kvQuorumKey(id int64) string { return strconv.FormatInt(id, 10) }
+
+// The n replicas of a key, or all replicas when n is 0.  Replicas are
+// ranked by a hash of the key and their addr (rendezvous hashing), so
+// keys spread across replicas, and a key's replicas only change when
+// one of them joins or leaves.
+func kvQuorumTargets(replica *LSet, n int, key string) []string {
+	res := []string{}
+	for x := range replica.Scan() {
+		res = append(res, x.(string))
+	}
+	if n <= 0 || n >= len(res) {
+		sort.Strings(res)
+		return res
+	}
+	rank := map[string]uint64{}
+	for _, a := range res {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(a))
+		rank[a] = h.Sum64()
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if rank[res[i]] != rank[res[j]] {
+			return rank[res[i]] > rank[res[j]]
+		}
+		return res[i] < res[j]
+	})
+	return res[:n]
+}
+
+func containsString(a []string, s string) bool {
+	for _, x := range a {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,263 @@
+package gdec
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// Partitioning of keys across nodes with a consistent-hash ring,
+// where each node has a number of virtual nodes on the ring, and a
+// key's replicas are the first distinct nodes clockwise from the key.
+
+const (
+	kvRingDefaultVNodes   = 64
+	kvRingDefaultReplicas = 1
+)
+
+type KVRingPoint struct {
+	Hash uint64
+	Addr string
+}
+
+// Entries shipped to nodes that became replicas after a ring change.
+type KVRingHandoff struct {
+	Addr    string `gdec:"addr"`
+	From    string
+	Key     string
+	Hash    uint64 // Distinguishes entries, as Val's aren't marshaled.
+	Val     Lattice
+	Time    int64
+	Expires int64
+}
+
+type kvRing struct {
+	points   []KVRingPoint
+	replicas int
+}
+
+// Declares the ring, and routes requests that clients leave
+// unaddressed, with an empty Addr.  Puts and deletes go to all of the
+// key's replicas, while gets go to the key's first replica.
+func KVRingInit(d *D, prefix string) *D {
+	if d.Relations[prefix+"KVPut"] == nil {
+		KVProtocolInit(d, prefix)
+	}
+
+	kvput := d.Relations[prefix+"KVPut"]
+	kvget := d.Relations[prefix+"KVGet"]
+	kvdel := d.Relations[prefix+"KVDelete"]
+
+	node := d.External(d.DeclareLSet(prefix+"KVRingNode", "addrString"))
+	vnodes := d.External(d.DeclareLMax(prefix + "KVRingVNodes")).(*LMax) // 0 means the default.
+	d.External(d.DeclareLMax(prefix + "KVRingReplicas"))                 // 0 means the default.
+
+	// Rederived each tick, so a placement during the tick's first round
+	// of joins may be empty, and is retried once the points are in.
+	points := d.Scratch(d.DeclareLSet(prefix+"kvRingPoint", KVRingPoint{}))
+
+	d.JoinFlat(node, func(a *string) *LSet {
+		res := d.NewLSet(points.TupleType())
+		for _, p := range kvRingNodePoints(*a, vnodes.Int()) {
+			p := p
+			res.DirectAdd(&p)
+		}
+		return res
+	}).Reads(vnodes).Into(points)
+
+	d.Join(kvput, func(k *KVPut) {
+		if k.Addr != "" {
+			return
+		}
+		for _, a := range KVRingPlacement(d, prefix, k.Key) {
+			c := *k
+			c.Addr = a
+			d.AddNext(kvput, &c)
+		}
+	}).Reads(points).Writes(kvput)
+
+	d.Join(kvdel, func(k *KVDelete) {
+		if k.Addr != "" {
+			return
+		}
+		for _, a := range KVRingPlacement(d, prefix, k.Key) {
+			c := *k
+			c.Addr = a
+			c.Time = kvStamp(d, k.Time)
+			d.AddNext(kvdel, &c)
+		}
+	}).Reads(points).Writes(kvdel)
+
+	d.Join(kvget, func(k *KVGet) *KVGet {
+		p := KVRingPlacement(d, prefix, k.Key)
+		if k.Addr != "" || len(p) <= 0 {
+			return nil
+		}
+		c := *k
+		c.Addr = p[0]
+		return &c
+	}).Reads(points).IntoAsync(kvget)
+
+	return d
+}
+
+// KV replica that knows the ring, and hands off its entries and
+// tombstones to nodes that became replicas for them when the ring
+// changes.  The ring as of the last handoff is kept in relations, so
+// a restored replica hands off for changes it missed.  Nodes are only
+// ever added to the ring.
+func PartitionedKVInit(d *D, prefix string) *D {
+	KVInit(d, prefix)
+	KVRingInit(d, prefix)
+
+	kvmap := d.Relations[prefix+"kvMap"].(*LMap)
+	tombstone := d.Relations[prefix+"kvTombstone"].(*LMap)
+	gossip := d.Relations[prefix+"KVTombstone"]
+	node := d.Relations[prefix+"KVRingNode"].(*LSet)
+	vnodes := d.Relations[prefix+"KVRingVNodes"].(*LMax)
+	replicas := d.Relations[prefix+"KVRingReplicas"].(*LMax)
+	points := d.Relations[prefix+"kvRingPoint"].(*LSet)
+	handoff := d.DeclareChannel(prefix+"KVRingHandoff", KVRingHandoff{})
+
+	wasNode := d.DeclarePersistent(d.DeclareLSet(prefix+"kvRingHandedOffNode", "addrString")).(*LSet)
+	wasVNodes := d.DeclarePersistent(d.DeclareLMax(prefix + "kvRingHandedOffVNodes")).(*LMax)
+	wasReplicas := d.DeclarePersistent(d.DeclareLMax(prefix + "kvRingHandedOffReplicas")).(*LMax)
+
+	d.Join(func() {
+		if points.Size() <= 0 || (wasVNodes.Int() == vnodes.Int() &&
+			wasReplicas.Int() == replicas.Int() && LatticeEqual(wasNode, node)) {
+			return
+		}
+		if wasNode.Size() > 0 {
+			nodes := []string{}
+			wasNode.each(func(x interface{}) { nodes = append(nodes, x.(string)) })
+			was := newKVRing(nodes, wasVNodes.Int(), wasReplicas.Int())
+			cur := kvRingGet(d, prefix)
+			moved := func(k string, f func(a string)) {
+				before := was.placement(k)
+				for _, a := range cur.placement(k) {
+					if a != d.Addr && !containsString(before, a) {
+						f(a)
+					}
+				}
+			}
+			kvmap.each(func(k string, v Lattice) {
+				t, expires := kvEntryTimes(d, prefix, k)
+				moved(k, func(a string) {
+					d.AddNext(handoff, &KVRingHandoff{Addr: a, From: d.Addr,
+						Key: k, Hash: LatticeHash(v), Val: v.Snapshot(),
+						Time: t, Expires: expires})
+				})
+			})
+			tombstone.each(func(k string, v Lattice) {
+				moved(k, func(a string) {
+					d.AddNext(gossip, &KVTombstone{Addr: a, From: d.Addr,
+						Key: k, Time: int64(v.(*LMax).Int())})
+				})
+			})
+		}
+		node.each(func(x interface{}) { d.Add(wasNode, x) })
+		d.Add(wasVNodes, vnodes.Int())
+		d.Add(wasReplicas, replicas.Int())
+	}).Reads(points, node, vnodes, replicas, kvmap, tombstone, wasNode, wasVNodes, wasReplicas).
+		Writes(handoff, gossip, wasNode, wasVNodes, wasReplicas)
+
+	d.Join(handoff, func(h *KVRingHandoff) {
+		if h.Addr == d.Addr {
+			kvMergeEntry(d, prefix, h.Key, h.Val, h.Time, h.Expires)
+		}
+	}).Reads(tombstone).Writes(kvmap,
+		d.Relations[prefix+"kvPutTime"], d.Relations[prefix+"kvExpires"])
+
+	return d
+}
+
+var PartitionedKVModule = &Module{"PartitionedKV", PartitionedKVInit,
+	kvProtocolPorts(map[string]PortKind{
+		"KVMember":       PortExternal,
+		"KVTombstone":    PortChannel,
+		"KVRingNode":     PortExternal,
+		"KVRingVNodes":   PortExternal,
+		"KVRingReplicas": PortExternal,
+		"KVRingHandoff":  PortChannel,
+	})}
+
+func init() {
+	KVRingInit(NewD(""), "")
+	PartitionedKVInit(NewD(""), "")
+	RegisterModule(PartitionedKVModule)
+}
+
+// Returns the addrs of the replicas for a key, in ring order.
+func KVRingPlacement(d *D, prefix string, key string) []string {
+	return kvRingGet(d, prefix).placement(key)
+}
+
+// The ring of the current tick, from its kvRingPoint's.
+func kvRingGet(d *D, prefix string) *kvRing {
+	r := &kvRing{replicas: d.Relations[prefix+"KVRingReplicas"].(*LMax).Int()}
+	if r.replicas <= 0 {
+		r.replicas = kvRingDefaultReplicas
+	}
+	for x := range d.Relations[prefix+"kvRingPoint"].Scan() {
+		r.points = append(r.points, *x.(*KVRingPoint))
+	}
+	sort.Sort(kvRingPoints(r.points))
+	return r
+}
+
+func newKVRing(nodes []string, vnodes, replicas int) *kvRing {
+	if replicas <= 0 {
+		replicas = kvRingDefaultReplicas
+	}
+	r := &kvRing{replicas: replicas}
+	for _, a := range nodes {
+		r.points = append(r.points, kvRingNodePoints(a, vnodes)...)
+	}
+	sort.Sort(kvRingPoints(r.points))
+	return r
+}
+
+// Returns a node's virtual nodes, where vnodes <= 0 means the default.
+func kvRingNodePoints(a string, vnodes int) []KVRingPoint {
+	if vnodes <= 0 {
+		vnodes = kvRingDefaultVNodes
+	}
+	res := make([]KVRingPoint, 0, vnodes)
+	for i := 0; i < vnodes; i++ {
+		res = append(res, KVRingPoint{kvRingHash(a + "#" + strconv.Itoa(i)), a})
+	}
+	return res
+}
+
+func (r *kvRing) placement(key string) []string {
+	res := []string{}
+	if len(r.points) <= 0 {
+		return res
+	}
+	h := kvRingHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].Hash >= h })
+	for n := 0; n < len(r.points) && len(res) < r.replicas; n++ {
+		a := r.points[(i+n)%len(r.points)].Addr
+		if !containsString(res, a) {
+			res = append(res, a)
+		}
+	}
+	return res
+}
+
+// Like ketama, uses md5, as fnv clusters similar vnode names.
+func kvRingHash(s string) uint64 {
+	h := md5.Sum([]byte(s))
+	return binary.BigEndian.Uint64(h[:8])
+}
+
+type kvRingPoints []KVRingPoint
+
+func (a kvRingPoints) Len() int      { return len(a) }
+func (a kvRingPoints) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a kvRingPoints) Less(i, j int) bool {
+	return a[i].Hash < a[j].Hash ||
+		(a[i].Hash == a[j].Hash && a[i].Addr < a[j].Addr)
+}
@@ -1,13 +1,16 @@
 package gdec
 
 import (
+	"encoding/json"
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
 )
 
 // Invoked by candidates to gather votes.
 type RaftVoteReq struct {
-	To           string
+	To           string `gdec:"addr"`
 	From         string // Candidate requesting vote.
 	Term         int    // Candidate's term.
 	LastLogTerm  int    // Term of candidate's last log entry.
@@ -15,7 +18,7 @@ type RaftVoteReq struct {
 }
 
 type RaftVoteRes struct { // Response.
-	To      string
+	To      string `gdec:"addr"`
 	From    string
 	Term    int  // Current term, for candidate to update itself.
 	Granted bool // True means candidate received vote.
@@ -23,21 +26,63 @@ type RaftVoteRes struct { // Response.
 
 // Invoked by leaders to replicate log entries.
 type RaftAddEntryReq struct {
-	To           string
+	To           string `gdec:"addr"`
 	From         string // Leader's addr, allowing follower to redirect clients.
 	Term         int    // Leader's term.
 	PrevLogTerm  int    // Term of log entry immediately preceding this one.
 	PrevLogIndex int    // Index of log entry immediately preceding this one.
 	Entry        string // Log entry to store (empty for heartbeat).
 	CommitIndex  int    // Last entry known to be commited.
+	Round        int    // Leader's heartbeat round, acked for ReadIndex.
 }
 
 type RaftAddEntryRes struct { // Response.
-	To    string
+	To    string `gdec:"addr"`
 	From  string
 	Term  int  // Current term, for leader to update itself.
 	Ok    bool // True if had entry matching PrevLogIndex/Term.
 	Index int
+	Round int // Non-zero when acking a heartbeat round.
+}
+
+// Invoked by clients for a linearizable read without appending to the log.
+type RaftReadReq struct {
+	ReqId int64
+	To    string `gdec:"addr"`
+	From  string
+}
+
+type RaftReadRes struct { // Response.
+	ReqId     int64
+	To        string `gdec:"addr"`
+	From      string
+	Ok        bool // False means not leader or not ready yet, so retry.
+	ReadIndex int  // Read once the state machine has applied this index.
+}
+
+type RaftReadPending struct {
+	ReqId     int64
+	From      string
+	Term      int
+	Round     int // Last heartbeat round sent when the read arrived.
+	ReadIndex int
+}
+
+// Invoked by would-be candidates, before bumping their term, to learn
+// whether they could win an election (the PreVote extension).
+type RaftPreVoteReq struct {
+	To           string `gdec:"addr"`
+	From         string
+	Term         int // Term the candidate would campaign in.
+	LastLogTerm  int
+	LastLogIndex int
+}
+
+type RaftPreVoteRes struct { // Response.
+	To      string `gdec:"addr"`
+	From    string
+	Term    int // Echoed from the request.
+	Granted bool
 }
 
 type RaftVote struct {
@@ -51,6 +96,20 @@ type RaftEntry struct {
 	Entry string // Command for state machine.
 }
 
+// Cluster configuration, carried through the log as a config entry.
+// During joint consensus both Old and New are non-empty, and elections
+// and commits need a majority from each.
+type RaftConfig struct {
+	Index int      `json:"-"` // Log index of the config entry, 0 for bootstrap.
+	Old   []string // Members being left behind, empty when not joint.
+	New   []string
+}
+
+// Asks the leader to move the cluster to a new set of members.
+type RaftConfigChange struct {
+	Members []string
+}
+
 type RaftLogState struct {
 	LastTerm        int
 	LastIndex       int
@@ -59,10 +118,11 @@ type RaftLogState struct {
 
 const (
 	// The 'kind' of a state are in the lowest bits.
-	state_FOLLOWER  = 0
-	state_CANDIDATE = 1
-	state_LEADER    = 2
-	state_STEP_DOWN = 3 // Must be largest for LMax precedence.
+	state_FOLLOWER      = 0
+	state_PRE_CANDIDATE = 1
+	state_CANDIDATE     = 2
+	state_LEADER        = 3
+	state_STEP_DOWN     = 4 // Must be largest for LMax precedence.
 
 	state_KIND_MASK    = 0x0000000f
 	state_VERSION_MASK = 0xfffffff0 // Highest bits are version for precedence.
@@ -76,8 +136,12 @@ func stateVersionNext(s int) int { return stateVersion(s) + state_VERSION_NEXT }
 func RaftProtocolInit(d *D, prefix string) *D {
 	d.DeclareChannel(prefix+"RaftVoteReq", RaftVoteReq{})
 	d.DeclareChannel(prefix+"RaftVoteRes", RaftVoteRes{})
+	d.DeclareChannel(prefix+"RaftPreVoteReq", RaftPreVoteReq{})
+	d.DeclareChannel(prefix+"RaftPreVoteRes", RaftPreVoteRes{})
 	d.DeclareChannel(prefix+"RaftAddEntryReq", RaftAddEntryReq{})
 	d.DeclareChannel(prefix+"RaftAddEntryRes", RaftAddEntryRes{})
+	d.DeclareChannel(prefix+"RaftReadReq", RaftReadReq{})
+	d.DeclareChannel(prefix+"RaftReadRes", RaftReadRes{})
 	return d
 }
 
@@ -87,50 +151,125 @@ func RaftInit(d *D, prefix string) *D {
 	rvote := d.Relations[prefix+"RaftVoteReq"]
 	rvoter := d.Relations[prefix+"RaftVoteRes"]
 
+	pvote := d.Relations[prefix+"RaftPreVoteReq"]
+	pvoter := d.Relations[prefix+"RaftPreVoteRes"]
+
 	radd := d.Relations[prefix+"RaftAddEntryReq"]
 	raddr := d.Relations[prefix+"RaftAddEntryRes"]
 
-	member := d.DeclareLSet(prefix+"raftMember", "addrString")
+	readReq := d.Relations[prefix+"RaftReadReq"]
+	readRes := d.Relations[prefix+"RaftReadRes"]
+
+	// Bootstrap members, used until the log has a config entry.
+	member := d.External(d.DeclareLSet(prefix+"raftMember", "addrString")).(*LSet)
+
+	configChange := d.Input(d.DeclareLSet(prefix+"RaftConfigChange", RaftConfigChange{}))
+	activeMember := d.Scratch(d.DeclareLSet(prefix+"raftActiveMember", "addrString"))
 
 	curTerm := d.DeclareLMax(prefix + "raftCurTerm")
+	d.DeclarePersistent(curTerm)
 	curState := d.DeclareLMax(prefix + "raftCurState")
 
 	nextTerm := d.Scratch(d.DeclareLMax(prefix + "raftNextTerm"))
 	nextState := d.Scratch(d.DeclareLMax(prefix + "raftNextState"))
 
-	alarm := d.Scratch(d.DeclareLBool(prefix + "raftAlarm"))           // TODO: periodic.
-	alarmReset := d.Scratch(d.DeclareLBool(prefix + "raftAlarmReset")) // TODO: periodic.
-	heartbeat := d.Scratch(d.DeclareLBool(prefix + "raftHeartbeat"))   // TODO: periodic.
+	alarm := d.Input(d.DeclareLBool(prefix + "raftAlarm"))            // TODO: periodic.
+	alarmReset := d.Output(d.DeclareLBool(prefix + "raftAlarmReset")) // TODO: periodic.
+	heartbeat := d.Input(d.DeclareLBool(prefix + "raftHeartbeat"))    // TODO: periodic.
+	clock := d.Input(d.DeclareLMax(prefix + "raftClock"))             // TODO: periodic.
+
+	preVote := d.External(d.DeclareLBool(prefix + "raftPreVote"))         // When true, use PreVote.
+	checkQuorum := d.External(d.DeclareLBool(prefix + "raftCheckQuorum")) // When true, use check-quorum.
+
+	// Counts alarms, so leader contact can be judged as since the last alarm.
+	alarmCount := d.DeclareLMax(prefix + "raftAlarmCount")
+	leaderSeen := d.DeclareLMax(prefix + "raftLeaderSeen") // Recent when > alarmCount.
 
-	MultiTallyInit(d, prefix+"tallyLeader/")
-	tallyLeaderVote := d.Relations[prefix+"tallyLeader/MultiTallyVote"].(*LSet)
-	tallyLeaderNeed := d.Relations[prefix+"tallyLeader/MultiTallyNeed"].(*LMax)
-	tallyLeaderDone := d.Relations[prefix+"tallyLeader/MultiTallyDone"].(*LMap)
+	tallyLeader := d.Instantiate(MultiTallyModule, prefix+"tallyLeader")
+	tallyLeaderVote := tallyLeader.LSet("MultiTallyVote")
+	tallyLeaderNeed := tallyLeader.LMax("MultiTallyNeed")
+	tallyLeaderDone := tallyLeader.LMap("MultiTallyDone")
+	tallyLeaderNeed.DeclareScratch() // Recomputed from the active config.
+
+	tallyPreVote := d.Instantiate(MultiTallyModule, prefix+"tallyPreVote")
+	tallyPreVoteVote := tallyPreVote.LSet("MultiTallyVote")
+	tallyPreVoteNeed := tallyPreVote.LMax("MultiTallyNeed")
+	tallyPreVoteDone := tallyPreVote.LMap("MultiTallyDone")
+	tallyPreVoteNeed.DeclareScratch()
 
 	goodCandidate := d.Scratch(d.DeclareLSet(prefix+"raftGoodCandidate", RaftVoteReq{}))
 	bestCandidate := d.Scratch(d.DeclareLMaxString(prefix + "raftBestCandidate"))
 
 	// TODO: optimization to instead use LMap["term", LSet[RaftVote]].
 	votedFor := d.DeclareLSet(prefix+"raftVotedFor", RaftVote{})
+	d.DeclarePersistent(votedFor)
 	votedForInCurTerm := d.Scratch(d.DeclareLSet(prefix+"raftVotedForInCurTerm", "addrString"))
 
 	// Key: "index", val: LSet[RaftEntry].
 	logEntry := d.DeclareLMap(prefix + "raftEntry")
+	d.DeclarePersistent(logEntry)
+	// TODO: No join writes logState or nextIndex yet, so Validate()
+	// reports them, see the nextIndex TODO at the end.
 	logState := d.DeclareLSet(prefix+"raftLogState", RaftLogState{}) // TODO: sub-module.
 	logAdd := d.DeclareLSet(prefix+"raftLogAdd", RaftEntry{})        // TODO: sub-module.
 	logCommit := d.DeclareLMax(prefix + "raftLogCommit")             // TODO: sub-module.
 
 	nextIndex := d.DeclareLMap(prefix + "raftNextIndex") // Key: "addr", val: LMax.
 
-	MultiTallyInit(d, prefix+"tallyCommit/")
-	tallyCommitVote := d.Relations[prefix+"tallyCommit/MultiTallyVote"].(*LSet)
-	tallyCommitNeed := d.Relations[prefix+"tallyCommit/MultiTallyNeed"].(*LMax)
-	tallyCommitDone := d.Relations[prefix+"tallyCommit/MultiTallyDone"].(*LMap)
+	tallyCommit := d.Instantiate(MultiTallyModule, prefix+"tallyCommit")
+	tallyCommitVote := tallyCommit.LSet("MultiTallyVote")
+	tallyCommitNeed := tallyCommit.LMax("MultiTallyNeed")
+	tallyCommitDone := tallyCommit.LMap("MultiTallyDone")
+	tallyCommitNeed.DeclareScratch()
+
+	// ReadIndex: reads are answered at the commit index once a later
+	// heartbeat round is acked by a quorum, confirming we're still leader.
+	round := d.DeclareLMax(prefix + "raftHeartbeatRound")    // Last sent, from 1.
+	roundSent := d.DeclareLMap(prefix + "raftHeartbeatSent") // Key: "term/round", val: LMax clock.
+	readPending := d.DeclareLSet(prefix+"raftReadPending", RaftReadPending{})
+	readDone := d.DeclareLSet(prefix+"raftReadDone", RaftReadPending{})
+
+	tallyRead := d.Instantiate(MultiTallyModule, prefix+"tallyRead")
+	tallyReadVote := tallyRead.LSet("MultiTallyVote")
+	tallyReadNeed := tallyRead.LMax("MultiTallyNeed")
+	tallyReadDone := tallyRead.LMap("MultiTallyDone")
+	tallyReadNeed.DeclareScratch()
+
+	// Optional leader lease, in clock units, where 0 disables leases.  It
+	// must be below the election timeout less any clock drift.
+	leaseDuration := d.External(d.DeclareLMax(prefix + "raftLeaseDuration"))
+	leaseUntil := d.Scratch(d.DeclareLMax(prefix + "raftLeaseUntil"))
+
+	// Check-quorum: a leader counts who it heard from since its last alarm.
+	tallyCheckQuorum := d.Instantiate(MultiTallyModule, prefix+"tallyCheckQuorum")
+	tallyCheckQuorumVote := tallyCheckQuorum.LSet("MultiTallyVote")
+	tallyCheckQuorumNeed := tallyCheckQuorum.LMax("MultiTallyNeed")
+	tallyCheckQuorumNeed.DeclareScratch()
+
+	activeConfig := func() *RaftConfig { return raftActiveConfig(logEntry, member) }
 
 	// ------------------------------------------------------------------------
 
-	d.Join(func() int { return member.Size() / 2 }).Into(tallyLeaderNeed)
-	d.Join(func() int { return member.Size() / 2 }).Into(tallyCommitNeed)
+	d.JoinFlat(func() *LSet {
+		c := activeConfig()
+		s := d.NewLSet(member.TupleType())
+		for _, a := range c.Old {
+			s.DirectAdd(a)
+		}
+		for _, a := range c.New {
+			s.DirectAdd(a)
+		}
+		return s
+	}).Into(activeMember)
+
+	// Election tallies include a self-vote, while the leader's own ack is
+	// implicit in the others.  Rules also check raftConfigQuorum(), which
+	// is exact even when joint, as scratch needs start each tick at 0.
+	d.Join(func() int { return raftConfigNeed(activeConfig().New) }).Into(tallyLeaderNeed)
+	d.Join(func() int { return raftConfigNeed(activeConfig().New) }).Into(tallyPreVoteNeed)
+	d.Join(func() int { return raftConfigNeed(activeConfig().New) - 1 }).Into(tallyCommitNeed)
+	d.Join(func() int { return raftConfigNeed(activeConfig().New) - 1 }).Into(tallyReadNeed)
+	d.Join(func() int { return raftConfigNeed(activeConfig().New) - 1 }).Into(tallyCheckQuorumNeed)
 
 	// Initialize our scratch next term/state.
 	d.Join(curTerm).Into(nextTerm)
@@ -165,24 +304,120 @@ func RaftInit(d *D, prefix string) *D {
 		func(r *RaftAddEntryRes, t *int, s *int) int { return caseStepDown(r.Term, *t, *s) }).
 		Into(nextState)
 
-	// Timeout means we should become a candidate.
-	d.Join(alarm, curTerm, curState, func(alarm *bool, t *int, s *int) {
+	startElection := func(t int) {
 		// Move to candidate state, with a new term, self-vote, and alarm reset.
-		if *alarm && stateKind(*s) != state_LEADER {
-			d.Add(nextTerm, *t+1)
-			d.Add(nextState, state_CANDIDATE)
-			d.Add(tallyLeaderVote, &MultiTallyVote{termToKey(*t + 1), d.Addr})
-			// TODO: d.Add(resetAlarm, true)
-			// TODO: remove uncommitted logs.
-			return
+		d.Add(nextTerm, t+1)
+		d.Add(nextState, state_CANDIDATE)
+		d.Add(tallyLeaderVote, &MultiTallyVote{termToKey(t + 1), d.Addr})
+		// TODO: d.Add(resetAlarm, true)
+		// TODO: remove uncommitted logs.
+	}
+
+	// Timeout means we should become a candidate.  With PreVote, we first
+	// become a pre-candidate without bumping our term, so a partitioned
+	// node can't disrupt the cluster when it rejoins.
+	d.Join(alarm, curTerm, curState, preVote,
+		func(alarm *bool, t *int, s *int, pv *bool) {
+			if !*alarm || stateKind(*s) == state_LEADER {
+				return
+			}
+			if *pv && stateKind(*s) != state_CANDIDATE {
+				d.Add(nextState, state_PRE_CANDIDATE)
+				d.Add(tallyPreVoteVote, &MultiTallyVote{termToKey(*t + 1), d.Addr})
+				return
+			}
+			startElection(*t)
+		}).Writes(nextTerm, nextState, tallyLeaderVote, tallyPreVoteVote)
+
+	d.Join(alarm, alarmCount, func(a *bool, c *int) int {
+		if *a {
+			return *c + 1
 		}
-	})
+		return *c
+	}).IntoAsync(alarmCount)
+
+	d.Join(radd, curTerm, alarmCount, func(r *RaftAddEntryReq, t *int, c *int) int {
+		if r.Term >= *t {
+			return *c + 1
+		}
+		return 0
+	}).Into(leaderSeen)
+
+	// Send pre-vote requests.
+	d.Join(heartbeat, activeMember, curTerm, curState, logState,
+		func(h *bool, a *string, t *int, s *int, l *RaftLogState) *RaftPreVoteReq {
+			if stateKind(*s) == state_PRE_CANDIDATE &&
+				!MultiTallyHasVoteFrom(tallyPreVote, termToKey(*t+1), *a) {
+				return &RaftPreVoteReq{To: *a, From: d.Addr, Term: *t + 1,
+					LastLogTerm: l.LastTerm, LastLogIndex: l.LastIndex}
+			}
+			return nil
+		}).IntoAsync(pvote)
+
+	// Grant pre-votes only if we haven't heard from a leader since our
+	// last alarm.  Pre-votes never change our term or state.
+	d.Join(pvote, curTerm, curState, logState, leaderSeen, alarmCount,
+		func(r *RaftPreVoteReq, t *int, s *int, l *RaftLogState,
+			seen *int, c *int) *RaftPreVoteRes {
+			granted := r.Term > *t && stateKind(*s) != state_LEADER && *seen <= *c &&
+				raftLogUpToDate(r.LastLogTerm, r.LastLogIndex, l)
+			return &RaftPreVoteRes{To: r.From, From: r.To, Term: r.Term, Granted: granted}
+		}).IntoAsync(pvoter)
+
+	d.Join(curTerm, curState, pvoter,
+		func(t *int, s *int, r *RaftPreVoteRes) *MultiTallyVote {
+			if stateKind(*s) == state_PRE_CANDIDATE && r.Term == *t+1 && r.Granted {
+				return &MultiTallyVote{termToKey(r.Term), r.From}
+			}
+			return nil
+		}).Into(tallyPreVoteVote)
+
+	d.Join(curTerm, curState, func(t *int, s *int) {
+		// Start the real election if we won the pre-vote.
+		if stateKind(*s) == state_PRE_CANDIDATE {
+			k := termToKey(*t + 1)
+			won, _ := tallyPreVoteDone.At(k).(*LBool)
+			if won != nil && won.Bool() &&
+				raftConfigQuorum(activeConfig(), MultiTallyVoters(tallyPreVote, k), d.Addr) {
+				startElection(*t)
+			}
+		}
+	}).Writes(nextTerm, nextState, tallyLeaderVote)
+
+	d.Join(radd, curTerm, curState, func(r *RaftAddEntryReq, t *int, s *int) int {
+		// A pre-candidate hearing from a current leader goes back to follower.
+		if stateKind(*s) == state_PRE_CANDIDATE && r.Term >= *t {
+			return state_STEP_DOWN
+		}
+		return stateKind(*s)
+	}).Into(nextState)
+
+	// A leader that hasn't heard from a quorum since its last alarm steps down.
+	d.Join(raddr, curTerm, curState, alarmCount,
+		func(r *RaftAddEntryRes, t *int, s *int, c *int) *MultiTallyVote {
+			if stateKind(*s) == state_LEADER && r.Term == *t && r.From != d.Addr {
+				return &MultiTallyVote{indexToKey(*c), r.From}
+			}
+			return nil
+		}).Into(tallyCheckQuorumVote)
+
+	d.Join(alarm, curState, checkQuorum, alarmCount,
+		func(a *bool, s *int, cq *bool, c *int) int {
+			// Uses the voters rather than the scratch MultiTallyDone, which
+			// is empty early in the tick, as stepping down can't be undone.
+			if *a && *cq && stateKind(*s) == state_LEADER &&
+				!raftConfigQuorum(activeConfig(),
+					MultiTallyVoters(tallyCheckQuorum, indexToKey(*c)), d.Addr) {
+				return state_STEP_DOWN
+			}
+			return stateKind(*s)
+		}).Into(nextState)
 
 	// Send vote requests.
-	d.Join(heartbeat, member, curTerm, curState, logState,
+	d.Join(heartbeat, activeMember, curTerm, curState, logState,
 		func(h *bool, a *string, t *int, s *int, l *RaftLogState) *RaftVoteReq {
 			if stateKind(*s) == state_CANDIDATE &&
-				!MultiTallyHasVoteFrom(d, prefix+"tallyLeader/", termToKey(*t), *a) {
+				!MultiTallyHasVoteFrom(tallyLeader, termToKey(*t), *a) {
 				return &RaftVoteReq{To: *a, From: d.Addr, Term: *t,
 					LastLogTerm: l.LastTerm, LastLogIndex: l.LastIndex}
 			}
@@ -202,10 +437,12 @@ func RaftInit(d *D, prefix string) *D {
 
 	d.Join(curTerm, curState,
 		func(curTerm *int, curState *int) int {
-			// Become leader if we won the race.
+			// Become leader if we won the race, in both configs when joint.
 			if stateKind(*curState) == state_CANDIDATE {
-				won := tallyLeaderDone.At(termToKey(*curTerm)).(*LBool)
-				if won != nil && won.Bool() {
+				k := termToKey(*curTerm)
+				won, _ := tallyLeaderDone.At(k).(*LBool)
+				if won != nil && won.Bool() &&
+					raftConfigQuorum(activeConfig(), MultiTallyVoters(tallyLeader, k), d.Addr) {
 					return state_LEADER
 				}
 			}
@@ -225,9 +462,7 @@ func RaftInit(d *D, prefix string) *D {
 	d.Join(rvote, logState,
 		func(rvote *RaftVoteReq, logState *RaftLogState) *RaftVoteReq {
 			// Good candidate only if candidate's log is at or beyond our log.
-			if rvote.LastLogTerm > logState.LastTerm ||
-				(rvote.LastLogTerm == logState.LastTerm &&
-					rvote.LastLogIndex >= logState.LastIndex) {
+			if raftLogUpToDate(rvote.LastLogTerm, rvote.LastLogIndex, logState) {
 				return rvote
 			}
 			return nil
@@ -243,7 +478,7 @@ func RaftInit(d *D, prefix string) *D {
 				((votedForInCurTerm.(*LSet).Size() == 0 && r.From == *b) ||
 					(votedForInCurTerm.(*LSet).Contains(r.From)))
 			return &RaftVoteRes{To: r.From, From: r.To, Term: *t, Granted: granted}
-		}).IntoAsync(rvoter) // TODO: reset timer if we grant a vote to a candidate.
+		}).Reads(votedForInCurTerm).IntoAsync(rvoter) // TODO: reset timer if we grant a vote to a candidate.
 
 	d.Join(bestCandidate, curTerm,
 		func(bestCandidate *string, curTerm *int) *RaftVote {
@@ -252,19 +487,67 @@ func RaftInit(d *D, prefix string) *D {
 				return &RaftVote{*curTerm, *bestCandidate}
 			}
 			return nil
-		}).IntoAsync(votedFor)
+		}).Reads(votedForInCurTerm).IntoAsync(votedFor)
 
 	// Send heartbeats.
-	d.Join(heartbeat, member, curTerm, curState, logState,
-		func(h *bool, a *string, t *int, s *int, l *RaftLogState) *RaftAddEntryReq {
-			if stateKind(*s) != state_LEADER {
+	d.Join(heartbeat, activeMember, curTerm, curState, logState, round,
+		func(h *bool, a *string, t *int, s *int, l *RaftLogState, r *int) *RaftAddEntryReq {
+			if !*h || stateKind(*s) != state_LEADER {
 				return nil
 			}
 			return &RaftAddEntryReq{To: *a, From: d.Addr, Term: *t,
 				PrevLogTerm: l.LastTerm, PrevLogIndex: l.LastIndex,
-				Entry: "", CommitIndex: l.LastCommitIndex}
+				Entry: "", CommitIndex: l.LastCommitIndex, Round: *r + 1}
 		}).IntoAsync(radd)
 
+	d.Join(heartbeat, curState, round, func(h *bool, s *int, r *int) int {
+		if *h && stateKind(*s) == state_LEADER {
+			return *r + 1
+		}
+		return *r
+	}).IntoAsync(round)
+
+	d.Join(heartbeat, curTerm, curState, round, clock,
+		func(h *bool, t *int, s *int, r *int, c *int) *LMapEntry {
+			if *h && stateKind(*s) == state_LEADER {
+				return &LMapEntry{raftRoundKey(*t, *r+1), NewLMax(d, *c)}
+			}
+			return nil
+		}).Into(roundSent)
+
+	// Followers ack heartbeats of the current term.
+	d.Join(radd, curTerm, curState,
+		func(r *RaftAddEntryReq, t *int, s *int) *RaftAddEntryRes {
+			if r.Entry != "" || r.Round <= 0 || r.Term < *t ||
+				stateKind(*s) == state_LEADER {
+				return nil
+			}
+			return &RaftAddEntryRes{To: r.From, From: r.To, Term: r.Term,
+				Ok: true, Round: r.Round}
+		}).IntoAsync(raddr)
+
+	d.Join(raddr, curTerm, curState,
+		func(r *RaftAddEntryRes, t *int, s *int) *MultiTallyVote {
+			if r.Round > 0 && r.Term == *t && stateKind(*s) == state_LEADER {
+				return &MultiTallyVote{raftRoundKey(r.Term, r.Round), r.From}
+			}
+			return nil
+		}).Into(tallyReadVote)
+
+	d.Join(tallyReadDone, curTerm, leaseDuration,
+		func(m *LMapEntry, t *int, l *int) int {
+			if *l <= 0 || !m.Val.(*LBool).Bool() ||
+				!strings.HasPrefix(m.Key, termToKey(*t)+"/") ||
+				!raftConfigQuorum(activeConfig(), MultiTallyVoters(tallyRead, m.Key), d.Addr) {
+				return 0
+			}
+			sent, _ := roundSent.At(m.Key).(*LMax)
+			if sent == nil {
+				return 0
+			}
+			return sent.Int() + *l
+		}).Reads(roundSent).Into(leaseUntil)
+
 	// Handle add entry requests.
 	d.Join(radd, curTerm,
 		func(radd *RaftAddEntryReq, curTerm *int) bool {
@@ -300,7 +583,7 @@ func RaftInit(d *D, prefix string) *D {
 			d.Add(logAdd, &RaftEntry{
 				Term: r.Term, Index: r.PrevLogIndex + 1, Entry: r.Entry})
 		}
-	})
+	}).Writes(raddr, logAdd)
 
 	d.Join(radd, func(r *RaftAddEntryReq) int { return r.CommitIndex }).
 		Into(logCommit) // TODO: commit entries before (or at?) this point?
@@ -325,19 +608,158 @@ func RaftInit(d *D, prefix string) *D {
 		}).IntoAsync(radd)
 
 	d.Join(raddr, func(r *RaftAddEntryRes) *MultiTallyVote {
-		if r.Ok {
+		if r.Ok && r.Round <= 0 {
 			return &MultiTallyVote{indexToKey(r.Index), r.From}
 		}
 		return nil
 	}).Into(tallyCommitVote)
 
 	d.Join(tallyCommitDone, func(m *LMapEntry) int {
-		if m.Val.(*LBool).Bool() {
+		if m.Val.(*LBool).Bool() &&
+			raftConfigQuorum(activeConfig(), MultiTallyVoters(tallyCommit, m.Key), d.Addr) {
 			return keyToIndex(m.Key)
 		}
 		return 0
 	}).Into(logCommit) // TODO: commit entries before (or at?) this point?
 
+	// Handle reads.  Like the Raft paper, a leader serves reads only once
+	// it has committed an entry from its own term.
+	readReady := func(t, s, commit int) bool {
+		return stateKind(s) == state_LEADER && raftCommittedInTerm(logEntry, commit, t)
+	}
+
+	d.Join(readReq, curTerm, curState, logCommit,
+		func(r *RaftReadReq, t *int, s *int, commit *int) *RaftReadRes {
+			if readReady(*t, *s, *commit) {
+				return nil
+			}
+			return &RaftReadRes{ReqId: r.ReqId, To: r.From, From: d.Addr, Ok: false}
+		}).IntoAsync(readRes)
+
+	d.Join(readReq, curTerm, curState, logCommit, leaseUntil, clock,
+		func(r *RaftReadReq, t *int, s *int, commit *int, lu *int, c *int) *RaftReadRes {
+			if readReady(*t, *s, *commit) && *c < *lu {
+				return &RaftReadRes{ReqId: r.ReqId, To: r.From, From: d.Addr,
+					Ok: true, ReadIndex: *commit}
+			}
+			return nil
+		}).IntoAsync(readRes)
+
+	d.Join(readReq, curTerm, curState, logCommit, leaseUntil, clock, round,
+		func(r *RaftReadReq, t *int, s *int, commit *int, lu *int, c *int,
+			rnd *int) *RaftReadPending {
+			if readReady(*t, *s, *commit) && *c >= *lu {
+				return &RaftReadPending{ReqId: r.ReqId, From: r.From, Term: *t,
+					Round: *rnd, ReadIndex: *commit}
+			}
+			return nil
+		}).Into(readPending)
+
+	readResult := func(p *RaftReadPending, t *int, s *int, r *int) *RaftReadRes {
+		if readDone.Contains(p) {
+			return nil
+		}
+		if p.Term != *t || stateKind(*s) != state_LEADER {
+			return &RaftReadRes{ReqId: p.ReqId, To: p.From, From: d.Addr, Ok: false}
+		}
+		for i := p.Round + 1; i <= *r; i++ {
+			k := raftRoundKey(p.Term, i)
+			done, _ := tallyReadDone.At(k).(*LBool)
+			if done != nil && done.Bool() &&
+				raftConfigQuorum(activeConfig(), MultiTallyVoters(tallyRead, k), d.Addr) {
+				return &RaftReadRes{ReqId: p.ReqId, To: p.From, From: d.Addr,
+					Ok: true, ReadIndex: p.ReadIndex}
+			}
+		}
+		return nil
+	}
+
+	d.Join(readPending, curTerm, curState, round, readResult).
+		Reads(readDone, tallyReadDone).IntoAsync(readRes)
+	d.Join(readPending, curTerm, curState, round,
+		func(p *RaftReadPending, t *int, s *int, r *int) *RaftReadPending {
+			if readResult(p, t, s, r) != nil {
+				return p
+			}
+			return nil
+		}).Reads(readDone, tallyReadDone).IntoAsync(readDone)
+
+	// Answered reads, and rounds that no pending read can use and that
+	// are too old to extend the lease, are collected on heartbeats, along
+	// with pre-votes of past terms and check-quorums of past alarms.
+	tallyReadTotal := tallyRead.Relation("multiTallyTotal").(*LMap)
+	tallyPreVoteTotal := tallyPreVote.Relation("multiTallyTotal").(*LMap)
+	tallyCheckQuorumTotal := tallyCheckQuorum.Relation("multiTallyTotal").(*LMap)
+	pruned := int64(-1)
+
+	d.Join(heartbeat, curTerm, round, alarmCount, func(h *bool, t *int, r *int, c *int) {
+		if !*h || pruned == d.ticks { // Collection isn't monotonic, so once per tick.
+			return
+		}
+		pruned = d.ticks
+
+		keep := *r + 1 - raftRoundsKept // This tick's heartbeats are of *r + 1.
+		readPending.each(func(x interface{}) {
+			p := x.(*RaftReadPending)
+			if readDone.Contains(p) {
+				readPending.remove(p)
+				readDone.remove(p)
+			} else if p.Term == *t && p.Round+1 < keep {
+				keep = p.Round + 1
+			}
+		})
+
+		for _, m := range []*LMap{roundSent, tallyReadTotal} {
+			m.each(func(k string, v Lattice) {
+				if term, rnd := raftRoundOfKey(k); term != *t || rnd < keep {
+					m.remove(k)
+				}
+			})
+		}
+
+		tallyPreVoteTotal.each(func(k string, v Lattice) {
+			if term, _ := strconv.Atoi(k); term <= *t {
+				tallyPreVoteTotal.remove(k)
+			}
+		})
+		tallyCheckQuorumTotal.each(func(k string, v Lattice) {
+			if k != indexToKey(*c) {
+				tallyCheckQuorumTotal.remove(k)
+			}
+		})
+	}).Reads(readPending, readDone, roundSent, tallyReadTotal, tallyPreVoteTotal,
+		tallyCheckQuorumTotal).
+		Writes(readPending, readDone, roundSent, tallyReadTotal, tallyPreVoteTotal,
+			tallyCheckQuorumTotal)
+
+	d.Join(logAdd, func(e *RaftEntry) *LMapEntry {
+		return &LMapEntry{indexToKey(e.Index), NewLSetOne(d, e)}
+	}).Into(logEntry)
+
+	// Membership changes, via joint consensus.  The leader first appends
+	// a joint config entry, and once that's committed, appends the final
+	// config entry.  Like the Raft paper, a config is active as soon as
+	// it's in the log, committed or not.
+	d.Join(configChange, curTerm, curState,
+		func(cc *RaftConfigChange, t *int, s *int) {
+			c := activeConfig()
+			if stateKind(*s) != state_LEADER || len(c.Old) > 0 ||
+				raftSameMembers(c.New, cc.Members) {
+				return
+			}
+			d.Add(logAdd, &RaftEntry{Term: *t, Index: raftLastIndex(logEntry) + 1,
+				Entry: raftConfigEntry(&RaftConfig{Old: c.New, New: cc.Members})})
+		}).Reads(logEntry, member).Writes(logAdd)
+
+	d.Join(curTerm, curState, logCommit, func(t *int, s *int, commit *int) {
+		c := activeConfig()
+		if stateKind(*s) != state_LEADER || len(c.Old) <= 0 || c.Index > *commit {
+			return
+		}
+		d.Add(logAdd, &RaftEntry{Term: *t, Index: raftLastIndex(logEntry) + 1,
+			Entry: raftConfigEntry(&RaftConfig{New: c.New})})
+	}).Reads(logEntry, member).Writes(logAdd)
+
 	// TODO: update nextIndex <+- (raddr * nextIndex) {|a,n|
 	//    a.success? [a.from, i.index + 1] : [a.from, i.index - 1]}
 
@@ -347,8 +769,30 @@ func RaftInit(d *D, prefix string) *D {
 	return d
 }
 
+var RaftModule = &Module{"Raft", RaftInit, map[string]PortKind{
+	"raftMember":        PortExternal,
+	"raftPreVote":       PortExternal,
+	"raftCheckQuorum":   PortExternal,
+	"raftLeaseDuration": PortExternal,
+	"raftHeartbeat":     PortInput,
+	"raftAlarm":         PortInput,
+	"raftClock":         PortInput,
+	"RaftConfigChange":  PortInput,
+	"raftAlarmReset":    PortOutput,
+	"RaftVoteReq":       PortChannel,
+	"RaftVoteRes":       PortChannel,
+	"RaftPreVoteReq":    PortChannel,
+	"RaftPreVoteRes":    PortChannel,
+	"RaftAddEntryReq":   PortChannel,
+	"RaftAddEntryRes":   PortChannel,
+	"RaftReadReq":       PortChannel,
+	"RaftReadRes":       PortChannel,
+}}
+
 func init() {
+	RegisterType(20, RaftEntry{}) // For raftEntry's LSet's in the WAL.
 	RaftInit(NewD(""), "")
+	RegisterModule(RaftModule)
 }
 
 func termToKey(term int) string   { return fmt.Sprintf("%d", term) }
@@ -381,3 +825,121 @@ func maxRaftEntry(entries *LSet) *RaftEntry {
 	}
 	return max
 }
+
+const raftConfigEntryPrefix = "raftConfig:"
+
+func raftConfigEntry(c *RaftConfig) string {
+	j, err := json.Marshal(c)
+	if err != nil {
+		panic(err)
+	}
+	return raftConfigEntryPrefix + string(j)
+}
+
+func parseRaftConfigEntry(e *RaftEntry) *RaftConfig {
+	if !strings.HasPrefix(e.Entry, raftConfigEntryPrefix) {
+		return nil
+	}
+	c := &RaftConfig{}
+	err := json.Unmarshal([]byte(e.Entry[len(raftConfigEntryPrefix):]), c)
+	if err != nil {
+		return nil
+	}
+	c.Index = e.Index
+	return c
+}
+
+// The latest config entry in the log, else the bootstrap members.
+func raftActiveConfig(logEntry *LMap, member *LSet) *RaftConfig {
+	var c *RaftConfig
+	for x := range logEntry.Scan() {
+		e := maxRaftEntry(x.(*LMapEntry).Val.(*LSet))
+		if e == nil {
+			continue
+		}
+		ec := parseRaftConfigEntry(e)
+		if ec != nil && (c == nil || ec.Index > c.Index) {
+			c = ec
+		}
+	}
+	if c == nil {
+		c = &RaftConfig{}
+		for x := range member.Scan() {
+			c.New = append(c.New, x.(string))
+		}
+		sort.Strings(c.New)
+	}
+	return c
+}
+
+func raftLogUpToDate(lastTerm, lastIndex int, ls *RaftLogState) bool {
+	return lastTerm > ls.LastTerm ||
+		(lastTerm == ls.LastTerm && lastIndex >= ls.LastIndex)
+}
+
+func raftRoundKey(term, round int) string { return fmt.Sprintf("%d/%d", term, round) }
+
+func raftRoundOfKey(k string) (term, round int) {
+	fmt.Sscanf(k, "%d/%d", &term, &round)
+	return term, round
+}
+
+// Heartbeat rounds kept for the lease, beyond those of pending reads.
+const raftRoundsKept = 3
+
+func raftCommittedInTerm(logEntry *LMap, commit, term int) bool {
+	s, _ := logEntry.At(indexToKey(commit)).(*LSet)
+	if s == nil {
+		return false
+	}
+	e := maxRaftEntry(s)
+	return e != nil && e.Term == term
+}
+
+func raftConfigNeed(members []string) int { return len(members)/2 + 1 }
+
+// True when voters plus self form a majority of each config, so of
+// both Old and New when joint.
+func raftConfigQuorum(c *RaftConfig, voters *LSet, self string) bool {
+	for _, members := range [][]string{c.Old, c.New} {
+		if len(members) <= 0 {
+			continue
+		}
+		n := 0
+		for _, a := range members {
+			if a == self || (voters != nil && voters.Contains(a)) {
+				n++
+			}
+		}
+		if n < raftConfigNeed(members) {
+			return false
+		}
+	}
+	return true
+}
+
+func raftSameMembers(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	as := append([]string(nil), a...)
+	bs := append([]string(nil), b...)
+	sort.Strings(as)
+	sort.Strings(bs)
+	for i := range as {
+		if as[i] != bs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func raftLastIndex(logEntry *LMap) int {
+	last := 0
+	for x := range logEntry.Scan() {
+		if i := keyToIndex(x.(*LMapEntry).Key); i > last {
+			last = i
+		}
+	}
+	return last
+}
@@ -14,7 +14,7 @@ type ShortestPath struct {
 }
 
 func ShortestPathInit(d *D, prefix string) *D {
-	links := d.DeclareLSet(prefix+"ShortestPathLink", ShortestPathLink{})
+	links := d.External(d.DeclareLSet(prefix+"ShortestPathLink", ShortestPathLink{}))
 	paths := d.DeclareLSet(prefix+"ShortestPath", ShortestPath{})
 
 	d.Join(links, func(link *ShortestPathLink) *ShortestPath {
@@ -31,6 +31,10 @@ func ShortestPathInit(d *D, prefix string) *D {
 	return d
 }
 
+var ShortestPathModule = &Module{"ShortestPath", ShortestPathInit,
+	map[string]PortKind{"ShortestPathLink": PortExternal}}
+
 func init() {
 	ShortestPathInit(NewD(""), "")
+	RegisterModule(ShortestPathModule)
 }
@@ -3,19 +3,24 @@ package gdec
 // Simple vote tally/counter.
 func TallyInit(d *D, prefix string) *D {
 	tvote := d.Input(d.DeclareLSet(prefix+"TallyVote", "voterString"))
-	tneed := d.DeclareLMax(prefix + "TallyNeed")
+	tneed := d.External(d.DeclareLMax(prefix + "TallyNeed")).(*LMax)
 	tdone := d.Output(d.DeclareLBool(prefix + "TallyDone"))
 
 	ttotal := d.DeclareLSet(prefix+"tallyTotal", "voterString")
 
 	d.Join(tvote).Into(ttotal)
-	d.Join(func() bool { return ttotal.Size() >= tneed.Int() }).Into(tdone)
+	d.Join(func() bool { return ttotal.Size() >= tneed.Int() }).
+		Reads(ttotal, tneed).Into(tdone)
 
 	return d
 }
 
+var TallyModule = &Module{"Tally", TallyInit, map[string]PortKind{
+	"TallyVote": PortInput, "TallyNeed": PortExternal, "TallyDone": PortOutput}}
+
 func init() {
 	TallyInit(NewD(""), "")
+	RegisterModule(TallyModule)
 }
 
 type MultiTallyVote struct {
@@ -26,7 +31,7 @@ type MultiTallyVote struct {
 // Multiple tally/counters, when there are multiple, in-flight races (or contests).
 func MultiTallyInit(d *D, prefix string) *D {
 	tvote := d.Input(d.DeclareLSet(prefix+"MultiTallyVote", MultiTallyVote{}))
-	tneed := d.DeclareLMax(prefix + "MultiTallyNeed")
+	tneed := d.External(d.DeclareLMax(prefix + "MultiTallyNeed")).(*LMax)
 	tdone := d.Output(d.DeclareLMap(prefix + "MultiTallyDone")) // Key: raceStr, val: LBool.
 
 	ttotal := d.DeclareLMap(prefix + "multiTallyTotal") // Key: raceStr, val: LSet[voterStr].
@@ -40,21 +45,32 @@ func MultiTallyInit(d *D, prefix string) *D {
 			return &LMapEntry{m.Key, NewLBool(d, true)}
 		}
 		return &LMapEntry{m.Key, NewLBool(d, false)}
-	}).Into(tdone)
+	}).Reads(tneed).Into(tdone)
 
 	return d
 }
 
+var MultiTallyModule = &Module{"MultiTally", MultiTallyInit, map[string]PortKind{
+	"MultiTallyVote": PortInput, "MultiTallyNeed": PortExternal, "MultiTallyDone": PortOutput}}
+
 func init() {
 	MultiTallyInit(NewD(""), "")
+	RegisterModule(MultiTallyModule)
 }
 
-func MultiTallyVoters(d *D, prefix string, race string) *LSet {
-	return d.Relations[prefix+"multiTallyTotal"].(*LMap).At(race).(*LSet)
+// Returns the voters so far in a race of a MultiTallyModule instance,
+// or nil.
+func MultiTallyVoters(mi *ModuleInstance, race string) *LSet {
+	total, _ := mi.Relation("multiTallyTotal").(*LMap)
+	if total == nil {
+		return nil
+	}
+	s, _ := total.At(race).(*LSet)
+	return s
 }
 
-func MultiTallyHasVoteFrom(d *D, prefix string, race string, voter string) bool {
-	s := MultiTallyVoters(d, prefix, race)
+func MultiTallyHasVoteFrom(mi *ModuleInstance, race string, voter string) bool {
+	s := MultiTallyVoters(mi, race)
 	if s != nil {
 		return s.Contains(voter)
 	}
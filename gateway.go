@@ -0,0 +1,274 @@
+package gdec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// HTTP/JSON gateway to a D, for ops and non-Go services.  The D may
+// be ticked via the gateway's Tick(), or Run(), as the gateway reads
+// the D between ticks, see D.Do(), and publishes events after each
+// tick, see D.AfterTick().  Create the gateway before ticking.
+// Endpoints:
+//
+//	GET  /relations        - lists relations with their types.
+//	GET  /relations/NAME   - dumps a relation's current contents.
+//	POST /relations/NAME   - adds a JSON tuple, or an array of tuples,
+//	                         to an Input() or a channel at the next
+//	                         tick, like AddNext().  See JSONCodec for
+//	                         lattices in tuples.
+//	GET  /events[?relation=NAME] - server-sent events of the relations
+//	                         that changed, after each tick.
+//	GET  /joins            - lists joins, with their outputs during
+//	                         the last tick, see D.JoinStats().
+type HTTPGateway struct {
+	d *D
+
+	// Whether POSTs may also write External() relations, like config,
+	// such as for tools driving a D by hand.
+	PostExternals bool
+
+	m      sync.Mutex             // Protects the fields below.
+	subs   map[chan []byte]string // Val: relation name, or "" for all.
+	dumped map[string][]byte      // Last dumps, for events.
+}
+
+type GatewayRelation struct {
+	Name      string
+	Kind      string // Like "LSet".
+	TupleType string
+	Scratch   bool
+	Channel   bool
+}
+
+type GatewayEvent struct {
+	Tick     int64
+	Relation string
+	Value    json.RawMessage
+}
+
+func NewHTTPGateway(d *D) *HTTPGateway {
+	g := &HTTPGateway{
+		d:      d,
+		subs:   map[chan []byte]string{},
+		dumped: map[string][]byte{},
+	}
+	d.AfterTick(g.publish)
+	return g
+}
+
+func (g *HTTPGateway) Tick() {
+	g.d.Tick()
+}
+
+// Invoked at the end of each tick.
+func (g *HTTPGateway) publish() {
+	g.m.Lock()
+	defer g.m.Unlock()
+	if len(g.subs) <= 0 {
+		return
+	}
+	for name, r := range g.d.Relations {
+		j, err := json.Marshal(RelationDump(r))
+		if err != nil || bytes.Equal(j, g.dumped[name]) {
+			continue
+		}
+		g.dumped[name] = j
+		e, _ := json.Marshal(&GatewayEvent{g.d.ticks, name, j})
+		for ch, want := range g.subs {
+			if want == "" || want == name {
+				select {
+				case ch <- e:
+				default: // Slow subscribers miss events, rather than block ticks.
+				}
+			}
+		}
+	}
+}
+
+func (g *HTTPGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	switch {
+	case path == "relations" && r.Method == "GET":
+		g.serveList(w)
+	case strings.HasPrefix(path, "relations/") && r.Method == "GET":
+		g.serveDump(w, path[len("relations/"):])
+	case strings.HasPrefix(path, "relations/") && r.Method == "POST":
+		g.servePost(w, r, path[len("relations/"):])
+	case path == "events" && r.Method == "GET":
+		g.serveEvents(w, r)
+	case path == "joins" && r.Method == "GET":
+		var stats []JoinStat
+		g.d.Do(func() { stats = g.d.JoinStats() })
+		writeJSON(w, stats)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (g *HTTPGateway) serveList(w http.ResponseWriter) {
+	res := []*GatewayRelation{}
+	g.d.Do(func() {
+		for name, r := range g.d.Relations {
+			res = append(res, describeRelation(name, r))
+		}
+	})
+	sort.Sort(gatewayRelations(res))
+	writeJSON(w, res)
+}
+
+func (g *HTTPGateway) serveDump(w http.ResponseWriter, name string) {
+	r := g.d.Relations[name]
+	if r == nil {
+		http.Error(w, "unknown relation: "+name, http.StatusNotFound)
+		return
+	}
+	var dump []byte
+	var err error
+	g.d.Do(func() { dump, err = json.Marshal(RelationDump(r)) })
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, json.RawMessage(dump))
+}
+
+func (g *HTTPGateway) servePost(w http.ResponseWriter, req *http.Request, name string) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	body = bytes.TrimSpace(body)
+	if len(body) <= 0 || body[0] != '[' {
+		body = append(append([]byte("["), body...), ']')
+	}
+	r := g.d.Relations[name] // Relations aren't added after init.
+	if r == nil {
+		http.Error(w, "unknown relation: "+name, http.StatusNotFound)
+		return
+	}
+	if !g.postable(r) {
+		http.Error(w, "not an input or channel: "+name, http.StatusForbidden)
+		return
+	}
+	tuples, err := JSONCodec.Decode(g.d, r.TupleType(), body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, x := range tuples {
+		g.d.Inject(r, x)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (g *HTTPGateway) postable(r Relation) bool {
+	if s, ok := r.(*LSet); ok && s.channel {
+		return true
+	}
+	return g.d.inputs[r] || (g.PostExternals && g.d.externals[r])
+}
+
+func (g *HTTPGateway) serveEvents(w http.ResponseWriter, r *http.Request) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	want := r.URL.Query().Get("relation")
+
+	ch := make(chan []byte, 100)
+	if want != "" && g.d.Relations[want] == nil {
+		http.Error(w, "unknown relation: "+want, http.StatusNotFound)
+		return
+	}
+	g.m.Lock()
+	g.subs[ch] = want
+	g.m.Unlock()
+	defer func() {
+		g.m.Lock()
+		delete(g.subs, ch)
+		g.m.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-ch:
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", e); err != nil {
+				return
+			}
+			f.Flush()
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func describeRelation(name string, r Relation) *GatewayRelation {
+	res := &GatewayRelation{
+		Name:      name,
+		Kind:      reflect.Indirect(reflect.ValueOf(r)).Type().Name(),
+		TupleType: r.TupleType().String(),
+		Scratch:   relationScratch(r),
+	}
+	if s, ok := r.(*LSet); ok {
+		res.Channel = s.channel
+	}
+	return res
+}
+
+// Returns a relation's contents as plain values for JSON, where LSet's
+// become arrays of tuples and LMap's become objects.
+func RelationDump(r Relation) interface{} {
+	switch x := r.(type) {
+	case *LMap:
+		res := map[string]interface{}{}
+		x.each(func(k string, v Lattice) {
+			if vr, ok := v.(Relation); ok {
+				res[k] = RelationDump(vr)
+			}
+		})
+		return res
+	case *LSet:
+		res := []interface{}{}
+		for _, k := range storageKeys(x.m) {
+			if v, ok := x.m.Get(k); ok {
+				res = append(res, v)
+			}
+		}
+		return res
+	case *LMax:
+		return x.v
+	case *LMaxString:
+		return x.v
+	case *LBool:
+		return x.v
+	}
+	return nil
+}
+
+type gatewayRelations []*GatewayRelation
+
+func (a gatewayRelations) Len() int           { return len(a) }
+func (a gatewayRelations) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a gatewayRelations) Less(i, j int) bool { return a[i].Name < a[j].Name }
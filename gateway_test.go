@@ -0,0 +1,210 @@
+package gdec
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHTTPGateway(t *testing.T) {
+	d := ShortestPathInit(NewD(""), "")
+	g := NewHTTPGateway(d)
+	g.PostExternals = true
+	s := httptest.NewServer(g)
+	defer s.Close()
+
+	res, err := http.Get(s.URL + "/relations")
+	if err != nil {
+		t.Fatalf("expected list, got: %v", err)
+	}
+	var rels []*GatewayRelation
+	json.NewDecoder(res.Body).Decode(&rels)
+	res.Body.Close()
+	if len(rels) != len(d.Relations) || rels[0].Name != "ShortestPath" ||
+		rels[0].Kind != "LSet" || rels[0].TupleType != "gdec.ShortestPath" {
+		t.Errorf("expected relations, got: %#v", rels[0])
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequest("GET", s.URL+"/events?relation=ShortestPath", nil)
+	events, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatalf("expected events, got: %v", err)
+	}
+	defer events.Body.Close()
+
+	res, err = http.Post(s.URL+"/relations/ShortestPathLink", "application/json",
+		strings.NewReader(`[{"From":"a","To":"b","Cost":1},{"From":"b","To":"c","Cost":1}]`))
+	if err != nil || res.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected post accepted, got: %v, %v", res, err)
+	}
+	res, _ = http.Post(s.URL+"/relations/nope", "application/json", strings.NewReader(`{}`))
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected not found, got: %v", res.StatusCode)
+	}
+	res, _ = http.Post(s.URL+"/relations/ShortestPathLink", "application/json",
+		strings.NewReader(`{"Cost":"x"}`))
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected bad request, got: %v", res.StatusCode)
+	}
+
+	g.Tick()
+
+	var paths []*ShortestPath
+	res, _ = http.Get(s.URL + "/relations/ShortestPath")
+	json.NewDecoder(res.Body).Decode(&paths)
+	res.Body.Close()
+	if len(paths) != 3 {
+		t.Errorf("expected 3 paths, got: %#v", paths)
+	}
+
+	var joins []JoinStat
+	res, _ = http.Get(s.URL + "/joins")
+	json.NewDecoder(res.Body).Decode(&joins)
+	res.Body.Close()
+	if len(joins) != 2 || joins[1].Name != "#1" || joins[1].Into != "ShortestPath" ||
+		joins[0].Fired < 2 || joins[1].Fired < 1 {
+		t.Errorf("expected join stats, got: %#v", joins)
+	}
+
+	lines := make(chan string)
+	go func() {
+		r := bufio.NewReader(events.Body)
+		for {
+			l, err := r.ReadString('\n')
+			if err != nil {
+				close(lines)
+				return
+			}
+			lines <- l
+		}
+	}()
+	select {
+	case l := <-lines:
+		var e GatewayEvent
+		if !strings.HasPrefix(l, "data: ") ||
+			json.Unmarshal([]byte(l[len("data: "):]), &e) != nil ||
+			e.Relation != "ShortestPath" || e.Tick != 1 {
+			t.Errorf("expected event, got: %q", l)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected event")
+	}
+}
+
+func TestHTTPGatewayPost(t *testing.T) {
+	d := MultiTallyInit(NewD(""), "")
+	g := NewHTTPGateway(d)
+	s := httptest.NewServer(g)
+	defer s.Close()
+
+	for _, c := range []struct {
+		name, body string
+		status     int
+	}{
+		{"MultiTallyVote", `{"Race":"r","Voter":"a"}`, http.StatusAccepted},
+		{"MultiTallyVote", `null`, http.StatusBadRequest},
+		{"MultiTallyVote", `[{"Race":"r","Voter":"b"},null]`, http.StatusBadRequest},
+		{"MultiTallyNeed", `1`, http.StatusForbidden},
+		{"multiTallyTotal", `{"Key":"r","Val":null}`, http.StatusForbidden},
+		{"MultiTallyDone", `null`, http.StatusForbidden},
+	} {
+		res, err := http.Post(s.URL+"/relations/"+c.name, "application/json",
+			strings.NewReader(c.body))
+		if err != nil || res.StatusCode != c.status {
+			t.Errorf("expected %d, relation: %s, body: %s, got: %v, %v",
+				c.status, c.name, c.body, res, err)
+		}
+	}
+	g.Tick()
+	if v := d.Relations["multiTallyTotal"].(*LMap).At("r"); v == nil || v.(*LSet).Size() != 1 {
+		t.Errorf("expected only the first vote, got: %#v", v)
+	}
+	g.PostExternals = true
+	res, _ := http.Post(s.URL+"/relations/MultiTallyNeed", "application/json",
+		strings.NewReader(`1`))
+	if res.StatusCode != http.StatusAccepted {
+		t.Errorf("expected externals allowed, got: %v", res.StatusCode)
+	}
+}
+
+func TestHTTPGatewayRun(t *testing.T) {
+	d := ShortestPathInit(NewD(""), "")
+	g := NewHTTPGateway(d)
+	g.PostExternals = true
+	s := httptest.NewServer(g)
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := http.Get(s.URL + "/events?relation=ShortestPath")
+	if err != nil {
+		t.Fatalf("expected events, got: %v", err)
+	}
+	defer events.Body.Close()
+	done := make(chan error)
+	go func() { done <- d.Run(ctx, RunOptions{}) }()
+
+	// Reads, posts, gateway ticks and checkpoints race with Run()'s ticks.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			for _, p := range []string{"/relations", "/relations/ShortestPath", "/joins"} {
+				if res, err := http.Get(s.URL + p); err == nil {
+					ioutil.ReadAll(res.Body)
+					res.Body.Close()
+				}
+			}
+			g.Tick()
+			d.Checkpoint(ioutil.Discard)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			res, err := http.Post(s.URL+"/relations/ShortestPathLink", "application/json",
+				strings.NewReader(fmt.Sprintf(`{"From":"n%d","To":"n%d","Cost":1}`, i, i+1)))
+			if err != nil || res.StatusCode != http.StatusAccepted {
+				t.Errorf("expected post accepted, got: %v, %v", res, err)
+				return
+			}
+			res.Body.Close()
+		}
+	}()
+
+	r := bufio.NewReader(events.Body)
+	for n := 0; n < 20*21/2; {
+		l, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("expected events, got: %v", err)
+		}
+		var e GatewayEvent
+		if strings.HasPrefix(l, "data: ") &&
+			json.Unmarshal([]byte(l[len("data: "):]), &e) == nil {
+			var paths []*ShortestPath
+			json.Unmarshal(e.Value, &paths)
+			n = len(paths)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	cancel()
+	<-done
+}
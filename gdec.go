@@ -1,8 +1,10 @@
 package gdec
 
 import (
-	"fmt"
 	"reflect"
+	"strings"
+	"sync"
+	"time"
 )
 
 type D struct {
@@ -12,6 +14,36 @@ type D struct {
 	ticks     int64
 	next      []relationChange
 	immediate []relationChange
+	periodics []*periodic
+	now       time.Time // Start of the current tick.
+
+	Transport Transport // Optional, for channel tuples to other addrs.
+
+	CollectErrors bool              // Collect declaration errors, rather than panic.
+	OnError       func(*TupleError) // Optional, for runtime errors.
+	errs          []error
+	errRelation   *LSet
+	tupleErrs     []*TupleError
+	seenErrs      map[TupleError]bool // Reported during the current tick.
+
+	inputs    map[Relation]bool
+	outputs   map[Relation]bool
+	externals map[Relation]bool
+
+	persistent map[Relation]string // Val: relation name.
+	wal        *WAL
+
+	tickM       sync.Mutex // Held during each tick, see Do().
+	afterTicks  []func()
+	watchM      sync.Mutex // Protects watched, and the funcs of each.
+	watched     map[Relation]*watchState
+	lastWatchId int
+
+	inboxM         sync.Mutex // Protects inbox and inboxErrs.
+	inbox          []inboxTuple
+	inboxErrs      []*TupleError
+	wake           chan struct{} // Signaled on inbox arrivals, for Run().
+	receiveDropped int64         // Atomic.
 }
 
 type Relation interface {
@@ -40,6 +72,7 @@ func NewD(addr string) *D {
 		Joins:     []*joinDeclaration{},
 		next:      []relationChange{},
 		immediate: []relationChange{},
+		wake:      make(chan struct{}, 1),
 	}
 }
 
@@ -50,10 +83,61 @@ func (d *D) DeclareChannel(name string, x interface{}) *LSet {
 	return c
 }
 
+// Declares a channel whose tuples transports should deliver reliably,
+// for transports like UDPTransport that are otherwise best-effort.
+func (d *D) DeclareReliableChannel(name string, x interface{}) *LSet {
+	c := d.DeclareChannel(name, x)
+	c.reliable = true
+	return c
+}
+
+// Returns the value of a tuple's string field tagged `gdec:"addr"`,
+// which is the addr of the D that the tuple is destined for.
+func tupleAddr(tuple interface{}) (string, bool) {
+	v := reflect.Indirect(reflect.ValueOf(tuple))
+	if v.Kind() != reflect.Struct {
+		return "", false
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		for _, s := range strings.Split(t.Field(i).Tag.Get("gdec"), ",") {
+			if s == "addr" && v.Field(i).Kind() == reflect.String {
+				return v.Field(i).String(), true
+			}
+		}
+	}
+	return "", false
+}
+
+// Returns the time at the start of the current tick, which stays the
+// same for all the rules that run during the tick.
+func (d *D) Now() time.Time {
+	if d.now.IsZero() {
+		return time.Now()
+	}
+	return d.now
+}
+
+type periodic struct {
+	r        *LBool
+	interval time.Duration
+	last     time.Time
+}
+
+// Declares a scratch LBool that's true during ticks when at least
+// interval has passed since it was last true.
+func (d *D) DeclarePeriodic(name string, interval time.Duration) *LBool {
+	p := d.DeclareLBool(name)
+	p.DeclareScratch()
+	d.periodics = append(d.periodics, &periodic{r: p, interval: interval})
+	return p
+}
+
 func (d *D) DeclareRelation(name string, x Relation) Relation {
 	if d.Relations[name] != nil {
-		panic(fmt.Sprintf("relation redeclared, name: %s"+
-			", relation: %#v", name, x))
+		d.declError("relation redeclared, name: %s"+
+			", relation: %#v", name, x)
+		return x
 	}
 	d.Relations[name] = x
 	return x
@@ -66,22 +150,28 @@ func (d *D) Join(vars ...interface{}) *joinDeclaration {
 	var joinNum int
 	var selectWhereFunc interface{}
 
+	jd := &joinDeclaration{d: d}
+
 	for i, x := range vars {
 		if x == nil {
-			panic("nil passed as Join() param")
+			d.declError("nil passed as Join() param")
+			jd.invalid = true
+			return jd
 		}
 		xt := reflect.TypeOf(x)
 		if xt.Kind() == reflect.Func {
 			if i < len(vars)-1 {
-				panic(fmt.Sprintf("func not last Join() param: %#v",
-					vars))
+				d.declError("func not last Join() param: %#v", vars)
+				jd.invalid = true
+				return jd
 			}
 			selectWhereFunc = x
 		} else if xt.Implements(rt) {
 			joinNum = i + 1
 		} else {
-			panic(fmt.Sprintf("unexpected Join() param type: %#v, %v",
-				x, xt))
+			d.declError("unexpected Join() param type: %#v, %v", x, xt)
+			jd.invalid = true
+			return jd
 		}
 	}
 
@@ -93,24 +183,31 @@ func (d *D) Join(vars ...interface{}) *joinDeclaration {
 	if selectWhereFunc != nil {
 		mft := reflect.TypeOf(selectWhereFunc)
 		if mft.NumIn() != joinNum {
-			panic(fmt.Sprintf("selectWhereFunc should take %v args"+
-				", selectWhereFunc: %v", joinNum, mft))
+			d.declError("selectWhereFunc should take %v args"+
+				", selectWhereFunc: %v", joinNum, mft)
+			jd.invalid = true
+			return jd
+		}
+		if mft.NumOut() > 1 {
+			d.declError("selectWhereFunc should return at most 1 result"+
+				", selectWhereFunc: %v", mft)
+			jd.invalid = true
+			return jd
 		}
 		for i, x := range sources {
 			rt := reflect.PtrTo(x.TupleType())
 			if rt != mft.In(i) {
-				panic(fmt.Sprintf("selectWhereFunc param #%v type"+
+				d.declError("selectWhereFunc param #%v type"+
 					" %v does not match, expected: %v, selectWhereFunc: %v",
-					i, mft.In(i), rt, mft))
+					i, mft.In(i), rt, mft)
+				jd.invalid = true
+				return jd
 			}
 		}
 	}
 
-	jd := &joinDeclaration{
-		d:               d,
-		sources:         sources,
-		selectWhereFunc: selectWhereFunc,
-	}
+	jd.sources = sources
+	jd.selectWhereFunc = selectWhereFunc
 	d.Joins = append(d.Joins, jd)
 	return jd
 }
@@ -145,6 +242,10 @@ type joinDeclaration struct {
 	selectWhereFlat bool
 	async           bool
 	into            Relation
+	invalid         bool // Declared with errors, so never executed.
+	reads           []Relation
+	writes          []Relation
+	fired           int // Outputs during the last tick.
 }
 
 func (jd *joinDeclaration) Name(name string) *joinDeclaration {
@@ -162,32 +263,43 @@ func (jd *joinDeclaration) Into(dest interface{}) *joinDeclaration {
 	var r *Relation
 	rt := reflect.TypeOf(r).Elem()
 
+	if jd.invalid {
+		return jd
+	}
+
 	dt := reflect.TypeOf(dest)
-	if !dt.Implements(rt) {
-		panic(fmt.Sprintf("Into() param: %#v, type: %v"+
-			", does not implement Relation", dest, dt))
+	if dt == nil || !dt.Implements(rt) {
+		jd.d.declError("Into() param: %#v, type: %v"+
+			", does not implement Relation", dest, dt)
+		jd.invalid = true
+		return jd
 	}
 
 	jd.into = dest.(Relation)
 
 	var out reflect.Type
-	if jd.selectWhereFunc != nil {
+	if jd.selectWhereFunc != nil &&
+		reflect.TypeOf(jd.selectWhereFunc).NumOut() == 1 {
 		out = reflect.TypeOf(jd.selectWhereFunc).Out(0)
-	} else if len(jd.sources) == 1 {
+	} else if jd.selectWhereFunc == nil && len(jd.sources) == 1 {
 		out = reflect.PtrTo(jd.sources[0].TupleType())
 	} else {
-		panic(fmt.Sprintf("unexpected Into() join declaration: %#v", jd))
+		jd.d.declError("unexpected Into() join declaration: %#v", jd)
+		jd.invalid = true
+		return jd
 	}
 	if jd.selectWhereFlat {
 		if out != dt {
-			panic(fmt.Sprintf("Into() param: %#v, type: %v, does not match"+
-				" output type: %v", dest, dt, out))
+			jd.d.declError("Into() param: %#v, type: %v, does not match"+
+				" output type: %v", dest, dt, out)
+			jd.invalid = true
 		}
 	} else {
 		if out != jd.into.TupleType() &&
 			out != reflect.PtrTo(jd.into.TupleType()) {
-			panic(fmt.Sprintf("Into() param: %#v, type: %v, does not match"+
-				" tuple type: %v", dest, dt, out))
+			jd.d.declError("Into() param: %#v, type: %v, does not match"+
+				" tuple type: %v", dest, dt, out)
+			jd.invalid = true
 		}
 	}
 
@@ -199,12 +311,22 @@ func (d *D) Scratch(r Relation) Relation { // Concise readability sugar.
 	return r
 }
 
-func (d *D) Input(r Relation) Relation { // Concise readability sugar.
+// Inputs are scratch, written only from outside the D's joins.
+func (d *D) Input(r Relation) Relation {
 	r.DeclareScratch()
+	if d.inputs == nil {
+		d.inputs = map[Relation]bool{}
+	}
+	d.inputs[r] = true
 	return r
 }
 
-func (d *D) Output(r Relation) Relation { // Concise readability sugar.
+// Outputs are scratch, read only from outside the D's joins.
+func (d *D) Output(r Relation) Relation {
 	r.DeclareScratch()
+	if d.outputs == nil {
+		d.outputs = map[Relation]bool{}
+	}
+	d.outputs[r] = true
 	return r
 }
@@ -1,8 +1,14 @@
 package gdec
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestNewD(t *testing.T) {
@@ -167,3 +173,980 @@ func TestShortestPath(t *testing.T) {
 		t.Errorf("expected paths to to not contain a->b at the wrong cost")
 	}
 }
+
+func TestRaftTick(t *testing.T) {
+	d := RaftInit(NewD("a"), "")
+	d.Tick()
+	d.Tick()
+}
+
+func TestRaftConfigChange(t *testing.T) {
+	d := RaftInit(NewD("a"), "")
+	member := d.Relations["raftMember"].(*LSet)
+	curState := d.Relations["raftCurState"].(*LMax)
+	activeMember := d.Relations["raftActiveMember"].(*LSet)
+	tallyLeaderNeed := d.Relations["tallyLeader/MultiTallyNeed"].(*LMax)
+	logEntry := d.Relations["raftEntry"].(*LMap)
+	logCommit := d.Relations["raftLogCommit"].(*LMax)
+
+	for _, a := range []string{"a", "b", "c"} {
+		member.DirectAdd(a)
+	}
+	curState.DirectAdd(state_LEADER)
+	d.Tick()
+	if activeMember.Size() != 3 {
+		t.Errorf("expected 3 active members, got: %v", activeMember.Size())
+	}
+	if tallyLeaderNeed.Int() != 2 {
+		t.Errorf("expected need 2, got: %v", tallyLeaderNeed.Int())
+	}
+
+	d.AddNext(d.Relations["RaftConfigChange"],
+		&RaftConfigChange{Members: []string{"a", "c", "d", "e", "f"}})
+	d.Tick()
+	c := raftActiveConfig(logEntry, member)
+	if c.Index != 1 || len(c.Old) != 3 || len(c.New) != 5 {
+		t.Errorf("expected joint config at index 1, got: %#v", c)
+	}
+	if activeMember.Size() != 6 {
+		t.Errorf("expected 6 active members when joint, got: %v", activeMember.Size())
+	}
+	d.Tick()
+	if raftLastIndex(logEntry) != 1 {
+		t.Errorf("expected no final config before joint commit")
+	}
+
+	d.AddNext(logCommit, 1)
+	d.Tick()
+	c = raftActiveConfig(logEntry, member)
+	if c.Index != 2 || len(c.Old) != 0 || len(c.New) != 5 {
+		t.Errorf("expected final config at index 2, got: %#v", c)
+	}
+	d.Tick()
+	if activeMember.Size() != 5 || activeMember.Contains("b") {
+		t.Errorf("expected b to be removed, got: %#v", activeMember.m)
+	}
+	if tallyLeaderNeed.Int() != 3 {
+		t.Errorf("expected need 3, got: %v", tallyLeaderNeed.Int())
+	}
+}
+
+func TestRaftConfigQuorum(t *testing.T) {
+	d := NewD("")
+	c := &RaftConfig{Old: []string{"a", "b", "c"}, New: []string{"c", "d", "e"}}
+	voters := d.NewLSet(reflect.TypeOf(""))
+	voters.DirectAdd("d")
+	if raftConfigQuorum(c, voters, "c") {
+		t.Errorf("expected no quorum without old config")
+	}
+	voters.DirectAdd("a")
+	if !raftConfigQuorum(c, voters, "c") {
+		t.Errorf("expected joint quorum")
+	}
+}
+
+func raftTestLeader(addr string, members ...string) *D {
+	d := RaftInit(NewD(addr), "")
+	for _, a := range members {
+		d.Relations["raftMember"].DirectAdd(a)
+	}
+	d.Relations["raftCurTerm"].DirectAdd(1)
+	d.Relations["raftCurState"].DirectAdd(state_LEADER)
+	d.Relations["raftLogAdd"].DirectAdd(&RaftEntry{Term: 1, Index: 1, Entry: "x"})
+	d.Relations["raftLogState"].DirectAdd(
+		&RaftLogState{LastTerm: 1, LastIndex: 1, LastCommitIndex: 1})
+	d.Relations["raftLogCommit"].DirectAdd(1)
+	d.Tick()
+	return d
+}
+
+func TestRaftReadIndex(t *testing.T) {
+	d := raftTestLeader("a", "a", "b", "c")
+	readReq := d.Relations["RaftReadReq"]
+	readRes := d.Relations["RaftReadRes"].(*LSet)
+	heartbeat := d.Relations["raftHeartbeat"]
+	raddr := d.Relations["RaftAddEntryRes"]
+
+	radd := d.Relations["RaftAddEntryReq"].(*LSet)
+
+	d.AddNext(readReq, &RaftReadReq{ReqId: 1, To: "a", From: "client"})
+	d.Tick()
+	if radd.Size() != 0 {
+		t.Errorf("expected no heartbeats without a heartbeat tick, got: %#v", radd.m)
+	}
+	d.AddNext(heartbeat, true)
+	d.Tick()
+	d.Tick()
+	if readRes.Size() != 0 {
+		t.Errorf("expected no read response before heartbeat acks")
+	}
+	if radd.Size() == 0 {
+		t.Errorf("expected heartbeats")
+	}
+	for x := range radd.Scan() {
+		if r := x.(*RaftAddEntryReq); r.Round != 1 {
+			t.Errorf("expected heartbeat rounds from 1, got: %#v", r)
+		}
+	}
+	d.Tick()
+	if radd.Size() != 0 {
+		t.Errorf("expected heartbeats only on heartbeat ticks, got: %#v", radd.m)
+	}
+
+	// An ack of a round sent before the read arrived isn't enough.
+	d.AddNext(raddr, &RaftAddEntryRes{To: "a", From: "b", Term: 1, Ok: true, Round: 0})
+	d.AddNext(heartbeat, true)
+	d.Tick()
+	d.Tick()
+	if readRes.Size() != 0 {
+		t.Errorf("expected no read response before later round acks")
+	}
+
+	d.AddNext(raddr, &RaftAddEntryRes{To: "a", From: "b", Term: 1, Ok: true, Round: 1})
+	d.Tick()
+	d.Tick()
+	if !readRes.Contains(&RaftReadRes{ReqId: 1, To: "client", From: "a",
+		Ok: true, ReadIndex: 1}) {
+		t.Errorf("expected read response, got: %#v", readRes.m)
+	}
+	d.Tick()
+	if readRes.Size() != 0 {
+		t.Errorf("expected only one read response, got: %#v", readRes.m)
+	}
+
+	for i := 0; i < 10; i++ {
+		d.AddNext(heartbeat, true)
+		d.Tick()
+	}
+	if n := d.Relations["raftReadPending"].(*LSet).Size() +
+		d.Relations["raftReadDone"].(*LSet).Size(); n != 0 {
+		t.Errorf("expected answered reads collected, got: %d", n)
+	}
+	if n := d.Relations["raftHeartbeatSent"].(*LMap).Size(); n > raftRoundsKept+1 {
+		t.Errorf("expected old rounds collected, got: %d", n)
+	}
+	if n := d.Relations["tallyRead/multiTallyTotal"].(*LMap).Size(); n > raftRoundsKept+1 {
+		t.Errorf("expected old round tallies collected, got: %d", n)
+	}
+}
+
+func TestRaftReadNotLeader(t *testing.T) {
+	d := RaftInit(NewD("a"), "")
+	readRes := d.Relations["RaftReadRes"].(*LSet)
+	d.AddNext(d.Relations["RaftReadReq"], &RaftReadReq{ReqId: 1, To: "a", From: "client"})
+	d.Tick()
+	d.Tick()
+	if !readRes.Contains(&RaftReadRes{ReqId: 1, To: "client", From: "a"}) {
+		t.Errorf("expected not ok read response, got: %#v", readRes.m)
+	}
+}
+
+func TestRaftReadLease(t *testing.T) {
+	d := raftTestLeader("a", "a", "b", "c")
+	readReq := d.Relations["RaftReadReq"]
+	readRes := d.Relations["RaftReadRes"].(*LSet)
+	heartbeat := d.Relations["raftHeartbeat"]
+	clock := d.Relations["raftClock"]
+
+	d.Relations["raftLeaseDuration"].DirectAdd(100)
+	d.AddNext(heartbeat, true)
+	d.AddNext(clock, 1000)
+	d.Tick()
+	d.AddNext(d.Relations["RaftAddEntryRes"],
+		&RaftAddEntryRes{To: "a", From: "c", Term: 1, Ok: true, Round: 1})
+	d.AddNext(heartbeat, true)
+	d.AddNext(clock, 1010)
+	d.Tick()
+
+	d.AddNext(readReq, &RaftReadReq{ReqId: 2, To: "a", From: "client"})
+	d.AddNext(clock, 1050)
+	d.Tick()
+	d.Tick()
+	if !readRes.Contains(&RaftReadRes{ReqId: 2, To: "client", From: "a",
+		Ok: true, ReadIndex: 1}) {
+		t.Errorf("expected leased read response, got: %#v", readRes.m)
+	}
+
+	d.AddNext(readReq, &RaftReadReq{ReqId: 3, To: "a", From: "client"})
+	d.AddNext(clock, 1200)
+	d.Tick()
+	d.Tick()
+	if readRes.Size() != 0 {
+		t.Errorf("expected no response with an expired lease, got: %#v", readRes.m)
+	}
+}
+
+func TestRaftPreVote(t *testing.T) {
+	d := RaftInit(NewD("a"), "")
+	for _, a := range []string{"a", "b", "c"} {
+		d.Relations["raftMember"].DirectAdd(a)
+	}
+	d.Relations["raftPreVote"].DirectAdd(true)
+	curTerm := d.Relations["raftCurTerm"].(*LMax)
+	curState := d.Relations["raftCurState"].(*LMax)
+
+	d.AddNext(d.Relations["raftAlarm"], true)
+	d.Tick()
+	d.Tick()
+	if curTerm.Int() != 0 || stateKind(curState.Int()) != state_PRE_CANDIDATE {
+		t.Errorf("expected pre-candidate in term 0, got: %v, %v",
+			curTerm.Int(), curState.Int())
+	}
+
+	d.AddNext(d.Relations["RaftPreVoteRes"],
+		&RaftPreVoteRes{To: "a", From: "b", Term: 1, Granted: false})
+	d.Tick()
+	d.Tick()
+	if curTerm.Int() != 0 || stateKind(curState.Int()) != state_PRE_CANDIDATE {
+		t.Errorf("expected still pre-candidate, got: %v, %v",
+			curTerm.Int(), curState.Int())
+	}
+
+	d.AddNext(d.Relations["RaftPreVoteRes"],
+		&RaftPreVoteRes{To: "a", From: "c", Term: 1, Granted: true})
+	d.Tick()
+	d.Tick()
+	if curTerm.Int() != 1 || stateKind(curState.Int()) != state_CANDIDATE {
+		t.Errorf("expected candidate in term 1, got: %v, %v",
+			curTerm.Int(), curState.Int())
+	}
+
+	total := d.Relations["tallyPreVote/multiTallyTotal"].(*LMap)
+	if total.Size() != 1 {
+		t.Errorf("expected the pre-vote tally, got: %v", total.Size())
+	}
+	d.AddNext(d.Relations["raftHeartbeat"], true)
+	d.Tick()
+	if total.Size() != 0 {
+		t.Errorf("expected past pre-votes collected, got: %v", total.Size())
+	}
+}
+
+func TestRaftPreVoteGrant(t *testing.T) {
+	d := RaftInit(NewD("b"), "")
+	d.Relations["raftPreVote"].DirectAdd(true)
+	d.Relations["raftCurTerm"].DirectAdd(1)
+	d.Relations["raftLogState"].DirectAdd(&RaftLogState{})
+	pvote := d.Relations["RaftPreVoteReq"]
+	pvoter := d.Relations["RaftPreVoteRes"].(*LSet)
+
+	d.AddNext(d.Relations["RaftAddEntryReq"],
+		&RaftAddEntryReq{To: "b", From: "a", Term: 1})
+	d.Tick()
+	d.AddNext(pvote, &RaftPreVoteReq{To: "b", From: "c", Term: 2})
+	d.Tick()
+	d.Tick()
+	if !pvoter.Contains(&RaftPreVoteRes{To: "c", From: "b", Term: 2, Granted: false}) {
+		t.Errorf("expected pre-vote refused with a recent leader, got: %#v", pvoter.m)
+	}
+	if d.Relations["raftCurTerm"].(*LMax).Int() != 1 {
+		t.Errorf("expected pre-vote to not change term")
+	}
+
+	d.AddNext(d.Relations["raftAlarm"], true)
+	d.Tick()
+	d.AddNext(pvote, &RaftPreVoteReq{To: "b", From: "c", Term: 2})
+	d.Tick()
+	d.Tick()
+	if !pvoter.Contains(&RaftPreVoteRes{To: "c", From: "b", Term: 2, Granted: true}) {
+		t.Errorf("expected pre-vote granted after alarm, got: %#v", pvoter.m)
+	}
+}
+
+func TestRaftCheckQuorum(t *testing.T) {
+	d := raftTestLeader("a", "a", "b", "c")
+	d.Relations["raftCheckQuorum"].DirectAdd(true)
+	curState := d.Relations["raftCurState"].(*LMax)
+
+	d.AddNext(d.Relations["RaftAddEntryRes"],
+		&RaftAddEntryRes{To: "a", From: "b", Term: 1, Ok: true, Round: 1})
+	d.Tick()
+	d.AddNext(d.Relations["raftAlarm"], true)
+	d.Tick()
+	d.Tick()
+	if stateKind(curState.Int()) != state_LEADER {
+		t.Errorf("expected to stay leader, got: %v", curState.Int())
+	}
+	total := d.Relations["tallyCheckQuorum/multiTallyTotal"].(*LMap)
+	if total.Size() != 1 {
+		t.Errorf("expected the check-quorum tally, got: %v", total.Size())
+	}
+	d.AddNext(d.Relations["raftHeartbeat"], true)
+	d.Tick()
+	if total.Size() != 0 {
+		t.Errorf("expected past alarms' tallies collected, got: %v", total.Size())
+	}
+
+	d.AddNext(d.Relations["raftAlarm"], true)
+	d.Tick()
+	d.Tick()
+	if stateKind(curState.Int()) == state_LEADER {
+		t.Errorf("expected leader to step down, got: %v", curState.Int())
+	}
+}
+
+// Stands in for a network, copying channel tuples addressed to other
+// D's into their next tick.
+func deliver(ds ...*D) {
+	for _, from := range ds {
+		for name, r := range from.Relations {
+			if s, ok := r.(*LSet); !ok || !s.channel {
+				continue
+			}
+			for x := range r.Scan() {
+				addr, ok := tupleAddr(x)
+				if !ok || addr == from.Addr {
+					continue
+				}
+				for _, to := range ds {
+					if to.Addr == addr && to.Relations[name] != nil {
+						to.AddNext(to.Relations[name], x)
+					}
+				}
+			}
+		}
+	}
+}
+
+func tickAll(ds ...*D) {
+	for _, d := range ds {
+		d.Tick()
+	}
+	deliver(ds...)
+}
+
+func TestQuorumKV(t *testing.T) {
+	co := QuorumKVInit(NewD("co"), "")
+	r1 := KVInit(NewD("r1"), "")
+	r2 := KVInit(NewD("r2"), "")
+	r3 := KVInit(NewD("r3"), "")
+	for _, a := range []string{"r1", "r2", "r3"} {
+		co.Relations["KVQuorumReplica"].DirectAdd(a)
+	}
+	co.Relations["KVQuorumW"].DirectAdd(2)
+	co.Relations["KVQuorumR"].DirectAdd(2)
+	putr := co.Relations["KVPutResponse"].(*LSet)
+	getr := co.Relations["KVGetResponse"].(*LSet)
+
+	// With only r1 reachable, there's no quorum.
+	co.AddNext(co.Relations["KVPut"], &KVPut{ReqId: 1, Addr: "co",
+		ClientAddr: "c", Key: "k", Val: NewLMax(co, 3)})
+	for i := 0; i < 10; i++ {
+		tickAll(co, r1)
+		if putr.Contains(&KVPutResponse{1, "c", "co"}) {
+			t.Errorf("expected no put response without quorum")
+		}
+	}
+
+	co.AddNext(co.Relations["KVPut"], &KVPut{ReqId: 2, Addr: "co",
+		ClientAddr: "c", Key: "k", Val: NewLMax(co, 3)})
+	responded := 0
+	for i := 0; i < 10; i++ {
+		tickAll(co, r1, r2)
+		if putr.Contains(&KVPutResponse{2, "c", "co"}) {
+			responded++
+		}
+	}
+	if responded != 1 {
+		t.Errorf("expected one put response with quorum, got: %v", responded)
+	}
+
+	r2.AddNext(r2.Relations["KVPut"], &KVPut{ReqId: 9, Addr: "r2",
+		ClientAddr: "x", Key: "k", Val: NewLMax(r2, 5)})
+	co.AddNext(co.Relations["KVGet"], &KVGet{ReqId: 3, Addr: "co",
+		ClientAddr: "c", Key: "k"})
+	var got *KVGetResponse
+	for i := 0; i < 10; i++ {
+		tickAll(co, r1, r2, r3)
+		for x := range getr.Scan() {
+			if g := x.(*KVGetResponse); g.Addr == "c" {
+				if got != nil {
+					t.Errorf("expected only one get response")
+				}
+				got = g
+			}
+		}
+	}
+	if got == nil || got.ReqId != 3 || !LatticeEqual(got.Val, NewLMax(co, 5)) {
+		t.Errorf("expected merged get response, got: %#v", got)
+	}
+}
+
+func TestKVAntiEntropy(t *testing.T) {
+	r1 := ReplicatedKVInit(NewD("r1"), "")
+	r2 := ReplicatedKVInit(NewD("r2"), "")
+	m1 := r1.Relations["kvMap"].(*LMap)
+	m2 := r2.Relations["kvMap"].(*LMap)
+	for _, d := range []*D{r1, r2} {
+		d.Relations["KVMember"].DirectAdd("r1")
+		d.Relations["KVMember"].DirectAdd("r2")
+	}
+	for i := 0; i < 500; i++ {
+		k := fmt.Sprintf("k%d", i)
+		m1.DirectAdd(&LMapEntry{k, NewLMax(r1, i)})
+		m2.DirectAdd(&LMapEntry{k, NewLMax(r2, i)})
+	}
+	m1.DirectAdd(&LMapEntry{"only1", NewLMax(r1, 1)})
+	m2.DirectAdd(&LMapEntry{"only2", NewLMax(r2, 2)})
+	m1.DirectAdd(&LMapEntry{"k7", NewLMax(r1, 100)})
+	m2.DirectAdd(&LMapEntry{"k9", NewLMax(r2, 200)})
+
+	shipped := 0
+	for i := 0; i < 20; i++ {
+		tickAll(r1, r2)
+		for _, d := range []*D{r1, r2} {
+			for x := range d.Relations["KVMerkleEntry"].Scan() {
+				if x.(*KVMerkleEntry).Addr == d.Addr {
+					shipped++
+				}
+			}
+		}
+	}
+	if !LatticeEqual(m1, m2) || m1.Size() != 502 {
+		t.Errorf("expected replicas to converge, got sizes: %v, %v",
+			m1.Size(), m2.Size())
+	}
+	if m1.At("k9").(*LMax).Int() != 200 || m2.At("k7").(*LMax).Int() != 100 {
+		t.Errorf("expected merged entries")
+	}
+	if shipped > 12 { // Both replicas start an exchange, each shipping 6.
+		t.Errorf("expected only differing entries shipped, got: %v", shipped)
+	}
+}
+
+func TestKVRing(t *testing.T) {
+	c := KVRingInit(NewD("c"), "")
+	rs := []*D{}
+	for _, a := range []string{"r1", "r2", "r3", "r4"} {
+		rs = append(rs, PartitionedKVInit(NewD(a), ""))
+	}
+	all := append([]*D{c}, rs...)
+	for _, d := range all {
+		for _, a := range []string{"r1", "r2", "r3"} {
+			d.Relations["KVRingNode"].DirectAdd(a)
+		}
+		d.Relations["KVRingVNodes"].DirectAdd(16)
+		d.Relations["KVRingReplicas"].DirectAdd(2)
+	}
+
+	for i := 0; i < 50; i++ {
+		c.AddNext(c.Relations["KVPut"], &KVPut{ReqId: int64(i), ClientAddr: "c",
+			Key: fmt.Sprintf("k%d", i), Val: NewLMax(c, i)})
+	}
+	for i := 0; i < 5; i++ {
+		tickAll(all...)
+	}
+	for i := 0; i < 50; i++ {
+		k := fmt.Sprintf("k%d", i)
+		p := KVRingPlacement(c, "", k)
+		if len(p) != 2 {
+			t.Errorf("expected 2 replicas, got: %v", p)
+		}
+		for _, r := range rs {
+			has := r.Relations["kvMap"].(*LMap).At(k) != nil
+			if has != containsString(p, r.Addr) {
+				t.Errorf("expected %s on %v only, but %s has it: %v", k, p, r.Addr, has)
+			}
+		}
+	}
+
+	c.AddNext(c.Relations["KVGet"], &KVGet{ReqId: 100, ClientAddr: "c", Key: "k3"})
+	var got *KVGetResponse
+	for i := 0; i < 5; i++ {
+		tickAll(all...)
+		for x := range c.Relations["KVGetResponse"].Scan() {
+			got = x.(*KVGetResponse)
+		}
+	}
+	if got == nil || got.ReplicaAddr != KVRingPlacement(c, "", "k3")[0] ||
+		!LatticeEqual(got.Val, NewLMax(c, 3)) {
+		t.Errorf("expected get routed to the first replica, got: %#v", got)
+	}
+
+	for _, d := range all {
+		d.AddNext(d.Relations["KVRingNode"], "r4")
+	}
+	for i := 0; i < 5; i++ {
+		tickAll(all...)
+	}
+	r4 := rs[3].Relations["kvMap"].(*LMap)
+	moved := 0
+	for i := 0; i < 50; i++ {
+		k := fmt.Sprintf("k%d", i)
+		if containsString(KVRingPlacement(c, "", k), "r4") {
+			moved++
+			if r4.At(k) == nil {
+				t.Errorf("expected %s handed off to r4", k)
+			}
+		}
+	}
+	if moved <= 0 || r4.Size() != moved {
+		t.Errorf("expected r4 to get only its keys, got: %v, moved: %v", r4.Size(), moved)
+	}
+}
+
+func TestKVRingHandoffRestored(t *testing.T) {
+	r1 := PartitionedKVInit(NewD("r1"), "")
+	r1.Relations["KVRingNode"].DirectAdd("r1")
+	for i := 0; i < 20; i++ {
+		r1.AddNext(r1.Relations["KVPut"], &KVPut{ReqId: int64(i), Addr: "r1",
+			ClientAddr: "c", Key: fmt.Sprintf("k%d", i), Val: NewLMax(r1, i)})
+	}
+	r1.Tick()
+	for i := 1; i < 20; i += 2 {
+		r1.AddNext(r1.Relations["KVDelete"], &KVDelete{ReqId: int64(100 + i), Addr: "r1",
+			ClientAddr: "c", Key: fmt.Sprintf("k%d", i)})
+	}
+	r1.Tick()
+	r1.Tick()
+
+	var buf bytes.Buffer
+	if err := r1.Checkpoint(&buf); err != nil {
+		t.Fatalf("expected checkpoint, got: %v", err)
+	}
+	r1, err := RestoreD(&buf, func(d *D) *D { return PartitionedKVInit(d, "") })
+	if err != nil {
+		t.Fatalf("expected restore, got: %v", err)
+	}
+	r2 := PartitionedKVInit(NewD("r2"), "")
+	for _, a := range []string{"r1", "r2"} {
+		r1.AddNext(r1.Relations["KVRingNode"], a)
+		r2.AddNext(r2.Relations["KVRingNode"], a)
+	}
+	for i := 0; i < 5; i++ {
+		tickAll(r1, r2)
+	}
+
+	m, ts := r2.Relations["kvMap"].(*LMap), r2.Relations["kvTombstone"].(*LMap)
+	moved := 0
+	for i := 0; i < 20; i++ {
+		k := fmt.Sprintf("k%d", i)
+		if KVRingPlacement(r2, "", k)[0] != "r2" {
+			continue
+		}
+		moved++
+		if i%2 == 0 && (m.At(k) == nil || ts.At(k) != nil) {
+			t.Errorf("expected %s handed off to r2", k)
+		}
+		if i%2 == 1 && (m.At(k) != nil || ts.At(k) == nil) {
+			t.Errorf("expected %s's tombstone handed off to r2", k)
+		}
+	}
+	if moved <= 0 {
+		t.Errorf("expected keys to move")
+	}
+}
+
+func TestKVRingPoints(t *testing.T) {
+	d := KVRingInit(NewD("c"), "")
+	d.Relations["KVRingNode"].DirectAdd("r1")
+	d.Tick()
+	if n := d.Relations["kvRingPoint"].(*LSet).Size(); n != kvRingDefaultVNodes {
+		t.Errorf("expected the ring's points, got: %v", n)
+	}
+	d.AddNext(d.Relations["KVRingNode"], "r2")
+	d.AddNext(d.Relations["KVRingVNodes"], 8)
+	d.Tick()
+	if r := kvRingGet(d, ""); len(r.points) != 16 ||
+		len(r.placement("k")) != 1 {
+		t.Errorf("expected a new ring on a membership change, got: %v", len(r.points))
+	}
+}
+
+func TestKVHintedHandoff(t *testing.T) {
+	co := QuorumKVInit(NewD("co"), "")
+	r1 := KVInit(NewD("r1"), "")
+	r2 := KVInit(NewD("r2"), "")
+	co.Relations["KVQuorumReplica"].DirectAdd("r1")
+	co.Relations["KVQuorumReplica"].DirectAdd("r2")
+	co.Relations["KVQuorumW"].DirectAdd(1)
+	replay := co.Relations["kvHintReplay"]
+
+	co.AddNext(co.Relations["KVPut"], &KVPut{ReqId: 1, Addr: "co",
+		ClientAddr: "c", Key: "k", Val: NewLMax(co, 3)})
+	for i := 0; i < 10; i++ {
+		tickAll(co, r1) // r2 is unreachable.
+	}
+	if r2.Relations["kvMap"].(*LMap).At("k") != nil {
+		t.Errorf("expected r2 to miss the put")
+	}
+
+	co.AddNext(replay, true)
+	for i := 0; i < 10; i++ {
+		tickAll(co, r1, r2)
+	}
+	if v := r2.Relations["kvMap"].(*LMap).At("k"); !LatticeEqual(v, NewLMax(r2, 3)) {
+		t.Errorf("expected hinted put replayed to r2, got: %#v", v)
+	}
+
+	// Deletes are hinted too.
+	co.AddNext(co.Relations["KVDelete"], &KVDelete{ReqId: 2, Addr: "co",
+		ClientAddr: "c", Key: "k"})
+	for i := 0; i < 10; i++ {
+		tickAll(co, r1)
+	}
+	if r2.Relations["kvMap"].(*LMap).At("k") == nil {
+		t.Errorf("expected r2 to miss the delete")
+	}
+	co.AddNext(replay, true)
+	for i := 0; i < 10; i++ {
+		tickAll(co, r1, r2)
+	}
+	if v := r2.Relations["kvMap"].(*LMap).At("k"); v != nil {
+		t.Errorf("expected hinted delete replayed to r2, got: %#v", v)
+	}
+
+	// Acked hints aren't replayed.
+	co.AddNext(replay, true)
+	tickAll(co, r1, r2)
+	tickAll(co, r1, r2)
+	for x := range co.Relations["KVPut"].Scan() {
+		if x.(*KVPut).Addr != "co" {
+			t.Errorf("expected no replay of acked hints, got: %#v", x)
+		}
+	}
+	if n := co.Relations["kvHint"].(*LSet).Size() +
+		co.Relations["kvHintAck"].(*LSet).Size(); n != 0 {
+		t.Errorf("expected acked hints collected, got: %d", n)
+	}
+}
+
+func TestKVHintPersistent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gdec-hint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	co := QuorumKVInit(NewD("co"), "")
+	w, err := co.OpenWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	co.Relations["KVQuorumReplica"].DirectAdd("r1")
+	co.AddNext(co.Relations["KVPut"], &KVPut{ReqId: 1, Addr: "co",
+		ClientAddr: "c", Key: "k", Val: NewLMax(co, 3)})
+	co.Tick()
+	co.Tick()
+	w.Close()
+
+	co = QuorumKVInit(NewD("co"), "")
+	if w, err = co.OpenWAL(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	co.Relations["KVQuorumReplica"].DirectAdd("r1")
+	r1 := KVInit(NewD("r1"), "")
+	co.AddNext(co.Relations["kvHintReplay"], true)
+	for i := 0; i < 5; i++ {
+		tickAll(co, r1)
+	}
+	if v := r1.Relations["kvMap"].(*LMap).At("k"); !LatticeEqual(v, NewLMax(r1, 3)) {
+		t.Errorf("expected the restored hint replayed, got: %#v", v)
+	}
+}
+
+func TestKVReadRepair(t *testing.T) {
+	co := QuorumKVInit(NewD("co"), "")
+	r1 := KVInit(NewD("r1"), "")
+	r2 := KVInit(NewD("r2"), "")
+	co.Relations["KVQuorumReplica"].DirectAdd("r1")
+	co.Relations["KVQuorumReplica"].DirectAdd("r2")
+	co.Relations["KVQuorumR"].DirectAdd(2)
+	r1.Relations["kvMap"].DirectAdd(&LMapEntry{"k", NewLMax(r1, 5)})
+	r2.Relations["kvMap"].DirectAdd(&LMapEntry{"k", NewLMax(r2, 3)})
+
+	co.AddNext(co.Relations["KVGet"], &KVGet{ReqId: 1, Addr: "co",
+		ClientAddr: "c", Key: "k"})
+	repairs := 0
+	for i := 0; i < 10; i++ {
+		tickAll(co, r1, r2)
+		for x := range co.Relations["KVPut"].Scan() {
+			if x.(*KVPut).Addr != "co" {
+				repairs++
+			}
+		}
+	}
+	if repairs != 1 {
+		t.Errorf("expected one repair, got: %v", repairs)
+	}
+	if v := r2.Relations["kvMap"].(*LMap).At("k"); !LatticeEqual(v, NewLMax(r2, 5)) {
+		t.Errorf("expected stale replica repaired, got: %#v", v)
+	}
+}
+
+func TestKVQuorumCollect(t *testing.T) {
+	defer func(x time.Duration) { KVQuorumLinger = x }(KVQuorumLinger)
+	KVQuorumLinger = 0
+
+	co := QuorumKVInit(NewD("co"), "")
+	r1 := KVInit(NewD("r1"), "")
+	co.Relations["KVQuorumReplica"].DirectAdd("r1")
+	co.Relations["KVQuorumW"].DirectAdd(1)
+	co.Relations["KVQuorumR"].DirectAdd(1)
+	co.AddNext(co.Relations["KVPut"], &KVPut{ReqId: 1, Addr: "co",
+		ClientAddr: "c", Key: "k", Val: NewLMax(co, 3)})
+	co.AddNext(co.Relations["KVGet"], &KVGet{ReqId: 2, Addr: "co",
+		ClientAddr: "c", Key: "k"})
+	for i := 0; i < 10; i++ {
+		tickAll(co, r1)
+	}
+	if co.Relations["kvQuorumDone"].(*LSet).Size() != 2 {
+		t.Fatalf("expected both requests done")
+	}
+
+	co.AddNext(co.Relations["kvHintReplay"], true)
+	tickAll(co, r1)
+	for _, name := range []string{"kvQuorumPending", "kvQuorumDone",
+		"kvQuorumReplicaVal", "kvQuorumVal", "kvQuorumExpires", "kvQuorumAt",
+		"kvQuorumPut/multiTallyTotal", "kvQuorumGet/multiTallyTotal"} {
+		if n := co.Relations[name].(interface{ Size() int }).Size(); n != 0 {
+			t.Errorf("expected %s collected, got: %d", name, n)
+		}
+	}
+}
+
+func TestKVQuorumTargets(t *testing.T) {
+	d := NewD("")
+	replica := d.NewLSet(reflect.TypeOf(""))
+	for _, a := range []string{"r1", "r2", "r3", "r4", "r5"} {
+		replica.DirectAdd(a)
+	}
+	if got := kvQuorumTargets(replica, 0, "k"); len(got) != 5 {
+		t.Errorf("expected all replicas, got: %v", got)
+	}
+	firsts := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		k := fmt.Sprintf("k%d", i)
+		got := kvQuorumTargets(replica, 2, k)
+		if len(got) != 2 || got[0] == got[1] ||
+			!reflect.DeepEqual(got, kvQuorumTargets(replica, 2, k)) {
+			t.Errorf("expected 2 stable replicas, got: %v", got)
+		}
+		firsts[got[0]] = true
+	}
+	if len(firsts) != 5 {
+		t.Errorf("expected keys spread across replicas, got: %v", firsts)
+	}
+}
+
+func TestKVClient(t *testing.T) {
+	lt := NewLocalTransport()
+	server := lt.Register(KVInit(NewD("server"), ""))
+	stop := make(chan bool)
+	stopped := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				close(stopped)
+				return
+			case <-time.After(time.Millisecond):
+				server.Tick()
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+
+	c := NewKVClient(lt.Register(NewD("client")), "", "server")
+	ctx := context.Background()
+	if err := c.Put(ctx, "k", NewLMax(c.D, 3)); err != nil {
+		t.Errorf("expected put to work, got: %v", err)
+	}
+	if err := c.Put(ctx, "k", NewLMax(c.D, 2)); err != nil {
+		t.Errorf("expected put to work, got: %v", err)
+	}
+	v, err := c.Get(ctx, "k")
+	if err != nil || !LatticeEqual(v, NewLMax(c.D, 3)) {
+		t.Errorf("expected merged get, got: %#v, %v", v, err)
+	}
+	v, err = c.Get(ctx, "missing")
+	if err != nil || v != nil {
+		t.Errorf("expected nil for missing key, got: %#v, %v", v, err)
+	}
+	if err := c.Delete(ctx, "k"); err != nil {
+		t.Errorf("expected delete to work, got: %v", err)
+	}
+	v, err = c.Get(ctx, "k")
+	if err != nil || v != nil {
+		t.Errorf("expected nil for deleted key, got: %#v, %v", v, err)
+	}
+
+	lost := NewKVClient(lt.Register(NewD("lost")), "", "nobody")
+	lost.Timeout = 5 * time.Millisecond
+	lost.Retries = 1
+	if err := lost.Put(ctx, "k", NewLMax(lost.D, 1)); err != ErrKVTimeout {
+		t.Errorf("expected timeout, got: %v", err)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := lost.Get(ctx, "k"); err != context.Canceled {
+		t.Errorf("expected canceled, got: %v", err)
+	}
+}
+
+func TestKVDelete(t *testing.T) {
+	rs := []*D{}
+	for _, a := range []string{"r1", "r2", "r3"} {
+		d := ReplicatedKVInit(NewD(a), "")
+		for _, m := range []string{"r1", "r2", "r3"} {
+			d.Relations["KVMember"].DirectAdd(m)
+		}
+		d.AddNext(d.Relations["KVPut"], &KVPut{ReqId: 1, Addr: a,
+			ClientAddr: "c", Key: "k", Val: NewLMax(d, 1), Time: 10})
+		rs = append(rs, d)
+	}
+	tickAll(rs...)
+
+	// Only r1 hears of the delete, and the rest learn by gossip.
+	r1 := rs[0]
+	r1.AddNext(r1.Relations["KVDelete"], &KVDelete{ReqId: 2, Addr: "r1",
+		ClientAddr: "c", Key: "k", Time: 20})
+	tickAll(rs...)
+	if r1.Relations["kvMap"].(*LMap).At("k") != nil {
+		t.Errorf("expected k deleted from r1")
+	}
+	r1.AddNext(r1.Relations["KVPut"], &KVPut{ReqId: 3, Addr: "r1",
+		ClientAddr: "c", Key: "k", Val: NewLMax(r1, 2), Time: 15})
+	tickAll(rs...)
+	if r1.Relations["kvMap"].(*LMap).At("k") != nil {
+		t.Errorf("expected put older than the tombstone to be ignored")
+	}
+
+	for i := 0; i < 12; i++ {
+		for _, d := range rs {
+			d.AddNext(d.Relations["kvSweep"], true)
+		}
+		tickAll(rs...)
+	}
+	for _, d := range rs {
+		if d.Relations["kvMap"].(*LMap).At("k") != nil {
+			t.Errorf("expected k deleted from %s", d.Addr)
+		}
+		if d.Relations["kvTombstone"].(*LMap).At("k") != nil ||
+			d.Relations["kvTombstoneAck"].(*LSet).Size() != 0 {
+			t.Errorf("expected tombstone collected on %s", d.Addr)
+		}
+		if d.Relations["KVTombstone"].(*LSet).Size() != 0 {
+			t.Errorf("expected gossip to stop on %s", d.Addr)
+		}
+	}
+
+	r1.AddNext(r1.Relations["KVPut"], &KVPut{ReqId: 4, Addr: "r1",
+		ClientAddr: "c", Key: "k", Val: NewLMax(r1, 3), Time: 30})
+	tickAll(rs...)
+	if v := r1.Relations["kvMap"].(*LMap).At("k"); !LatticeEqual(v, NewLMax(r1, 3)) {
+		t.Errorf("expected put after the delete, got: %#v", v)
+	}
+}
+
+func TestKVDeleteCheckpoint(t *testing.T) {
+	d := KVInit(NewD("r"), "")
+	for _, name := range []string{"kvMap", "kvPutTime", "kvExpires", "kvTombstone"} {
+		if _, ok := d.persistent[d.Relations[name]]; ok {
+			t.Errorf("expected %s to not be persistent", name)
+		}
+	}
+	var deleted []interface{}
+	d.Watch(d.Relations["kvTombstone"], func(added []interface{}) {
+		deleted = append(deleted, added...)
+	})
+	d.AddNext(d.Relations["KVPut"], &KVPut{ReqId: 1, Addr: "r",
+		ClientAddr: "c", Key: "k", Val: NewLMax(d, 1), Time: 10})
+	d.Tick()
+	d.AddNext(d.Relations["KVDelete"], &KVDelete{ReqId: 2, Addr: "r",
+		ClientAddr: "c", Key: "k", Time: 20})
+	d.Tick()
+	if len(deleted) != 1 || deleted[0].(*LMapEntry).Key != "k" {
+		t.Errorf("expected the delete watched, got: %#v", deleted)
+	}
+
+	var buf bytes.Buffer
+	if err := d.Checkpoint(&buf); err != nil {
+		t.Fatal(err)
+	}
+	r, err := RestoreD(bytes.NewReader(buf.Bytes()), func(d *D) *D { return KVInit(d, "") })
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Tick()
+	if r.Relations["kvMap"].(*LMap).At("k") != nil {
+		t.Errorf("expected k to stay deleted after a restore")
+	}
+}
+
+func TestKVExpire(t *testing.T) {
+	d := KVInit(NewD("r"), "")
+	kvmap := d.Relations["kvMap"].(*LMap)
+	getr := d.Relations["KVGetResponse"].(*LSet)
+	get := func(key string) Lattice {
+		d.AddNext(d.Relations["KVGet"], &KVGet{ReqId: 1, Addr: "r",
+			ClientAddr: "c", Key: key})
+		d.Tick()
+		d.Tick()
+		var v Lattice
+		for x := range getr.Scan() {
+			v = x.(*KVGetResponse).Val
+		}
+		return v
+	}
+
+	soon := time.Now().Add(20 * time.Millisecond).UnixNano()
+	d.AddNext(d.Relations["KVPut"], &KVPut{ReqId: 1, Addr: "r",
+		ClientAddr: "c", Key: "a", Val: NewLMax(d, 1), Expires: soon})
+	d.AddNext(d.Relations["KVPut"], &KVPut{ReqId: 2, Addr: "r",
+		ClientAddr: "c", Key: "b", Val: NewLMax(d, 1), Expires: soon})
+	d.AddNext(d.Relations["KVPut"], &KVPut{ReqId: 3, Addr: "r",
+		ClientAddr: "c", Key: "b", Val: NewLMax(d, 2)})
+	d.AddNext(d.Relations["KVPut"], &KVPut{ReqId: 4, Addr: "r",
+		ClientAddr: "c", Key: "c", Val: NewLMax(d, 1), Expires: 1})
+	d.Tick()
+	if get("a") == nil || get("c") != nil {
+		t.Errorf("expected a to be live and c to be expired")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if get("a") != nil {
+		t.Errorf("expected a to be expired")
+	}
+	if !LatticeEqual(get("b"), NewLMax(d, 2)) {
+		t.Errorf("expected b to never expire")
+	}
+	d.AddNext(d.Relations["kvSweep"], true)
+	d.Tick()
+	if kvmap.At("a") != nil || kvmap.At("b") == nil {
+		t.Errorf("expected a to be swept, got: %#v", kvmap.m)
+	}
+}
+
+func TestKVMerkleTreeUpdate(t *testing.T) {
+	d := NewD("")
+	kvmap := d.NewLMap()
+	tree := newKVMerkleTree()
+	kvmap.observe(tree.update)
+	for i := 0; i < 300; i++ {
+		kvmap.DirectAdd(&LMapEntry{fmt.Sprintf("k%d", i%200), NewLMax(d, i)})
+		if i%3 == 0 {
+			kvmap.remove(fmt.Sprintf("k%d", i%50))
+		}
+	}
+	tree.rehash()
+
+	full := newKVMerkleTree()
+	kvmap.each(full.update)
+	full.rehash()
+	if !reflect.DeepEqual(tree.levels, full.levels) ||
+		!reflect.DeepEqual(tree.leaves, full.leaves) {
+		t.Errorf("expected an updated tree to match a tree built from scratch")
+	}
+
+	empty := newKVMerkleTree()
+	kvmap.each(func(k string, v Lattice) { kvmap.remove(k) })
+	tree.rehash()
+	if !reflect.DeepEqual(tree.levels, empty.levels) {
+		t.Errorf("expected removals to restore the empty tree")
+	}
+}
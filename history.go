@@ -0,0 +1,172 @@
+package gdec
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// An operation in a history, from its invocation to its completion.
+type Op struct {
+	Id     string // Unique per operation, like "clientAddr/reqId".
+	Client string
+	Input  interface{}
+	Output interface{}
+	Call   int64 // Logical time of invocation.
+	Return int64 // Logical time of completion.
+}
+
+// Records invoke/complete events, such as from a simulated run, for
+// later feeding to CheckLinearizable().
+type History struct {
+	clock   int64
+	pending map[string]*Op
+	ops     []*Op
+}
+
+func NewHistory() *History {
+	return &History{pending: map[string]*Op{}}
+}
+
+// Repeated invocations of the same id are ignored.
+func (h *History) Invoke(id, client string, input interface{}) {
+	if h.pending[id] != nil {
+		return
+	}
+	for _, op := range h.ops {
+		if op.Id == id {
+			return
+		}
+	}
+	h.clock++
+	h.pending[id] = &Op{Id: id, Client: client, Input: input, Call: h.clock}
+}
+
+// Completions of unknown or already completed ids are ignored.
+func (h *History) Complete(id string, output interface{}) {
+	op := h.pending[id]
+	if op == nil {
+		return
+	}
+	h.clock++
+	op.Output = output
+	op.Return = h.clock
+	delete(h.pending, id)
+	h.ops = append(h.ops, op)
+}
+
+// Returns the completed operations, ordered by invocation.  Pending
+// operations are left out, as they may or may not have taken effect.
+func (h *History) Ops() []Op {
+	ops := make([]Op, len(h.ops))
+	for i, op := range h.ops {
+		ops[i] = *op
+	}
+	sort.Sort(opsByCall(ops))
+	return ops
+}
+
+type opsByCall []Op
+
+func (a opsByCall) Len() int           { return len(a) }
+func (a opsByCall) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a opsByCall) Less(i, j int) bool { return a[i].Call < a[j].Call }
+
+// ------------------------------------------------------------------------
+
+// Input of an operation recorded by RecordKVHistory().
+type KVOpInput struct {
+	Put    bool
+	Delete bool
+	Key    string
+	Val    Lattice // Only for puts.
+}
+
+func kvOpId(clientAddr string, reqId int64) string {
+	return fmt.Sprintf("%s/%d", clientAddr, reqId)
+}
+
+// Records the KV requests and responses seen by a KVInit() replica,
+// and should be invoked after each Tick().  Lattices are snapshotted,
+// as replicas hand out their live values.
+func RecordKVHistory(h *History, d *D, prefix string) {
+	for x := range d.Relations[prefix+"KVPut"].Scan() {
+		k := x.(*KVPut)
+		h.Invoke(kvOpId(k.ClientAddr, k.ReqId), k.ClientAddr,
+			&KVOpInput{Put: true, Key: k.Key, Val: snapshotLattice(k.Val)})
+	}
+	for x := range d.Relations[prefix+"KVGet"].Scan() {
+		k := x.(*KVGet)
+		h.Invoke(kvOpId(k.ClientAddr, k.ReqId), k.ClientAddr,
+			&KVOpInput{Key: k.Key})
+	}
+	for x := range d.Relations[prefix+"KVDelete"].Scan() {
+		k := x.(*KVDelete)
+		h.Invoke(kvOpId(k.ClientAddr, k.ReqId), k.ClientAddr,
+			&KVOpInput{Delete: true, Key: k.Key})
+	}
+	for x := range d.Relations[prefix+"KVPutResponse"].Scan() {
+		k := x.(*KVPutResponse)
+		h.Complete(kvOpId(k.Addr, k.ReqId), nil)
+	}
+	for x := range d.Relations[prefix+"KVGetResponse"].Scan() {
+		k := x.(*KVGetResponse)
+		h.Complete(kvOpId(k.Addr, k.ReqId), snapshotLattice(k.Val))
+	}
+}
+
+func snapshotLattice(v Lattice) Lattice {
+	if v == nil || isNil(reflect.ValueOf(v)) {
+		return nil
+	}
+	return v.Snapshot()
+}
+
+// Sequential model of the KV store, where puts merge into a key's
+// lattice, deletes clear it, and gets return the merged lattice.
+// Partitions by key.
+var KVModel = Model{
+	Partition: func(ops []Op) [][]Op {
+		m := map[string][]Op{}
+		keys := []string{}
+		for _, op := range ops {
+			k := op.Input.(*KVOpInput).Key
+			if m[k] == nil {
+				keys = append(keys, k)
+			}
+			m[k] = append(m[k], op)
+		}
+		sort.Strings(keys)
+		res := make([][]Op, len(keys))
+		for i, k := range keys {
+			res[i] = m[k]
+		}
+		return res
+	},
+	Init: func() interface{} { return nil },
+	Step: func(state, input, output interface{}) (bool, interface{}) {
+		s, _ := state.(Lattice)
+		in := input.(*KVOpInput)
+		if in.Delete {
+			return true, nil
+		}
+		if in.Put {
+			if in.Val == nil {
+				return true, s
+			}
+			if s == nil {
+				return true, in.Val.Snapshot()
+			}
+			n := s.Snapshot()
+			n.DirectMerge(in.Val.(Relation))
+			return true, n
+		}
+		out, _ := output.(Lattice)
+		return LatticeEqual(s, out), s
+	},
+	Equal: func(a, b interface{}) bool {
+		al, _ := a.(Lattice)
+		bl, _ := b.(Lattice)
+		return LatticeEqual(al, bl)
+	},
+}
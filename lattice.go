@@ -3,7 +3,10 @@ package gdec
 import (
 	"encoding/json"
 	"fmt"
+	"hash"
+	"hash/fnv"
 	"reflect"
+	"sort"
 )
 
 type Lattice interface {
@@ -12,10 +15,11 @@ type Lattice interface {
 }
 
 type LMap struct {
-	name    string
-	d       *D
-	m       map[string]Lattice
-	scratch bool
+	name      string
+	d         *D
+	m         Storage // Val: Lattice.
+	scratch   bool
+	observers []func(key string, v Lattice) // See observe().
 }
 
 type LMapEntry struct {
@@ -24,12 +28,13 @@ type LMapEntry struct {
 }
 
 type LSet struct {
-	name    string
-	d       *D
-	t       reflect.Type
-	m       map[string]interface{}
-	scratch bool
-	channel bool // When true, this LSet was declared as a channel.
+	name     string
+	d        *D
+	t        reflect.Type
+	m        Storage // Key: JSON of the tuple.
+	scratch  bool
+	channel  bool // When true, this LSet was declared as a channel.
+	reliable bool // When true, transports should retransmit until acked.
 }
 
 type LMax struct {
@@ -83,10 +88,23 @@ func (d *D) DeclareLBool(name string) *LBool {
 	return d.DeclareRelation(name, m).(*LBool)
 }
 
-func (d *D) NewLMap() *LMap { return &LMap{d: d, m: map[string]Lattice{}} }
+func (d *D) NewLMap() *LMap { return &LMap{d: d, m: NewMemStorage()} }
 
 func (d *D) NewLSet(t reflect.Type) *LSet {
-	return &LSet{d: d, t: t, m: map[string]interface{}{}}
+	return &LSet{d: d, t: t, m: NewMemStorage()}
+}
+
+// Replaces the Storage of an empty LMap, like with a DiskStorage.
+func (m *LMap) DeclareStorage(s Storage) {
+	m.m = s
+	for _, f := range m.observers { // Storage may have restored entries.
+		m.each(f)
+	}
+}
+
+// Replaces the Storage of an empty LSet, like with a DiskStorage.
+func (m *LSet) DeclareStorage(s Storage) {
+	m.m = s
 }
 
 func (d *D) NewLMax() *LMax { return &LMax{d: d} }
@@ -139,13 +157,16 @@ func (m *LBool) DeclareScratch() {
 
 func (m *LMap) startTick() {
 	if m.scratch {
-		m.m = map[string]Lattice{}
+		if len(m.observers) > 0 {
+			m.each(func(k string, v Lattice) { m.notify(k, nil) })
+		}
+		m.m.Clear()
 	}
 }
 
 func (m *LSet) startTick() {
 	if m.scratch {
-		m.m = map[string]interface{}{}
+		m.m.Clear()
 	}
 }
 
@@ -167,37 +188,105 @@ func (m *LBool) startTick() {
 	}
 }
 
+func relationScratch(r Relation) bool {
+	switch x := r.(type) {
+	case *LMap:
+		return x.scratch
+	case *LSet:
+		return x.scratch
+	case *LMax:
+		return x.scratch
+	case *LMaxString:
+		return x.scratch
+	case *LBool:
+		return x.scratch
+	}
+	return false
+}
+
 func (m *LMap) DirectAdd(v interface{}) bool {
 	if v == nil {
 		panic("unexpected nil during LMap.DirectAdd")
 	}
 	e := v.(*LMapEntry)
-	o, _ := m.m[e.Key]
-	if o != nil {
+	if o := m.At(e.Key); o != nil {
 		changed := o.DirectMerge(e.Val.(Relation))
-		m.m[e.Key] = o
+		if changed {
+			m.m.Put(e.Key, o)
+			m.notify(e.Key, o)
+		}
 		return changed
 	}
-	m.m[e.Key] = e.Val
+	m.m.Put(e.Key, e.Val)
+	m.notify(e.Key, e.Val)
 	return true
 }
 
+// Non-monotonic, so only for garbage collection, such as of tombstones.
+func (m *LMap) remove(key string) bool {
+	if !m.m.Delete(key) {
+		return false
+	}
+	m.notify(key, nil)
+	return true
+}
+
+// Invokes f on each existing entry, and from then on with each added
+// or changed entry, or with a nil v for a removed entry, so f can keep
+// an index of the LMap up to date, like a Merkle tree.
+func (m *LMap) observe(f func(key string, v Lattice)) {
+	m.observers = append(m.observers, f)
+	m.each(f)
+}
+
+func (m *LMap) notify(key string, v Lattice) {
+	for _, f := range m.observers {
+		f(key, v)
+	}
+}
+
+// Invokes f on each entry, without Scan()'s goroutine, so f may
+// remove entries.
+func (m *LMap) each(f func(key string, v Lattice)) {
+	m.m.Scan(func(k string, v interface{}) bool {
+		f(k, v.(Lattice))
+		return true
+	})
+}
+
+func (m *LSet) each(f func(v interface{})) {
+	m.m.Scan(func(k string, v interface{}) bool {
+		f(v)
+		return true
+	})
+}
+
 func (m *LSet) DirectAdd(v interface{}) bool {
+	js, err := lsetKey(v)
+	if err != nil {
+		panic(fmt.Sprintf("%v during LSet.DirectAdd, LSet.name: %s", err, m.name))
+	}
+	if _, exists := m.m.Get(js); exists {
+		return false
+	}
+	m.m.Put(js, v)
+	return true
+}
+
+// Returns the key of an LSet element, or an error for elements that
+// can't be keyed, like nil's, which LSet's don't allow.
+func lsetKey(v interface{}) (string, error) {
 	if v == nil {
-		panic("unexpected nil during LSet.DirectAdd")
+		return "", fmt.Errorf("unexpected nil")
 	}
 	j, err := json.Marshal(v)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 	if string(j) == "null" {
-		panic(fmt.Sprintf("unexpected null during LSet.DirectAdd"+
-			", v: %#v, LSet.name: %s", v, m.name))
+		return "", fmt.Errorf("unexpected null, v: %#v", v)
 	}
-	js := string(j)
-	_, exists := m.m[js]
-	m.m[js] = v
-	return !exists
+	return string(j), nil
 }
 
 func (m *LMax) DirectAdd(v interface{}) bool {
@@ -226,19 +315,17 @@ func (m *LBool) DirectAdd(v interface{}) bool {
 
 func (m *LMap) DirectMerge(rel Relation) bool {
 	changed := false
-	r := rel.(*LMap)
-	for k, v := range r.m {
+	rel.(*LMap).each(func(k string, v Lattice) {
 		changed = m.DirectAdd(&LMapEntry{k, v}) || changed
-	}
+	})
 	return changed
 }
 
 func (m *LSet) DirectMerge(rel Relation) bool {
 	changed := false
-	r := rel.(*LSet)
-	for _, v := range r.m {
+	rel.(*LSet).each(func(v interface{}) {
 		changed = m.DirectAdd(v) || changed
-	}
+	})
 	return changed
 }
 
@@ -257,9 +344,7 @@ func (m *LBool) DirectMerge(rel Relation) bool {
 func (m *LMap) Scan() chan interface{} {
 	ch := make(chan interface{})
 	go func() {
-		for k, v := range m.m {
-			ch <- &LMapEntry{k, v}
-		}
+		m.each(func(k string, v Lattice) { ch <- &LMapEntry{k, v} })
 		close(ch)
 	}()
 	return ch
@@ -268,9 +353,7 @@ func (m *LMap) Scan() chan interface{} {
 func (m *LSet) Scan() chan interface{} {
 	ch := make(chan interface{})
 	go func() {
-		for _, v := range m.m {
-			ch <- v
-		}
+		m.each(func(v interface{}) { ch <- v })
 		close(ch)
 	}()
 	return ch
@@ -305,22 +388,21 @@ func (m *LBool) Scan() chan interface{} {
 
 func (m *LMap) Snapshot() Lattice {
 	s := m.d.NewLMap()
-	for k, v := range m.m {
-		s.m[k] = v.Snapshot()
-	}
+	m.each(func(k string, v Lattice) { s.m.Put(k, v.Snapshot()) })
 	return s
 }
 
 func (m *LSet) Snapshot() Lattice {
 	s := m.d.NewLSet(m.t)
-	for k, v := range m.m {
+	m.m.Scan(func(k string, v interface{}) bool {
 		switch v.(type) {
 		case Lattice:
-			s.m[k] = v.(Lattice).Snapshot()
+			s.m.Put(k, v.(Lattice).Snapshot())
 		default:
-			s.m[k] = v
+			s.m.Put(k, v)
 		}
-	}
+		return true
+	})
 	return s
 }
 
@@ -342,9 +424,15 @@ func (m *LBool) Snapshot() Lattice {
 	return s
 }
 
+// With storage like DiskStorage, returns a copy.
 func (m *LMap) At(key string) Lattice {
-	v, _ := m.m[key]
-	return v
+	v, _ := m.m.Get(key)
+	l, _ := v.(Lattice)
+	return l
+}
+
+func (m *LMap) Size() int {
+	return m.m.Len()
 }
 
 func (m *LSet) Contains(v interface{}) bool {
@@ -358,13 +446,21 @@ func (m *LSet) Contains(v interface{}) bool {
 	if string(j) == "null" {
 		panic("unexpected null during LSet.Contains")
 	}
-	js := string(j)
-	_, ok := m.m[js]
+	_, ok := m.m.Get(string(j))
 	return ok
 }
 
+// Non-monotonic, so only for garbage collection, such as of tombstones.
+func (m *LSet) remove(v interface{}) bool {
+	j, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return m.m.Delete(string(j))
+}
+
 func (m *LSet) Size() int {
-	return len(m.m)
+	return m.m.Len()
 }
 
 func (m *LMax) Int() int {
@@ -379,12 +475,101 @@ func (m *LBool) Bool() bool {
 	return m.v
 }
 
+// Compares lattice values, where nil only equals nil.
+func LatticeEqual(a, b Lattice) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	switch av := a.(type) {
+	case *LMap:
+		bv, ok := b.(*LMap)
+		if !ok || av.Size() != bv.Size() {
+			return false
+		}
+		eq := true
+		av.m.Scan(func(k string, v interface{}) bool {
+			eq = LatticeEqual(v.(Lattice), bv.At(k))
+			return eq
+		})
+		return eq
+	case *LSet:
+		bv, ok := b.(*LSet)
+		if !ok || av.Size() != bv.Size() {
+			return false
+		}
+		eq := true
+		av.m.Scan(func(k string, v interface{}) bool {
+			_, eq = bv.m.Get(k)
+			return eq
+		})
+		return eq
+	case *LMax:
+		bv, ok := b.(*LMax)
+		return ok && av.v == bv.v
+	case *LMaxString:
+		bv, ok := b.(*LMaxString)
+		return ok && av.v == bv.v
+	case *LBool:
+		bv, ok := b.(*LBool)
+		return ok && av.v == bv.v
+	}
+	return false
+}
+
+// Hash of a lattice value, where equal values have equal hashes.
+func LatticeHash(l Lattice) uint64 {
+	h := fnv.New64a()
+	latticeHashWrite(h, l)
+	return h.Sum64()
+}
+
+func latticeHashWrite(h hash.Hash64, l Lattice) {
+	switch v := l.(type) {
+	case *LMap:
+		keys := storageKeys(v.m)
+		fmt.Fprintf(h, "LMap:%d{", len(keys))
+		for _, k := range keys {
+			fmt.Fprintf(h, "%q:", k)
+			latticeHashWrite(h, v.At(k))
+		}
+		fmt.Fprintf(h, "}")
+	case *LSet:
+		keys := storageKeys(v.m)
+		fmt.Fprintf(h, "LSet:%d%q", len(keys), keys)
+	case *LMax:
+		fmt.Fprintf(h, "LMax:%d", v.v)
+	case *LMaxString:
+		fmt.Fprintf(h, "LMaxString:%q", v.v)
+	case *LBool:
+		fmt.Fprintf(h, "LBool:%t", v.v)
+	default:
+		fmt.Fprintf(h, "nil")
+	}
+}
+
+// Returns the sorted keys of a Storage.
+func storageKeys(s Storage) []string {
+	keys := make([]string, 0, s.Len())
+	s.Scan(func(k string, v interface{}) bool {
+		keys = append(keys, k)
+		return true
+	})
+	sort.Strings(keys)
+	return keys
+}
+
 func NewLSetOne(d *D, v interface{}) *LSet { // Helper creator for a 1 item LSet.
 	s := d.NewLSet(reflect.TypeOf(v))
 	s.DirectAdd(v)
 	return s
 }
 
+func NewLMax(d *D, v int) *LMax { // Helper creator for an initialized LMax.
+	s := d.NewLMax()
+	s.DirectAdd(v)
+	return s
+}
+
 func NewLBool(d *D, v bool) *LBool { // Helper creator for an initialized LBool.
 	s := d.NewLBool()
 	s.DirectAdd(v)
@@ -0,0 +1,208 @@
+package gdec
+
+// Sequential specification of an object, for CheckLinearizable().
+type Model struct {
+	// Optional, splits a history into independently checkable
+	// sub-histories, such as by key.
+	Partition func(ops []Op) [][]Op
+
+	Init func() interface{}
+
+	// Returns whether the output is legal for the input in the given
+	// state, along with the next state.
+	Step func(state, input, output interface{}) (bool, interface{})
+
+	// Optional, defaults to ==.
+	Equal func(a, b interface{}) bool
+}
+
+// Checks whether a history is linearizable with respect to a model,
+// using the Wing & Gong search with Lowe's memoization, as in Knossos
+// and Porcupine.  On failure, also returns a minimal violating
+// sub-history, where removing any single op makes it linearizable.
+func CheckLinearizable(model Model, ops []Op) (bool, []Op) {
+	parts := [][]Op{ops}
+	if model.Partition != nil {
+		parts = model.Partition(ops)
+	}
+	for _, part := range parts {
+		if !checkOps(model, part) {
+			return false, minimizeOps(model, part)
+		}
+	}
+	return true, nil
+}
+
+// Greedily drops ops while the rest still fails the check.
+func minimizeOps(model Model, ops []Op) []Op {
+	min := append([]Op(nil), ops...)
+	for i := 0; i < len(min); {
+		rest := append(append([]Op(nil), min[:i]...), min[i+1:]...)
+		if !checkOps(model, rest) {
+			min = rest
+		} else {
+			i++
+		}
+	}
+	return min
+}
+
+type linEntry struct {
+	op    int // Index of op in the history.
+	call  bool
+	time  int64
+	match *linEntry // A call's return entry.
+	prev  *linEntry
+	next  *linEntry
+}
+
+type linCall struct {
+	entry *linEntry
+	state interface{}
+}
+
+type linCacheEntry struct {
+	linearized bitset
+	state      interface{}
+}
+
+func checkOps(model Model, ops []Op) bool {
+	equal := model.Equal
+	if equal == nil {
+		equal = func(a, b interface{}) bool { return a == b }
+	}
+
+	head := makeLinEntries(ops)
+
+	lift := func(e *linEntry) {
+		e.prev.next = e.next
+		e.next.prev = e.prev
+		m := e.match
+		m.prev.next = m.next
+		if m.next != nil {
+			m.next.prev = m.prev
+		}
+	}
+	unlift := func(e *linEntry) {
+		m := e.match
+		m.prev.next = m
+		if m.next != nil {
+			m.next.prev = m
+		}
+		e.prev.next = e
+		e.next.prev = e
+	}
+
+	cache := map[uint64][]linCacheEntry{}
+	cached := func(linearized bitset, state interface{}) bool {
+		for _, c := range cache[linearized.hash()] {
+			if c.linearized.equals(linearized) && equal(c.state, state) {
+				return true
+			}
+		}
+		return false
+	}
+
+	linearized := newBitset(len(ops))
+	state := model.Init()
+	calls := []linCall{}
+
+	e := head.next
+	for head.next != nil {
+		if e.call {
+			ok, next := model.Step(state, ops[e.op].Input, ops[e.op].Output)
+			if ok {
+				l := linearized.clone().set(e.op)
+				if !cached(l, next) {
+					h := l.hash()
+					cache[h] = append(cache[h], linCacheEntry{l, next})
+					calls = append(calls, linCall{e, state})
+					state = next
+					linearized.set(e.op)
+					lift(e)
+					e = head.next
+					continue
+				}
+			}
+			e = e.next
+		} else {
+			// Reached a return before its call was linearized, so backtrack.
+			if len(calls) <= 0 {
+				return false
+			}
+			c := calls[len(calls)-1]
+			calls = calls[:len(calls)-1]
+			state = c.state
+			linearized.clear(c.entry.op)
+			unlift(c.entry)
+			e = c.entry.next
+		}
+	}
+	return true
+}
+
+// Returns the head sentinel of a list of call and return entries,
+// ordered by time, with calls before returns at equal times.
+func makeLinEntries(ops []Op) *linEntry {
+	entries := make([]*linEntry, 0, 2*len(ops))
+	for i, op := range ops {
+		c := &linEntry{op: i, call: true, time: op.Call}
+		r := &linEntry{op: i, time: op.Return}
+		c.match = r
+		entries = append(entries, c, r)
+	}
+	for i := 1; i < len(entries); i++ { // Insertion sort, stable.
+		for j := i; j > 0 && linEntryLess(entries[j], entries[j-1]); j-- {
+			entries[j], entries[j-1] = entries[j-1], entries[j]
+		}
+	}
+	head := &linEntry{}
+	prev := head
+	for _, e := range entries {
+		e.prev = prev
+		prev.next = e
+		prev = e
+	}
+	return head
+}
+
+func linEntryLess(a, b *linEntry) bool {
+	if a.time != b.time {
+		return a.time < b.time
+	}
+	return a.call && !b.call
+}
+
+type bitset []uint64
+
+func newBitset(n int) bitset { return make(bitset, (n+63)/64) }
+
+func (b bitset) clone() bitset { return append(bitset(nil), b...) }
+
+func (b bitset) set(i int) bitset {
+	b[i/64] |= 1 << uint(i%64)
+	return b
+}
+
+func (b bitset) clear(i int) bitset {
+	b[i/64] &^= 1 << uint(i%64)
+	return b
+}
+
+func (b bitset) equals(o bitset) bool {
+	for i := range b {
+		if b[i] != o[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (b bitset) hash() uint64 {
+	h := uint64(14695981039346656037) // FNV-1a.
+	for _, x := range b {
+		h ^= x
+		h *= 1099511628211
+	}
+	return h
+}
@@ -0,0 +1,84 @@
+package gdec
+
+import (
+	"testing"
+)
+
+var registerModel = Model{
+	Init: func() interface{} { return 0 },
+	Step: func(state, input, output interface{}) (bool, interface{}) {
+		if input.(int) >= 0 { // Write.
+			return true, input
+		}
+		return output == state, state // Read.
+	},
+}
+
+func TestCheckLinearizable(t *testing.T) {
+	ok, _ := CheckLinearizable(registerModel, []Op{
+		{Id: "w1", Input: 1, Call: 1, Return: 4},
+		{Id: "r1", Input: -1, Output: 1, Call: 2, Return: 3},
+		{Id: "r0", Input: -1, Output: 0, Call: 2, Return: 5},
+	})
+	if !ok {
+		t.Errorf("expected linearizable with concurrent ops")
+	}
+
+	ok, min := CheckLinearizable(registerModel, []Op{
+		{Id: "w1", Input: 1, Call: 1, Return: 2},
+		{Id: "w2", Input: 2, Call: 3, Return: 4},
+		{Id: "r0", Input: -1, Output: 0, Call: 5, Return: 6},
+	})
+	if ok {
+		t.Errorf("expected not linearizable with a stale read")
+	}
+	if len(min) != 2 || min[0].Id != "w2" || min[1].Id != "r0" {
+		t.Errorf("expected minimal violation of w2 and r0, got: %#v", min)
+	}
+}
+
+func TestKVHistory(t *testing.T) {
+	h := NewHistory()
+	d1 := KVInit(NewD("r1"), "")
+	d2 := KVInit(NewD("r2"), "")
+	tick := func(d *D) {
+		d.Tick()
+		RecordKVHistory(h, d, "")
+	}
+
+	d1.AddNext(d1.Relations["KVPut"], &KVPut{ReqId: 1, Addr: "r1",
+		ClientAddr: "c", Key: "k", Val: NewLMax(d1, 1)})
+	tick(d1)
+	tick(d1)
+	d1.AddNext(d1.Relations["KVGet"], &KVGet{ReqId: 2, Addr: "r1",
+		ClientAddr: "c", Key: "k"})
+	tick(d1)
+	d1.AddNext(d1.Relations["KVPut"], &KVPut{ReqId: 3, Addr: "r1",
+		ClientAddr: "c", Key: "k", Val: NewLMax(d1, 5)})
+	tick(d1)
+	tick(d1)
+
+	ops := h.Ops()
+	if len(ops) != 3 {
+		t.Errorf("expected 3 ops, got: %#v", ops)
+	}
+	if !LatticeEqual(ops[1].Output.(Lattice), NewLMax(d1, 1)) {
+		t.Errorf("expected get output snapshotted, got: %#v", ops[1].Output)
+	}
+	if ok, min := CheckLinearizable(KVModel, ops); !ok {
+		t.Errorf("expected linearizable, got: %#v", min)
+	}
+
+	// A get from a replica that hasn't seen the put is stale.
+	d2.AddNext(d2.Relations["KVGet"], &KVGet{ReqId: 4, Addr: "r2",
+		ClientAddr: "c", Key: "k"})
+	tick(d2)
+	tick(d2)
+	ok, min := CheckLinearizable(KVModel, h.Ops())
+	if ok {
+		t.Errorf("expected not linearizable")
+	}
+	if len(min) != 2 || min[1].Id != "c/4" {
+		t.Errorf("expected minimal violation with the stale get, got: %#v", min)
+	}
+}
@@ -0,0 +1,243 @@
+package gdec
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// A reusable group of relations and joins, declared by an XInit()
+// style func, which can be instantiated into a D under a namespace.
+// Each of the module's Ports must be a relation its Init declares and
+// marks to match, via Input(), Output(), External() or
+// DeclareChannel().  Other relations, including any ports of its own
+// sub-modules, are internal.
+type Module struct {
+	Name  string
+	Init  func(d *D, prefix string) *D
+	Ports map[string]PortKind // Key: relation name, without the prefix.
+}
+
+var modules = map[string]*Module{}
+
+// Registers a module by name, such as for tools like gdec-repl.
+func RegisterModule(m *Module) {
+	if modules[m.Name] != nil {
+		panic(fmt.Sprintf("module registered twice: %s", m.Name))
+	}
+	modules[m.Name] = m
+}
+
+// Returns nil for an unknown name.
+func ModuleByName(name string) *Module {
+	return modules[name]
+}
+
+// Returns the registered module names, sorted.
+func ModuleNames() []string {
+	res := make([]string, 0, len(modules))
+	for name := range modules {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+type PortKind int
+
+const (
+	PortInput PortKind = iota
+	PortOutput
+	PortExternal
+	PortChannel
+)
+
+type Port struct {
+	Name     string // Without the namespace.
+	Kind     PortKind
+	Relation Relation
+}
+
+type ModuleInstance struct {
+	Module    *Module
+	Namespace string
+	d         *D
+	ports     map[string]*Port
+}
+
+// Declares the module's relations and joins, named with the prefix
+// of namespace + "/", or with no prefix for an empty namespace.  It's
+// a declaration error for the module to declare relations outside of
+// its namespace, or to not declare and mark its ports.
+func (d *D) Instantiate(m *Module, namespace string) *ModuleInstance {
+	prefix := ""
+	if namespace != "" {
+		prefix = namespace + "/"
+	}
+	before := map[string]bool{}
+	for name := range d.Relations {
+		before[name] = true
+	}
+
+	m.Init(d, prefix)
+
+	for name := range d.Relations {
+		if !before[name] && !strings.HasPrefix(name, prefix) {
+			d.declError("module: %s, namespace: %s, declared relation"+
+				" outside its namespace: %s", m.Name, namespace, name)
+		}
+	}
+
+	mi := &ModuleInstance{Module: m, Namespace: namespace, d: d, ports: map[string]*Port{}}
+	names := make([]string, 0, len(m.Ports))
+	for name := range m.Ports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		kind := m.Ports[name]
+		r := d.Relations[prefix+name]
+		if r == nil || before[prefix+name] {
+			d.declError("module: %s, namespace: %s, did not declare port: %s",
+				m.Name, namespace, name)
+			continue
+		}
+		if k, ok := d.portKind(r); !ok || k != kind {
+			d.declError("module: %s, namespace: %s, port: %s, is not marked as: %v",
+				m.Name, namespace, name, kind)
+			continue
+		}
+		mi.ports[name] = &Port{Name: name, Kind: kind, Relation: r}
+	}
+	return mi
+}
+
+// Returns the kind of port a relation is marked as, if any.
+func (d *D) portKind(r Relation) (PortKind, bool) {
+	if d.inputs[r] {
+		return PortInput, true
+	} else if d.outputs[r] {
+		return PortOutput, true
+	} else if d.externals[r] {
+		return PortExternal, true
+	} else if s, ok := r.(*LSet); ok && s.channel {
+		return PortChannel, true
+	}
+	return 0, false
+}
+
+func (mi *ModuleInstance) Prefix() string {
+	if mi.Namespace == "" {
+		return ""
+	}
+	return mi.Namespace + "/"
+}
+
+// Returns the ports, sorted by name.
+func (mi *ModuleInstance) Ports() []*Port {
+	res := make([]*Port, 0, len(mi.ports))
+	for _, p := range mi.ports {
+		res = append(res, p)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// Returns the named port, where an unknown name is a declaration error.
+func (mi *ModuleInstance) Port(name string) *Port {
+	p := mi.ports[name]
+	if p == nil {
+		mi.d.declError("module: %s, namespace: %s, has no port: %s",
+			mi.Module.Name, mi.Namespace, name)
+	}
+	return p
+}
+
+// Returns the named relation, including non-port relations, where an
+// unknown name is a declaration error.
+func (mi *ModuleInstance) Relation(name string) Relation {
+	r := mi.d.Relations[mi.Prefix()+name]
+	if r == nil {
+		mi.d.declError("module: %s, namespace: %s, has no relation: %s",
+			mi.Module.Name, mi.Namespace, name)
+	}
+	return r
+}
+
+func (mi *ModuleInstance) portOf(name string, x interface{}) interface{} {
+	p := mi.Port(name)
+	if p == nil {
+		return nil
+	}
+	if reflect.TypeOf(p.Relation) != reflect.TypeOf(x) {
+		mi.d.declError("module: %s, namespace: %s, port: %s, is a: %T, not: %T",
+			mi.Module.Name, mi.Namespace, name, p.Relation, x)
+		return nil
+	}
+	return p.Relation
+}
+
+// Typed port accessors, which return nil on a declaration error.
+
+func (mi *ModuleInstance) LSet(name string) *LSet {
+	r, _ := mi.portOf(name, (*LSet)(nil)).(*LSet)
+	return r
+}
+
+func (mi *ModuleInstance) LMap(name string) *LMap {
+	r, _ := mi.portOf(name, (*LMap)(nil)).(*LMap)
+	return r
+}
+
+func (mi *ModuleInstance) LMax(name string) *LMax {
+	r, _ := mi.portOf(name, (*LMax)(nil)).(*LMax)
+	return r
+}
+
+func (mi *ModuleInstance) LMaxString(name string) *LMaxString {
+	r, _ := mi.portOf(name, (*LMaxString)(nil)).(*LMaxString)
+	return r
+}
+
+func (mi *ModuleInstance) LBool(name string) *LBool {
+	r, _ := mi.portOf(name, (*LBool)(nil)).(*LBool)
+	return r
+}
+
+// Wires a relation to a port of the same relation and tuple type, by
+// a join from the relation into an input, external or channel port,
+// or from an output port into the relation.
+func (mi *ModuleInstance) Connect(port string, r Relation) *ModuleInstance {
+	p := mi.Port(port)
+	if p == nil {
+		return mi
+	}
+	if reflect.TypeOf(p.Relation) != reflect.TypeOf(r) ||
+		p.Relation.TupleType() != r.TupleType() {
+		mi.d.declError("module: %s, namespace: %s, port: %s, of: %T[%v]"+
+			", can't connect to: %T[%v]", mi.Module.Name, mi.Namespace, port,
+			p.Relation, p.Relation.TupleType(), r, r.TupleType())
+		return mi
+	}
+	if p.Kind == PortOutput {
+		mi.d.Join(p.Relation).Into(r)
+	} else {
+		mi.d.Join(r).Into(p.Relation)
+	}
+	return mi
+}
+
+func (k PortKind) String() string {
+	switch k {
+	case PortInput:
+		return "input"
+	case PortOutput:
+		return "output"
+	case PortExternal:
+		return "external"
+	case PortChannel:
+		return "channel"
+	}
+	return fmt.Sprintf("PortKind(%d)", int(k))
+}
@@ -0,0 +1,109 @@
+package gdec
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestModule(t *testing.T) {
+	d := NewD("")
+	votes := d.Input(d.DeclareLSet("votes", "voterString"))
+	done := d.Output(d.DeclareLBool("done"))
+
+	t1 := d.Instantiate(TallyModule, "t1")
+	t1.Connect("TallyVote", votes).Connect("TallyDone", done)
+	t2 := d.Instantiate(TallyModule, "t2")
+	t2.Connect("TallyVote", votes)
+
+	ports := []string{}
+	for _, p := range t1.Ports() {
+		ports = append(ports, p.Name+":"+p.Kind.String())
+	}
+	if strings.Join(ports, ",") != "TallyDone:output,TallyNeed:external,TallyVote:input" {
+		t.Errorf("expected ports, got: %v", ports)
+	}
+	if t1.LMax("TallyNeed") != d.Relations["t1/TallyNeed"] || t1.Prefix() != "t1/" {
+		t.Errorf("expected namespaced relations")
+	}
+	if t1.Relation("tallyTotal") == nil {
+		t.Errorf("expected access to non-port relations")
+	}
+	if err := d.Validate(); err != nil {
+		t.Errorf("expected valid wiring, got: %v", err)
+	}
+
+	d.AddNext(t1.LMax("TallyNeed"), 2)
+	d.AddNext(t2.LMax("TallyNeed"), 3)
+	d.Tick()
+	d.AddNext(votes, "a")
+	d.AddNext(votes, "b")
+	d.Tick()
+	if !done.(*LBool).Bool() || !t1.LBool("TallyDone").Bool() || t2.LBool("TallyDone").Bool() {
+		t.Errorf("expected separate tallies, got: %v, %v", t1.LBool("TallyDone").Bool(),
+			t2.LBool("TallyDone").Bool())
+	}
+
+	m := d.Instantiate(MultiTallyModule, "m")
+	d.AddNext(m.LSet("MultiTallyVote"), &MultiTallyVote{"r", "a"})
+	d.Tick()
+	if !MultiTallyHasVoteFrom(m, "r", "a") || MultiTallyHasVoteFrom(m, "r", "b") ||
+		MultiTallyVoters(m, "x") != nil {
+		t.Errorf("expected the tally's voters")
+	}
+
+	// Only the declared ports, and not those of sub-modules.
+	for _, p := range NewD("").Instantiate(RaftModule, "r").Ports() {
+		if strings.Contains(p.Name, "/") {
+			t.Errorf("expected no sub-module ports, got: %s", p.Name)
+		}
+	}
+}
+
+func TestModuleErrors(t *testing.T) {
+	d := NewD("")
+	d.CollectErrors = true
+	m := d.Instantiate(MultiTallyModule, "m")
+	if m.LSet("MultiTallyVotes") != nil || m.LMap("MultiTallyNeed") != nil ||
+		m.Relation("nope") != nil {
+		t.Errorf("expected nil for a bad port or relation")
+	}
+	m.Connect("MultiTallyVote", d.DeclareLSet("strs", ""))
+	m.Connect("MultiTallyNeed", d.DeclareLMax("need")) // Fine.
+	leaky := &Module{"Leaky", func(d *D, prefix string) *D {
+		d.DeclareLSet(prefix+"ok", "")
+		d.DeclareLSet("oops", "")
+		return d
+	}, map[string]PortKind{"ok": PortInput, "gone": PortChannel}}
+	d.Instantiate(leaky, "l")
+	err := d.Err()
+	if err == nil {
+		t.Fatalf("expected errors")
+	}
+	for _, s := range []string{"no port: MultiTallyVotes", "port: MultiTallyNeed, is a: *gdec.LMax",
+		"no relation: nope", "can't connect", "outside its namespace: oops",
+		"did not declare port: gone", "port: ok, is not marked as: input"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("expected: %s, got: %v", s, err)
+		}
+	}
+	if n := len(strings.Split(err.Error(), "\n")); n != 7 {
+		t.Errorf("expected 7 errors, got: %d, %v", n, err)
+	}
+}
+
+func TestModuleRegistry(t *testing.T) {
+	if ModuleByName("Raft") != RaftModule || ModuleByName("nope") != nil {
+		t.Errorf("expected registered modules")
+	}
+	if n := ModuleNames(); len(n) != 8 || n[0] != "KV" {
+		t.Errorf("expected sorted names, got: %v", n)
+	}
+	for _, name := range ModuleNames() {
+		d := NewD("")
+		d.CollectErrors = true
+		m := ModuleByName(name)
+		if mi := d.Instantiate(m, "x"); d.Err() != nil || len(mi.Ports()) != len(m.Ports) {
+			t.Errorf("expected %s's declared ports, got: %v", name, d.Err())
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package gdec
+
+import (
+	"context"
+	"time"
+)
+
+type RunOptions struct {
+	MinTickInterval time.Duration // Minimum time between the starts of ticks.
+	MaxBatch        int           // Max received tuples per tick, or unlimited when <= 0.
+}
+
+// Ticks the D until ctx is done, whenever there are received or
+// injected tuples, pending changes from the last tick, or periodics
+// that are due.  Returns ctx.Err().  While running, other goroutines
+// should use Inject() rather than AddNext(), and Do() to read
+// relations.  Ticks are serialized, so others may still Tick().
+func (d *D) Run(ctx context.Context, opts RunOptions) error {
+	var last time.Time
+	for {
+		select { // Consume any stale wakeup, as pending() is checked next.
+		case <-d.wake:
+		default:
+		}
+		var pending, periodic bool
+		var t time.Time
+		d.Do(func() {
+			pending = d.pending()
+			t, periodic = d.nextPeriodic()
+		})
+		if !pending {
+			var timer *time.Timer
+			var due <-chan time.Time
+			if periodic {
+				timer = time.NewTimer(time.Until(t))
+				due = timer.C
+			}
+			select {
+			case <-ctx.Done():
+			case <-d.wake:
+			case <-due:
+			}
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+		if wait := opts.MinTickInterval - time.Since(last); !last.IsZero() && wait > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(wait):
+			}
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		last = time.Now()
+		d.tick(opts.MaxBatch)
+	}
+}
+
+// Invokes f between ticks, so other goroutines may read the D's
+// relations while it's Run() or ticked elsewhere.  Not for use during
+// a tick, like from a join, watch or AfterTick() func.
+func (d *D) Do(f func()) {
+	d.tickM.Lock()
+	defer d.tickM.Unlock()
+	f()
+}
+
+// Like AddNext(), but safe to call from other goroutines, such as
+// while the D is Run().  The tuple is added at the start of a tick.
+func (d *D) Inject(r Relation, v interface{}) {
+	d.inboxM.Lock()
+	d.inbox = append(d.inbox, inboxTuple{r: r, tuple: v})
+	d.inboxM.Unlock()
+	d.wakeup()
+}
+
+func (d *D) wakeup() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *D) pending() bool {
+	if len(d.next) > 0 {
+		return true
+	}
+	if t, ok := d.nextPeriodic(); ok && !t.After(time.Now()) {
+		return true
+	}
+	d.inboxM.Lock()
+	n := len(d.inbox)
+	d.inboxM.Unlock()
+	return n > 0
+}
+
+// Returns when the earliest periodic is due.
+func (d *D) nextPeriodic() (time.Time, bool) {
+	var next time.Time
+	for _, p := range d.periodics {
+		if t := p.last.Add(p.interval); next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	return next, len(d.periodics) > 0
+}
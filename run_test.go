@@ -0,0 +1,69 @@
+package gdec
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	d := ShortestPathInit(NewD(""), "")
+	link := d.Relations["ShortestPathLink"]
+	paths, _ := d.WatchChan(d.Relations["ShortestPath"], 10)
+	d.Inject(link, &ShortestPathLink{"a", "b", 1})
+	d.Inject(link, &ShortestPathLink{"b", "c", 1})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	start := time.Now()
+	go func() {
+		done <- d.Run(ctx, RunOptions{MinTickInterval: 5 * time.Millisecond, MaxBatch: 1})
+	}()
+	n := 0
+	for n < 3 {
+		select {
+		case added := <-paths:
+			n += len(added)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected paths, got: %d", n)
+		}
+	}
+	if time.Since(start) < 5*time.Millisecond {
+		t.Errorf("expected ticks to be spaced by the min interval")
+	}
+	go d.Inject(link, &ShortestPathLink{"c", "d", 1}) // From another goroutine.
+	for n < 6 {
+		select {
+		case added := <-paths:
+			n += len(added)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected paths, got: %d", n)
+		}
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("expected canceled, got: %v", err)
+	}
+	if d.ticks != 3 {
+		t.Errorf("expected a tick per batch of one, got: %d", d.ticks)
+	}
+}
+
+func TestRunIdle(t *testing.T) {
+	idle := ShortestPathInit(NewD(""), "")
+	p := NewD("")
+	p.DeclarePeriodic("p", 5*time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan error)
+	go func() { done <- idle.Run(ctx, RunOptions{}) }()
+	go func() { done <- p.Run(ctx, RunOptions{}) }()
+	<-done
+	<-done
+	if idle.ticks != 0 {
+		t.Errorf("expected no ticks without inputs, got: %d", idle.ticks)
+	}
+	if p.ticks < 3 || p.ticks > 11 {
+		t.Errorf("expected ticks driven by the periodic, got: %d", p.ticks)
+	}
+}
@@ -0,0 +1,643 @@
+package gdec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// Holds the entries of an LSet or LMap, where LSet keys are the JSON
+// of tuples, and LMap values are Lattice's.  Get() of a value that's
+// then changed must be followed by a Put() of it, as storage may hold
+// copies, like DiskStorage.
+type Storage interface {
+	Get(key string) (interface{}, bool)
+	Put(key string, v interface{})
+	Delete(key string) bool
+	Len() int
+	// Invokes f on each entry until f returns false.  Entries may be
+	// put or deleted by f.
+	Scan(f func(key string, v interface{}) bool)
+	Clear()
+}
+
+// The default Storage, a Go map.
+type MemStorage struct {
+	m map[string]interface{}
+}
+
+func NewMemStorage() *MemStorage {
+	return &MemStorage{m: map[string]interface{}{}}
+}
+
+func (s *MemStorage) Get(key string) (interface{}, bool) {
+	v, ok := s.m[key]
+	return v, ok
+}
+
+func (s *MemStorage) Put(key string, v interface{}) { s.m[key] = v }
+
+func (s *MemStorage) Delete(key string) bool {
+	_, ok := s.m[key]
+	delete(s.m, key)
+	return ok
+}
+
+func (s *MemStorage) Len() int { return len(s.m) }
+
+func (s *MemStorage) Scan(f func(key string, v interface{}) bool) {
+	for k, v := range s.m {
+		if !f(k, v) {
+			return
+		}
+	}
+}
+
+func (s *MemStorage) Clear() { s.m = map[string]interface{}{} }
+
+// ------------------------------------------------------------------------
+
+// Embedded on-disk Storage, so relations can be larger than memory.
+// Changes are appended to a log file, while an in-memory table maps
+// the keys that the log changed to their records.  Once the log grows
+// past diskCompactMin, it's merged with a sorted segment file, at
+// path.seg, into a new segment, and emptied.  Only a sparse index of
+// every diskSparseEvery'th key of the segment is kept in memory, so a
+// Get() of a key that isn't in the log reads a block of the segment,
+// and Scan() streams entries in key order.  Values are encoded like by
+// BinaryCodec, so Lattice's within them must have registered types.
+//
+// The log is reopened with its contents, but isn't fsync'ed, so see
+// the WAL for durability, while a new segment is fsync'ed before the
+// log is emptied.  After an I/O error, see Err(), changes are dropped,
+// and the D reports the error for the change that hit it, or the next
+// one, see D.OnError.
+type DiskStorage struct {
+	d    *D
+	t    reflect.Type // Of values.
+	path string
+
+	m      sync.Mutex // Scan() runs concurrently with joins.
+	err    error      // The first I/O error.
+	taken  bool       // Whether err was reported, see takeErr().
+	f      *os.File   // The log.
+	size   int64      // Of the log.
+	mem    map[string]diskLocation
+	seg    *os.File // Or nil.
+	segLen int64
+	sparse []diskSparseKey
+	gen    int // Bumped as the segment is replaced, for Scan().
+	count  int // Of live entries.
+}
+
+type diskLocation struct {
+	off int64 // Of the record.
+	n   int64 // Length of the record.
+	del bool
+}
+
+type diskSparseKey struct {
+	key string
+	off int64 // Of the key's record in the segment.
+}
+
+type diskRecord struct {
+	raw []byte // The whole record.
+	op  byte
+	key string
+	val []byte // Within raw.
+}
+
+const (
+	diskOpPut    = byte(1)
+	diskOpDelete = byte(2)
+
+	diskCompactMin  = 1024 * 1024
+	diskSparseEvery = 64
+)
+
+// Backs an empty LSet or LMap with a DiskStorage at path, which
+// restores any entries that the path already has.
+func (d *D) DeclareDiskStorage(r Relation, path string) (*DiskStorage, error) {
+	var t reflect.Type
+	switch x := r.(type) {
+	case *LMap:
+		t = reflect.TypeOf((*Lattice)(nil)).Elem()
+	case *LSet:
+		t = x.t
+	default:
+		return nil, fmt.Errorf("DeclareDiskStorage of an unsupported relation: %#v", r)
+	}
+	s, err := OpenDiskStorage(d, path, t)
+	if err != nil {
+		return nil, err
+	}
+	r.(interface{ DeclareStorage(Storage) }).DeclareStorage(s)
+	return s, nil
+}
+
+// Opens a DiskStorage for values of type t, where struct values are
+// held as pointers, like tuples in relations.
+func OpenDiskStorage(d *D, path string, t reflect.Type) (*DiskStorage, error) {
+	os.Remove(path + ".seg.tmp") // From an interrupted compaction.
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := &DiskStorage{d: d, t: t, path: path, f: f, mem: map[string]diskLocation{}}
+	if err = s.loadSegment(); err == nil {
+		err = s.load()
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Builds the sparse index of the segment, if any.
+func (s *DiskStorage) loadSegment() error {
+	f, err := os.Open(s.path + ".seg")
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.seg = f
+	r := bufio.NewReader(f)
+	for {
+		rec, err := readDiskRecord(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("DiskStorage: %s.seg, err: %v", s.path, err)
+		}
+		if s.count%diskSparseEvery == 0 {
+			s.sparse = append(s.sparse, diskSparseKey{rec.key, s.segLen})
+		}
+		s.segLen += int64(len(rec.raw))
+		s.count++
+	}
+}
+
+// Replays the log, truncating any torn record.
+func (s *DiskStorage) load() error {
+	r := bufio.NewReader(s.f)
+	for {
+		rec, err := readDiskRecord(r)
+		if err != nil {
+			break
+		}
+		existed, err := s.has(rec.key)
+		if err != nil {
+			return err
+		}
+		s.apply(rec.key, int64(len(rec.raw)), rec.op != diskOpPut, existed)
+	}
+	if err := s.f.Truncate(s.size); err != nil {
+		return err
+	}
+	_, err := s.f.Seek(s.size, io.SeekStart)
+	return err
+}
+
+// A record is a big-endian uint32 length of the rest, a uint32 CRC-32
+// of the rest, an op byte, a uvarint length prefixed key, and the
+// value's encoding, when a put.  Returns io.EOF only at a record
+// boundary.
+func readDiskRecord(r io.Reader) (*diskRecord, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[0:4])
+	if n < 2 || n > walMaxRecord {
+		return nil, fmt.Errorf("DiskStorage: bad record length: %d", n)
+	}
+	raw := make([]byte, len(hdr)+int(n))
+	copy(raw, hdr[:])
+	b := raw[len(hdr):]
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if crc32.ChecksumIEEE(b) != binary.BigEndian.Uint32(hdr[4:8]) {
+		return nil, fmt.Errorf("DiskStorage: bad record checksum")
+	}
+	nk, k := binary.Uvarint(b[1:])
+	if k <= 0 || uint64(len(b)-1-k) < nk {
+		return nil, fmt.Errorf("DiskStorage: bad record key")
+	}
+	return &diskRecord{raw: raw, op: b[0],
+		key: string(b[1+k : 1+k+int(nk)]), val: b[1+k+int(nk):]}, nil
+}
+
+func (s *DiskStorage) encodeRecord(op byte, key string, v interface{}) ([]byte, error) {
+	var n [binary.MaxVarintLen64]byte
+	b := append([]byte{0, 0, 0, 0, 0, 0, 0, 0, op}, n[:binary.PutUvarint(n[:], uint64(len(key)))]...)
+	b = append(b, key...)
+	if op == diskOpPut {
+		rv := reflect.ValueOf(v)
+		if s.t.Kind() == reflect.Interface { // Tagged with the value's type.
+			x := reflect.New(s.t).Elem()
+			x.Set(rv)
+			rv = x
+		}
+		w, err := toWire(rv, false)
+		if err == nil {
+			b, err = binaryAppend(b, w)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("DiskStorage: %s, can't encode: %#v, err: %v", s.path, v, err)
+		}
+	}
+	binary.BigEndian.PutUint32(b[0:4], uint32(len(b)-8))
+	binary.BigEndian.PutUint32(b[4:8], crc32.ChecksumIEEE(b[8:]))
+	return b, nil
+}
+
+func (s *DiskStorage) decode(rec *diskRecord) (interface{}, error) {
+	w, rest, err := binaryRead(rec.val)
+	if err == nil && len(rest) > 0 {
+		err = fmt.Errorf("%d trailing bytes", len(rest))
+	}
+	var tuples []interface{}
+	if err == nil {
+		tuples, err = tuplesFromWire(s.d, s.t, []interface{}{w})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("DiskStorage: %s, read of key: %s, err: %v", s.path, rec.key, err)
+	}
+	return tuples[0], nil
+}
+
+// Returns the first I/O or encoding error, or nil.
+func (s *DiskStorage) Err() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.err
+}
+
+// Returns the first error, if it's not been returned before, so the D
+// reports it.
+func (s *DiskStorage) takeErr() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.taken {
+		return nil
+	}
+	s.taken = s.err != nil
+	return s.err
+}
+
+// Invoked with s.m held.
+func (s *DiskStorage) fail(err error) {
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+func (s *DiskStorage) Get(key string) (interface{}, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	rec, err := s.find(key)
+	if err == nil && rec != nil {
+		var v interface{}
+		if v, err = s.decode(rec); err == nil {
+			return v, true
+		}
+	}
+	if err != nil {
+		s.fail(err)
+	}
+	return nil, false
+}
+
+// Returns the current put record of a key, or nil.  Invoked with s.m
+// held, as compaction replaces the files.
+func (s *DiskStorage) find(key string) (*diskRecord, error) {
+	if loc, ok := s.mem[key]; ok {
+		if loc.del {
+			return nil, nil
+		}
+		rec, err := readDiskRecord(io.NewSectionReader(s.f, loc.off, loc.n))
+		if err == nil && rec.key != key {
+			err = fmt.Errorf("DiskStorage: %s, mismatched key: %s, want: %s", s.path, rec.key, key)
+		}
+		return rec, err
+	}
+	i := sort.Search(len(s.sparse), func(i int) bool { return s.sparse[i].key > key }) - 1
+	if i < 0 {
+		return nil, nil
+	}
+	end := s.segLen
+	if i+1 < len(s.sparse) {
+		end = s.sparse[i+1].off
+	}
+	r := bufio.NewReader(io.NewSectionReader(s.seg, s.sparse[i].off, end-s.sparse[i].off))
+	for {
+		rec, err := readDiskRecord(r)
+		if err == io.EOF || (err == nil && rec.key > key) {
+			return nil, nil
+		}
+		if err != nil || rec.key == key {
+			return rec, err
+		}
+	}
+}
+
+// Invoked with s.m held.
+func (s *DiskStorage) has(key string) (bool, error) {
+	if loc, ok := s.mem[key]; ok {
+		return !loc.del, nil
+	}
+	rec, err := s.find(key)
+	return rec != nil, err
+}
+
+func (s *DiskStorage) Put(key string, v interface{}) {
+	b, err := s.encodeRecord(diskOpPut, key, v)
+	s.m.Lock()
+	defer s.m.Unlock()
+	if err != nil {
+		s.fail(err)
+		return
+	}
+	existed, err := s.has(key)
+	if err != nil {
+		s.fail(err)
+		return
+	}
+	s.write(key, b, existed)
+}
+
+func (s *DiskStorage) Delete(key string) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	existed, err := s.has(key)
+	if err != nil {
+		s.fail(err)
+		return false
+	}
+	if existed {
+		b, _ := s.encodeRecord(diskOpDelete, key, nil)
+		s.write(key, b, true)
+	}
+	return existed
+}
+
+// Appends a record to the log.  Invoked with s.m held.
+func (s *DiskStorage) write(key string, b []byte, existed bool) {
+	if s.err != nil {
+		return
+	}
+	if _, err := s.f.Write(b); err != nil {
+		s.fail(fmt.Errorf("DiskStorage: %s, write err: %v", s.path, err))
+		return
+	}
+	s.apply(key, int64(len(b)), b[8] != diskOpPut, existed)
+	if s.size > diskCompactMin {
+		if err := s.compact(); err != nil {
+			s.fail(fmt.Errorf("DiskStorage: %s, compact err: %v", s.path, err))
+		}
+	}
+}
+
+// Tracks a record of n bytes at the end of the log.  Invoked with s.m
+// held.
+func (s *DiskStorage) apply(key string, n int64, del, existed bool) {
+	if !existed && !del {
+		s.count++
+	} else if existed && del {
+		s.count--
+	}
+	s.mem[key] = diskLocation{s.size, n, del}
+	s.size += n
+}
+
+// Returns the keys of the log's records, sorted.  Invoked with s.m held.
+func (s *DiskStorage) memKeys() []string {
+	keys := make([]string, 0, len(s.mem))
+	for k := range s.mem {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Merges the log into a new segment, and empties the log.  The new
+// segment is synced before it replaces the old one, and the rename is
+// synced before the log is emptied.  Invoked with s.m held.
+func (s *DiskStorage) compact() (err error) {
+	tmp := s.path + ".seg.tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+	w := bufio.NewWriter(f)
+	var sparse []diskSparseKey
+	off, count := int64(0), 0
+	emit := func(rec *diskRecord) error {
+		if count%diskSparseEvery == 0 {
+			sparse = append(sparse, diskSparseKey{rec.key, off})
+		}
+		off += int64(len(rec.raw))
+		count++
+		_, err := w.Write(rec.raw)
+		return err
+	}
+
+	it := s.seek("", false)
+	keys := s.memKeys()
+	for err == nil && (len(keys) > 0 || it.rec != nil) {
+		if it.rec != nil && (len(keys) <= 0 || it.rec.key < keys[0]) {
+			err = emit(it.rec)
+			it.next()
+			continue
+		}
+		if it.rec != nil && it.rec.key == keys[0] { // Superseded.
+			it.next()
+		}
+		var rec *diskRecord
+		if rec, err = s.find(keys[0]); err == nil && rec != nil {
+			err = emit(rec)
+		}
+		keys = keys[1:]
+	}
+	if err == nil {
+		err = it.err
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.path+".seg")
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(s.path))
+	}
+	if err != nil {
+		return err
+	}
+	if s.seg != nil {
+		s.seg.Close()
+	}
+	s.seg, s.segLen, s.sparse, s.count = f, off, sparse, count
+	s.gen++
+	s.mem, s.size = map[string]diskLocation{}, 0
+	terr := s.f.Truncate(0) // Else replayed over the segment when reopened.
+	if terr == nil {
+		_, terr = s.f.Seek(0, io.SeekStart)
+	}
+	return terr
+}
+
+// Iterates the segment's records in key order.
+type diskSegIter struct {
+	gen int
+	r   *bufio.Reader
+	rec *diskRecord // Current, or nil when done.
+	err error
+}
+
+func (it *diskSegIter) next() {
+	it.rec = nil
+	if it.r == nil || it.err != nil {
+		return
+	}
+	rec, err := readDiskRecord(it.r)
+	if err == nil {
+		it.rec = rec
+	} else if err != io.EOF {
+		it.err = err
+	}
+}
+
+// Returns an iterator at the segment's first key after a key, or at
+// its first key.  Invoked with s.m held.
+func (s *DiskStorage) seek(after string, started bool) *diskSegIter {
+	it := &diskSegIter{gen: s.gen}
+	if s.seg == nil {
+		return it
+	}
+	off := int64(0)
+	if started {
+		i := sort.Search(len(s.sparse), func(i int) bool { return s.sparse[i].key > after }) - 1
+		if i >= 0 {
+			off = s.sparse[i].off
+		}
+	}
+	it.r = bufio.NewReader(io.NewSectionReader(s.seg, off, s.segLen-off))
+	for it.next(); started && it.rec != nil && it.rec.key <= after; {
+		it.next()
+	}
+	return it
+}
+
+func (s *DiskStorage) Len() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.count
+}
+
+// Streams entries in key order, skipping those deleted during the
+// scan, while those put during the scan may be skipped.
+func (s *DiskStorage) Scan(f func(key string, v interface{}) bool) {
+	var it *diskSegIter
+	var keys []string // Of the log's records, after the last key.
+	last, started := "", false
+	for {
+		s.m.Lock()
+		if it == nil || it.gen != s.gen {
+			it = s.seek(last, started)
+			keys = s.memKeys()
+			for len(keys) > 0 && started && keys[0] <= last {
+				keys = keys[1:]
+			}
+		}
+		var rec *diskRecord
+		var err error
+		if it.rec != nil && (len(keys) <= 0 || it.rec.key < keys[0]) {
+			if _, inLog := s.mem[it.rec.key]; !inLog {
+				rec = it.rec
+			} else { // Changed during the scan.
+				rec, err = s.find(it.rec.key)
+			}
+			last = it.rec.key
+			it.next()
+		} else if len(keys) > 0 {
+			if it.rec != nil && it.rec.key == keys[0] {
+				it.next()
+			}
+			last = keys[0]
+			rec, err = s.find(last)
+			keys = keys[1:]
+		} else {
+			if it.err != nil {
+				s.fail(it.err)
+			}
+			s.m.Unlock()
+			return
+		}
+		started = true
+		var v interface{}
+		if err == nil && rec != nil {
+			v, err = s.decode(rec)
+		}
+		if err != nil {
+			s.fail(err)
+			s.m.Unlock()
+			return
+		}
+		s.m.Unlock()
+		if rec != nil && !f(last, v) {
+			return
+		}
+	}
+}
+
+func (s *DiskStorage) Clear() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	err := s.f.Truncate(0)
+	if err == nil {
+		_, err = s.f.Seek(0, io.SeekStart)
+	}
+	if s.seg != nil {
+		s.seg.Close()
+		if rerr := os.Remove(s.path + ".seg"); err == nil {
+			err = rerr
+		}
+	}
+	if err != nil {
+		s.fail(fmt.Errorf("DiskStorage: %s, clear err: %v", s.path, err))
+	}
+	s.mem, s.size, s.seg, s.segLen, s.sparse, s.count = map[string]diskLocation{}, 0, nil, 0, nil, 0
+	s.gen++
+}
+
+func (s *DiskStorage) Close() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.seg != nil {
+		s.seg.Close()
+	}
+	return s.f.Close()
+}
@@ -0,0 +1,197 @@
+package gdec
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func storageTestDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "gdec-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestDiskStorageLSet(t *testing.T) {
+	dir := storageTestDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "links")
+
+	d := ShortestPathInit(NewD(""), "")
+	links := d.Relations["ShortestPathLink"].(*LSet)
+	s, err := d.DeclareDiskStorage(links, path)
+	if err != nil {
+		t.Fatalf("expected open, got: %v", err)
+	}
+	d.AddNext(links, &ShortestPathLink{"b", "c", 2})
+	d.AddNext(links, &ShortestPathLink{"a", "b", 1})
+	d.Tick()
+	if !links.Contains(&ShortestPathLink{"a", "b", 1}) || links.Size() != 2 ||
+		d.Relations["ShortestPath"].(*LSet).Size() != 3 {
+		t.Errorf("expected links and paths, got: %v", links.Size())
+	}
+	if links.DirectAdd(&ShortestPathLink{"a", "b", 1}) {
+		t.Errorf("expected no change for a dup")
+	}
+	keys := []string{}
+	s.Scan(func(k string, v interface{}) bool {
+		if _, ok := v.(*ShortestPathLink); !ok {
+			t.Errorf("expected pointer tuples, got: %#v", v)
+		}
+		keys = append(keys, k)
+		return true
+	})
+	if !sort.StringsAreSorted(keys) || len(keys) != 2 {
+		t.Errorf("expected sorted scan, got: %v", keys)
+	}
+	if !links.remove(&ShortestPathLink{"b", "c", 2}) {
+		t.Errorf("expected remove")
+	}
+	s.Close()
+
+	d = ShortestPathInit(NewD(""), "")
+	links = d.Relations["ShortestPathLink"].(*LSet)
+	if s, err = d.DeclareDiskStorage(links, path); err != nil {
+		t.Fatalf("expected reopen, got: %v", err)
+	}
+	defer s.Close()
+	if links.Size() != 1 || !links.Contains(&ShortestPathLink{"a", "b", 1}) {
+		t.Errorf("expected reopened links, got: %v", links.Size())
+	}
+}
+
+func TestDiskStorageCompact(t *testing.T) {
+	dir := storageTestDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "m")
+
+	d := NewD("")
+	m := d.DeclareLMap("m")
+	s, err := d.DeclareDiskStorage(m, path)
+	if err != nil {
+		t.Fatalf("expected open, got: %v", err)
+	}
+	defer s.Close()
+	big := strings.Repeat("x", 1000)
+	for i := 0; i < 2000; i++ { // Each a new version of one of 10 keys.
+		k := fmt.Sprintf("k%d", i%10)
+		v := d.NewLMaxString()
+		v.DirectAdd(fmt.Sprintf("%s%05d", big, i))
+		if !m.DirectAdd(&LMapEntry{k, v}) {
+			t.Fatalf("expected change")
+		}
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Size() > diskCompactMin+4096 {
+		t.Errorf("expected compaction, got: %v, %v", fi.Size(), err)
+	}
+	if x, _ := m.At("k3").(*LMaxString); m.Size() != 10 || x == nil ||
+		x.String() != big+"01993" {
+		t.Errorf("expected merged values, got: %v, %#v", m.Size(), x)
+	}
+	m.DeclareScratch()
+	m.startTick()
+	if fi, err := os.Stat(path); err != nil || fi.Size() != 0 || m.Size() != 0 {
+		t.Errorf("expected cleared storage, got: %v, %v", fi, err)
+	}
+}
+
+func TestKVDiskStorage(t *testing.T) {
+	dir := storageTestDir(t)
+	defer os.RemoveAll(dir)
+
+	d := KVInit(NewD("r"), "")
+	s, err := d.DeclareDiskStorage(d.Relations["kvMap"], filepath.Join(dir, "kv"))
+	if err != nil {
+		t.Fatalf("expected open, got: %v", err)
+	}
+	defer s.Close()
+	for i := 0; i < 3; i++ {
+		d.AddNext(d.Relations["KVPut"], &KVPut{ReqId: int64(i), Addr: "r",
+			ClientAddr: "c", Key: "k", Val: NewLSetOne(d, fmt.Sprintf("v%d", i))})
+		d.Tick()
+	}
+	d.AddNext(d.Relations["KVGet"], &KVGet{ReqId: 9, Addr: "r", ClientAddr: "c", Key: "k"})
+	d.Tick()
+	d.Tick()
+	var v Lattice
+	for x := range d.Relations["KVGetResponse"].Scan() {
+		v = x.(*KVGetResponse).Val
+	}
+	if x, _ := v.(*LSet); x == nil || x.Size() != 3 || s.Len() != 1 {
+		t.Errorf("expected merged val from disk, got: %#v", v)
+	}
+}
+
+func TestDiskStorageSegment(t *testing.T) {
+	dir := storageTestDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "s")
+
+	d := NewD("")
+	s, err := OpenDiskStorage(d, path, reflect.TypeOf(""))
+	if err != nil {
+		t.Fatalf("expected open, got: %v", err)
+	}
+	val := strings.Repeat("v", 200)
+	n := 10000
+	for i := 0; i < n; i++ {
+		s.Put(fmt.Sprintf("k%05d", i), val)
+	}
+	for i := 0; i < n; i += 2 {
+		if !s.Delete(fmt.Sprintf("k%05d", i)) {
+			t.Fatalf("expected delete")
+		}
+	}
+	if s.Delete("k00000") || s.Len() != n/2 || s.seg == nil ||
+		len(s.sparse) > n/diskSparseEvery+1 || s.size > diskCompactMin {
+		t.Errorf("expected a segment with a sparse index, got: %d, %d, %d",
+			s.Len(), len(s.sparse), s.size)
+	}
+	if v, ok := s.Get("k00001"); !ok || v != val {
+		t.Errorf("expected a get from the segment, got: %v, %v", v, ok)
+	}
+	if _, ok := s.Get("k00002"); ok {
+		t.Errorf("expected no deleted entry")
+	}
+
+	// Changes during a scan that compacts don't disturb the scan.
+	keys := []string{}
+	s.Scan(func(k string, v interface{}) bool {
+		keys = append(keys, k)
+		s.Put(k, strings.Repeat("w", 300))
+		s.Delete(fmt.Sprintf("k%05d", n-1))
+		return true
+	})
+	if len(keys) != n/2-1 || !sort.StringsAreSorted(keys) || s.Len() != n/2-1 {
+		t.Errorf("expected a sorted scan, got: %d, %d", len(keys), s.Len())
+	}
+	if err := s.Err(); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+	s.Close()
+
+	if s, err = OpenDiskStorage(d, path, reflect.TypeOf("")); err != nil {
+		t.Fatalf("expected reopen, got: %v", err)
+	}
+	defer s.Close()
+	if v, ok := s.Get("k00001"); s.Len() != n/2-1 || !ok || v != strings.Repeat("w", 300) {
+		t.Errorf("expected reopened entries, got: %d, %v", s.Len(), v)
+	}
+
+	// I/O errors are kept for Err(), rather than panicking.
+	s.f.Close()
+	s.Put("k", val)
+	if s.Err() == nil {
+		t.Errorf("expected an error")
+	}
+	if _, ok := s.Get("k"); ok || s.Len() != n/2-1 {
+		t.Errorf("expected the put dropped")
+	}
+}
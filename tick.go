@@ -3,6 +3,7 @@ package gdec
 import (
 	"fmt"
 	"reflect"
+	"time"
 )
 
 type relationChange struct {
@@ -12,37 +13,80 @@ type relationChange struct {
 }
 
 func (d *D) Tick() {
+	d.tick(0)
+}
+
+// Incorporates at most maxBatch received tuples, or all when <= 0.
+func (d *D) tick(maxBatch int) {
+	d.tickM.Lock()
+	defer d.tickM.Unlock()
+
+	d.seenErrs = nil
+	for _, jd := range d.Joins {
+		jd.fired = 0
+	}
+
 	for _, r := range d.Relations {
 		r.startTick()
 	}
 
-	// TODO: Incorporate periodics.
-	// TODO: Incorporate network.
+	now := time.Now()
+	d.now = now
+	for _, p := range d.periodics {
+		if p.last.IsZero() || now.Sub(p.last) >= p.interval {
+			p.r.DirectAdd(true)
+			p.last = now
+		}
+	}
+
+	d.incorporateNetwork(maxBatch)
 
-	applyRelationChanges(d.next) // Apply pending data from last tick.
+	d.applyRelationChanges(d.next) // Apply pending data from last tick.
 	d.next = d.next[0:0]
 
 	d.tickMain()
 	d.ticks++
 
-	// TODO: Emit to network.
+	if d.wal == nil || d.wal.sync() { // Else the tick's changes aren't durable.
+		d.emitNetwork()
+	}
+
+	d.notifyWatches()
+
+	for _, f := range d.afterTicks {
+		f()
+	}
+	if len(d.next) > 0 {
+		d.wakeup() // For Run(), when ticked elsewhere.
+	}
+}
+
+// Registers f to be invoked at the end of each tick, in the ticking
+// goroutine, such as to publish the D's state.  Invoke before ticking.
+func (d *D) AfterTick(f func()) {
+	d.afterTicks = append(d.afterTicks, f)
 }
 
 func (d *D) tickMain() {
 	for { // TODO: Hugely naive, inefficient, simple implementation.
 		for _, jd := range d.Joins {
-			d.next, d.immediate = jd.executeJoinInto(d.next, d.immediate)
+			jd.executeJoinInto()
 		}
-		changed := applyRelationChanges(d.immediate)
+		changed := d.applyRelationChanges(d.immediate)
 		d.immediate = d.immediate[0:0]
+		if d.errRelation != nil {
+			changed = d.flushErrors() || changed
+		}
 		if !changed {
 			return
 		}
 	}
 }
 
-func (jd *joinDeclaration) executeJoinInto(next, immediate []relationChange) (
-	nextOut, immediateOut []relationChange) {
+// Select funcs may call d.Add() and friends as side-effects, so
+// results are appended straight onto the D's next/immediate lists.
+func (jd *joinDeclaration) executeJoinInto() {
+	d := jd.d
 	numSources := len(jd.sources)
 
 	join := make([]interface{}, numSources)
@@ -50,12 +94,29 @@ func (jd *joinDeclaration) executeJoinInto(next, immediate []relationChange) (
 
 	selectWhere := func() *relationChange {
 		if jd.selectWhereFunc != nil {
+			ft := reflect.ValueOf(jd.selectWhereFunc)
 			for i, x := range join {
-				values[i] = reflect.ValueOf(x)
+				values[i] = tupleValue(x, ft.Type().In(i))
 			}
-			ft := reflect.ValueOf(jd.selectWhereFunc)
-			out := ft.Call(values)
-			if out == nil || len(out) != 1 {
+			var out []reflect.Value
+			ni, nn := len(d.immediate), len(d.next)
+			if err := d.catch(func() {
+				out = ft.Call(values)
+				if len(jd.writes) > 0 { // Opted in via Writes().
+					jd.checkWrites(d.immediate[ni:], d.next[nn:])
+				}
+			}); err != nil {
+				d.immediate, d.next = d.immediate[:ni], d.next[:nn] // Drop its writes.
+				d.tupleError(jd.errorName(), join, err)
+				return nil
+			}
+			if len(out) == 0 { // Side-effect only select func.
+				if len(d.immediate)+len(d.next) > ni+nn {
+					jd.fired++
+				}
+				return nil
+			}
+			if len(out) != 1 {
 				panic(fmt.Sprintf("unexpected # out results: %#v", out))
 			}
 			if out[0].IsValid() && !isNil(out[0]) {
@@ -64,7 +125,7 @@ func (jd *joinDeclaration) executeJoinInto(next, immediate []relationChange) (
 					if jd.selectWhereFlat {
 						return &relationChange{jd.into, out0, false}
 					} else {
-						return &relationChange{jd.into, out0, true}
+						return &relationChange{jd.into, tupleOf(out[0], jd.into), true}
 					}
 				}
 			}
@@ -91,31 +152,169 @@ func (jd *joinDeclaration) executeJoinInto(next, immediate []relationChange) (
 		} else {
 			res := selectWhere()
 			if res != nil {
+				jd.fired++
 				if jd.async {
-					next = append(next, *res)
+					d.next = append(d.next, *res)
 				} else {
-					immediate = append(immediate, *res)
+					d.immediate = append(d.immediate, *res)
 				}
 			}
 		}
 	}
-	joiner(0)
+	if !jd.invalid {
+		joiner(0)
+	}
+}
+
+// Panics on a side-effect of a select func that isn't into a relation
+// declared by Writes(), or doesn't fit its relation.
+func (jd *joinDeclaration) checkWrites(changes ...[]relationChange) {
+	for _, cs := range changes {
+		for _, c := range cs {
+			if !jd.writesTo(c.into) {
+				panic(fmt.Sprintf("write to undeclared relation: %s",
+					jd.d.relationName(c.into)))
+			}
+			if err := checkChange(c); err != nil {
+				panic(err.Error())
+			}
+		}
+	}
+}
+
+func (jd *joinDeclaration) writesTo(r Relation) bool {
+	if r == jd.into {
+		return true
+	}
+	for _, w := range jd.writes {
+		if w == r {
+			return true
+		}
+	}
+	return false
+}
 
-	return next, immediate
+func (jd *joinDeclaration) errorName() string {
+	if jd.name != "" {
+		return jd.name
+	}
+	if jd.into != nil {
+		return "join into: " + jd.d.relationName(jd.into)
+	}
+	return "join"
 }
 
-func applyRelationChanges(changes []relationChange) bool {
+func (d *D) applyRelationChanges(changes []relationChange) bool {
 	changed := false
 	for _, c := range changes {
-		if c.add {
-			changed = c.into.DirectAdd(c.arg) || changed
-		} else {
-			changed = c.into.DirectMerge(c.arg.(Relation)) || changed
+		var ok bool
+		err := d.catch(func() {
+			if w := d.watch(c.into); w != nil {
+				ok = w.apply(d, c)
+			} else {
+				ok = d.applyChange(c)
+			}
+			if ok && d.wal != nil {
+				d.wal.log(c)
+			}
+		})
+		if err != nil {
+			d.tupleError(d.relationName(c.into), c.arg, err)
 		}
+		changed = ok || changed
+	}
+	return changed
+}
+
+// Panics on a change that doesn't fit its relation, before storing
+// it, or when the relation's storage fails.
+func (d *D) applyChange(c relationChange) bool {
+	if err := checkChange(c); err != nil {
+		panic(err.Error())
+	}
+	var changed bool
+	if c.add {
+		changed = c.into.DirectAdd(c.arg)
+	} else {
+		changed = c.into.DirectMerge(c.arg.(Relation))
+	}
+	if err := storageErr(c.into); err != nil {
+		panic(err.Error())
 	}
 	return changed
 }
 
+func checkChange(c relationChange) error {
+	if !c.add {
+		if reflect.TypeOf(c.arg) != reflect.TypeOf(c.into) {
+			return fmt.Errorf("merge of a %T into a %T", c.arg, c.into)
+		}
+		return nil
+	}
+	return checkTuple(c.into, c.arg)
+}
+
+// Checks a tuple against a relation's TupleType(), where the tuples
+// of an LSet of structs may be pointers, and LMap entries need values.
+func checkTuple(r Relation, x interface{}) error {
+	if x == nil || isNil(reflect.ValueOf(x)) {
+		return fmt.Errorf("nil tuple")
+	}
+	if _, ok := r.(*LMap); ok {
+		e, ok := x.(*LMapEntry)
+		if !ok {
+			return fmt.Errorf("tuple of type: %T, want: *LMapEntry", x)
+		}
+		if v, ok := e.Val.(Relation); !ok || isNil(reflect.ValueOf(v)) {
+			return fmt.Errorf("LMapEntry of key: %s, without a lattice val", e.Key)
+		}
+		return nil
+	}
+	t, xt := r.TupleType(), reflect.TypeOf(x)
+	if t == nil || xt == t || (t.Kind() == reflect.Struct && xt == reflect.PtrTo(t)) ||
+		(t.Kind() == reflect.Interface && xt.Implements(t)) {
+		return nil
+	}
+	return fmt.Errorf("tuple of type: %v, want: %v", xt, t)
+}
+
+// Returns a failure of a relation's storage, once.
+func storageErr(r Relation) error {
+	var s Storage
+	switch x := r.(type) {
+	case *LSet:
+		s = x.m
+	case *LMap:
+		s = x.m
+	}
+	if ds, ok := s.(*DiskStorage); ok {
+		return ds.takeErr()
+	}
+	return nil
+}
+
+// Scalar relations like LMax scan out plain values, but select funcs
+// take pointers to tuples, so wrap when needed.
+func tupleValue(x interface{}, t reflect.Type) reflect.Value {
+	v := reflect.ValueOf(x)
+	if v.Type() != t && t.Kind() == reflect.Ptr && v.Type() == t.Elem() {
+		p := reflect.New(t.Elem())
+		p.Elem().Set(v)
+		return p
+	}
+	return v
+}
+
+// The reverse of tupleValue(), as a select func may return a pointer
+// to a scalar tuple, so that it can return nil for no tuple.
+func tupleOf(v reflect.Value, r Relation) interface{} {
+	t := r.TupleType()
+	if t != nil && t.Kind() != reflect.Struct && v.Type() == reflect.PtrTo(t) {
+		return v.Elem().Interface()
+	}
+	return v.Interface()
+}
+
 func isNil(v reflect.Value) bool {
 	switch v.Kind() {
 	case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map,
@@ -124,3 +323,31 @@ func isNil(v reflect.Value) bool {
 	}
 	return false
 }
+
+// Describes a join, and how many outputs it had during the last tick,
+// including repeats during the tick's fixpoint.
+type JoinStat struct {
+	Name    string // The join's Name(), or its "#index".
+	Sources []string
+	Into    string   // Empty for side-effect only joins.
+	Writes  []string // See joinDeclaration.Writes().
+	Fired   int
+}
+
+func (d *D) JoinStats() []JoinStat {
+	res := make([]JoinStat, 0, len(d.Joins))
+	for _, jd := range d.Joins {
+		s := JoinStat{Name: jd.validateName(), Fired: jd.fired}
+		for _, r := range jd.sources {
+			s.Sources = append(s.Sources, d.relationName(r))
+		}
+		if jd.into != nil {
+			s.Into = d.relationName(jd.into)
+		}
+		for _, r := range jd.writes {
+			s.Writes = append(s.Writes, d.relationName(r))
+		}
+		res = append(res, s)
+	}
+	return res
+}
@@ -0,0 +1,205 @@
+package gdec
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Moves channel tuples between D's.  At the end of each tick, a D
+// sends the tuples in its channels that are addressed to other D's,
+// and a receiving D incorporates them at the start of its next tick.
+type Transport interface {
+	// Sends tuples of the named channel to the D at addr.
+	Send(addr string, channel string, tuples []interface{}) error
+}
+
+// Optionally implemented by Transports, to send all of a tick's
+// tuples for an addr at once, rather than a Send() per channel.
+type BatchTransport interface {
+	Transport
+	SendBatch(addr string, batch []ChannelTuples) error
+}
+
+type ChannelTuples struct {
+	Channel string
+	Tuples  []interface{}
+}
+
+// Metrics of a Transport's outbound queue to an addr.
+type QueueStats struct {
+	Queued    int   // Batches waiting to be sent.
+	MaxQueued int   // High water mark of Queued.
+	Sent      int64 // Batches sent.
+	Dropped   int64 // Batches dropped, as the queue was full or sending failed.
+	Bytes     int64 // Bytes sent, after any compression.
+}
+
+// Buffers tuples received for a channel, to be added at the start of
+// the next tick.  Safe to call from other goroutines.  Tuples for a
+// name that isn't a channel's are dropped, and counted, so peers can't
+// write into a D's other relations.
+func (d *D) Receive(channel string, tuples []interface{}) {
+	c := d.channel(channel)
+	if c == nil {
+		atomic.AddInt64(&d.receiveDropped, int64(len(tuples)))
+		return
+	}
+	d.inboxM.Lock()
+	for _, x := range tuples {
+		if err := checkTuple(c, x); err != nil {
+			d.inboxErrs = append(d.inboxErrs,
+				&TupleError{Relation: channel, Tuple: fmt.Sprintf("%#v", x), Err: err.Error()})
+			continue
+		}
+		d.inbox = append(d.inbox, inboxTuple{channel: channel, tuple: x})
+	}
+	d.inboxM.Unlock()
+	d.wakeup()
+}
+
+// Records a channel's tuples that a transport couldn't decode, to be
+// reported at the next tick.  Safe to call from other goroutines.
+func (d *D) receiveError(channel string, err error) {
+	d.inboxM.Lock()
+	d.inboxErrs = append(d.inboxErrs, &TupleError{Relation: channel, Err: err.Error()})
+	d.inboxM.Unlock()
+}
+
+type inboxTuple struct {
+	channel string
+	r       Relation // Used instead of channel, when non-nil.
+	tuple   interface{}
+}
+
+func (d *D) inboxRelation(x inboxTuple) Relation {
+	if x.r != nil {
+		return x.r
+	}
+	if c := d.channel(x.channel); c != nil {
+		return c
+	}
+	return nil
+}
+
+// Returns the named channel, or nil when the name isn't a channel's.
+func (d *D) channel(name string) *LSet {
+	if s, ok := d.Relations[name].(*LSet); ok && s.channel {
+		return s
+	}
+	return nil
+}
+
+// Returns the number of received tuples that were dropped, as they
+// weren't for a channel.
+func (d *D) ReceiveDropped() int64 {
+	return atomic.LoadInt64(&d.receiveDropped)
+}
+
+// Incorporates at most max inbox tuples, or all when max <= 0.
+func (d *D) incorporateNetwork(max int) {
+	d.inboxM.Lock()
+	inbox, errs := d.inbox, d.inboxErrs
+	if max > 0 && len(inbox) > max {
+		inbox, d.inbox = inbox[:max], append([]inboxTuple(nil), inbox[max:]...)
+	} else {
+		d.inbox = nil
+	}
+	d.inboxErrs = nil
+	d.inboxM.Unlock()
+	for _, e := range errs {
+		d.reportError(e)
+	}
+	for _, x := range inbox {
+		if r := d.inboxRelation(x); r != nil {
+			d.next = append(d.next, relationChange{r, x.tuple, true})
+		} else {
+			atomic.AddInt64(&d.receiveDropped, 1)
+		}
+	}
+}
+
+// Channels are best-effort, so tuples that fail to send are dropped,
+// though the send errors are reported under "transport", with the
+// addr.  The tuples for each addr are coalesced into one batch.
+func (d *D) emitNetwork() {
+	if d.Transport == nil {
+		return
+	}
+	names := []string{}
+	for name, r := range d.Relations {
+		if s, ok := r.(*LSet); ok && s.channel {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	out := map[string][]ChannelTuples{}
+	for _, name := range names {
+		for x := range d.Relations[name].Scan() {
+			addr, ok := tupleAddr(x)
+			if !ok || addr == "" || addr == d.Addr {
+				continue
+			}
+			b := out[addr]
+			if len(b) <= 0 || b[len(b)-1].Channel != name {
+				b = append(b, ChannelTuples{Channel: name})
+			}
+			b[len(b)-1].Tuples = append(b[len(b)-1].Tuples, x)
+			out[addr] = b
+		}
+	}
+	bt, _ := d.Transport.(BatchTransport)
+	for addr, batch := range out {
+		if bt != nil {
+			if err := bt.SendBatch(addr, batch); err != nil {
+				d.tupleError("transport", addr, err)
+			}
+			continue
+		}
+		for _, c := range batch {
+			if err := d.Transport.Send(addr, c.Channel, c.Tuples); err != nil {
+				d.tupleError("transport", addr, err)
+			}
+		}
+	}
+}
+
+// Transport between D's in the same process.
+type LocalTransport struct {
+	m  sync.Mutex
+	ds map[string]*D
+}
+
+func NewLocalTransport() *LocalTransport {
+	return &LocalTransport{ds: map[string]*D{}}
+}
+
+// Registers a D to receive tuples for its addr, and to send via t.
+func (t *LocalTransport) Register(d *D) *D {
+	t.m.Lock()
+	t.ds[d.Addr] = d
+	t.m.Unlock()
+	d.Transport = t
+	return d
+}
+
+func (t *LocalTransport) Send(addr string, channel string, tuples []interface{}) error {
+	t.m.Lock()
+	d := t.ds[addr]
+	t.m.Unlock()
+	if d == nil {
+		return fmt.Errorf("LocalTransport: unknown addr: %s", addr)
+	}
+	d.Receive(channel, tuples)
+	return nil
+}
+
+func (t *LocalTransport) SendBatch(addr string, batch []ChannelTuples) error {
+	for _, c := range batch {
+		if err := t.Send(addr, c.Channel, c.Tuples); err != nil {
+			return err
+		}
+	}
+	return nil
+}
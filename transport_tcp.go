@@ -0,0 +1,346 @@
+package gdec
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+// Transport over TCP, which listens on a D's Addr and keeps a
+// persistent connection to each peer that it sends to.  Each batch is
+// sent from a bounded per-peer queue, so slow peers don't block
+// ticks, and batches are dropped once a peer's queue is full.
+//
+// Each batch is a frame of a big-endian uint32 length, followed by
+// the Codec's id, a flags byte, and the body, which is flate
+// compressed when flagged.  The body is a uint16 count of channels,
+// each a uint16 length prefixed channel name and uint32 length
+// prefixed encoded tuples.
+type TCPTransport struct {
+	d        *D
+	listener net.Listener
+
+	DialTimeout time.Duration
+	Codec       Codec // For sending; received frames name their codec.
+	Compress    bool
+	QueueLen    int // Max batches queued per peer.
+
+	m      sync.Mutex
+	queues map[string]*tcpQueue // Outbound, keyed by addr.
+	inbox  map[net.Conn]bool    // Inbound.
+	closed bool
+	wg     sync.WaitGroup
+}
+
+type tcpQueue struct {
+	ch    chan []byte
+	conn  net.Conn // Protected by the TCPTransport's m.
+	stats QueueStats
+}
+
+type tcpChannel struct {
+	channel string
+	raw     []byte
+}
+
+const (
+	tcpMaxFrame = 64 * 1024 * 1024
+
+	tcpFlagCompressed = byte(1)
+)
+
+// Listens on d.Addr and becomes d's Transport.  When d.Addr has port
+// 0, d.Addr is updated with the port that was picked.
+func NewTCPTransport(d *D) (*TCPTransport, error) {
+	l, err := net.Listen("tcp", d.Addr)
+	if err != nil {
+		return nil, err
+	}
+	d.Addr = l.Addr().String()
+
+	t := &TCPTransport{
+		d:           d,
+		listener:    l,
+		DialTimeout: 5 * time.Second,
+		Codec:       JSONCodec,
+		QueueLen:    64,
+		queues:      map[string]*tcpQueue{},
+		inbox:       map[net.Conn]bool{},
+	}
+	d.Transport = t
+
+	t.wg.Add(1)
+	go t.accept()
+
+	return t, nil
+}
+
+func (t *TCPTransport) Send(addr string, channel string, tuples []interface{}) error {
+	return t.SendBatch(addr, []ChannelTuples{{channel, tuples}})
+}
+
+// Queues a batch for addr, returning an error when it's dropped.
+func (t *TCPTransport) SendBatch(addr string, batch []ChannelTuples) error {
+	frame, err := encodeTCPFrame(t.Codec, t.Compress, batch)
+	if err != nil {
+		return err
+	}
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.closed {
+		return fmt.Errorf("TCPTransport: closed")
+	}
+	q := t.queues[addr]
+	if q == nil {
+		q = &tcpQueue{ch: make(chan []byte, t.QueueLen)}
+		t.queues[addr] = q
+		t.wg.Add(1)
+		go t.write(addr, q)
+	}
+	select {
+	case q.ch <- frame:
+		q.stats.Queued++
+		if q.stats.Queued > q.stats.MaxQueued {
+			q.stats.MaxQueued = q.stats.Queued
+		}
+		return nil
+	default:
+		q.stats.Dropped++
+		return fmt.Errorf("TCPTransport: queue full, addr: %s", addr)
+	}
+}
+
+// Returns the outbound queue metrics, keyed by addr.
+func (t *TCPTransport) Stats() map[string]QueueStats {
+	t.m.Lock()
+	defer t.m.Unlock()
+	res := map[string]QueueStats{}
+	for addr, q := range t.queues {
+		res[addr] = q.stats
+	}
+	return res
+}
+
+// Sends a peer's queued frames, dialing lazily, and redialing after
+// errors.  Frames that fail are dropped.
+func (t *TCPTransport) write(addr string, q *tcpQueue) {
+	defer t.wg.Done()
+	var c net.Conn
+	var w *bufio.Writer
+	for frame := range q.ch {
+		t.m.Lock()
+		q.stats.Queued--
+		t.m.Unlock()
+		var err error
+		if c == nil {
+			if c, err = net.DialTimeout("tcp", addr, t.DialTimeout); err == nil {
+				w = bufio.NewWriter(c)
+				t.m.Lock()
+				if t.closed {
+					c.Close()
+				}
+				q.conn = c
+				t.m.Unlock()
+			}
+		}
+		if err == nil {
+			if _, err = w.Write(frame); err == nil && len(q.ch) <= 0 {
+				err = w.Flush() // Else coalesced with the next frames.
+			}
+		}
+		t.m.Lock()
+		if err != nil {
+			q.stats.Dropped++
+			if c != nil {
+				c.Close()
+				c, q.conn = nil, nil
+			}
+		} else {
+			q.stats.Sent++
+			q.stats.Bytes += int64(len(frame))
+		}
+		t.m.Unlock()
+	}
+	if c != nil {
+		c.Close()
+	}
+}
+
+// Stops listening and closes all connections, dropping queued batches.
+func (t *TCPTransport) Close() error {
+	t.m.Lock()
+	t.closed = true
+	err := t.listener.Close()
+	for _, q := range t.queues {
+		close(q.ch)
+		if q.conn != nil {
+			q.conn.Close()
+		}
+	}
+	for c := range t.inbox {
+		c.Close()
+	}
+	t.m.Unlock()
+	t.wg.Wait()
+	return err
+}
+
+func (t *TCPTransport) accept() {
+	defer t.wg.Done()
+	for {
+		c, err := t.listener.Accept()
+		if err != nil {
+			return
+		}
+		t.m.Lock()
+		if t.closed {
+			t.m.Unlock()
+			c.Close()
+			return
+		}
+		t.inbox[c] = true
+		t.wg.Add(1)
+		t.m.Unlock()
+		go t.receive(c)
+	}
+}
+
+// Reads frames until the connection fails, buffering the tuples in
+// the D until its next Tick().  Channels that don't decode are dropped.
+func (t *TCPTransport) receive(c net.Conn) {
+	defer t.wg.Done()
+	defer func() {
+		t.m.Lock()
+		delete(t.inbox, c)
+		t.m.Unlock()
+		c.Close()
+	}()
+	r := bufio.NewReader(c)
+	for {
+		codec, channels, err := readTCPFrame(r)
+		if err != nil {
+			return
+		}
+		for _, x := range channels {
+			if tuples, err := decodeTuples(t.d, codec, x.channel, x.raw); err == nil {
+				t.d.Receive(x.channel, tuples)
+			} else {
+				t.d.receiveError(x.channel, err)
+			}
+		}
+	}
+}
+
+func encodeTCPFrame(codec Codec, compress bool, batch []ChannelTuples) ([]byte, error) {
+	if len(batch) > 0xffff {
+		return nil, fmt.Errorf("TCPTransport: too many channels")
+	}
+	body := []byte{byte(len(batch) >> 8), byte(len(batch))}
+	for _, c := range batch {
+		b, err := codec.Encode(c.Tuples)
+		if err != nil {
+			return nil, err
+		}
+		if len(c.Channel) > 0xffff || len(b) > tcpMaxFrame {
+			return nil, fmt.Errorf("TCPTransport: frame too large, channel: %s", c.Channel)
+		}
+		var n [4]byte
+		binary.BigEndian.PutUint32(n[:], uint32(len(b)))
+		body = append(body, byte(len(c.Channel)>>8), byte(len(c.Channel)))
+		body = append(append(append(body, c.Channel...), n[:]...), b...)
+	}
+	flags := byte(0)
+	if compress {
+		var buf bytes.Buffer
+		w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+		w.Write(body)
+		w.Close()
+		body, flags = buf.Bytes(), tcpFlagCompressed
+	}
+	n := 2 + len(body)
+	if n > tcpMaxFrame {
+		return nil, fmt.Errorf("TCPTransport: frame too large")
+	}
+	frame := make([]byte, 4, 4+n)
+	binary.BigEndian.PutUint32(frame, uint32(n))
+	frame = append(frame, codec.Id(), flags)
+	return append(frame, body...), nil
+}
+
+func readTCPFrame(r io.Reader) (Codec, []tcpChannel, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n < 2 || n > tcpMaxFrame {
+		return nil, nil, fmt.Errorf("TCPTransport: bad frame length: %d", n)
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, nil, err
+	}
+	// An unknown codec is left for decodeTuples(), to skip just the frame.
+	codec, body := CodecById(frame[0]), frame[2:]
+	if frame[1]&tcpFlagCompressed != 0 {
+		b, err := ioutil.ReadAll(io.LimitReader(
+			flate.NewReader(bytes.NewReader(body)), tcpMaxFrame+1))
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(b) > tcpMaxFrame {
+			return nil, nil, fmt.Errorf("TCPTransport: decompressed frame too large")
+		}
+		body = b
+	}
+	bad := fmt.Errorf("TCPTransport: bad frame body")
+	if len(body) < 2 {
+		return nil, nil, bad
+	}
+	res := make([]tcpChannel, int(body[0])<<8|int(body[1]))
+	body = body[2:]
+	for i := range res {
+		if len(body) < 2 {
+			return nil, nil, bad
+		}
+		nc := int(body[0])<<8 | int(body[1])
+		if 2+nc+4 > len(body) {
+			return nil, nil, bad
+		}
+		res[i].channel = string(body[2 : 2+nc])
+		nb := binary.BigEndian.Uint32(body[2+nc:])
+		body = body[2+nc+4:]
+		if uint64(nb) > uint64(len(body)) {
+			return nil, nil, bad
+		}
+		res[i].raw, body = body[:nb], body[nb:]
+	}
+	return codec, res, nil
+}
+
+// Decodes tuples into the tuple type of d's channel.
+// Returns an error, rather than panicking, on any input, as it's from
+// the network.
+func decodeTuples(d *D, codec Codec, channel string, b []byte) (
+	res []interface{}, err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			res, err = nil, fmt.Errorf("decode of channel: %s, err: %v", channel, x)
+		}
+	}()
+	r := d.channel(channel)
+	if r == nil {
+		return nil, fmt.Errorf("unknown channel: %s", channel)
+	}
+	if codec == nil {
+		return nil, fmt.Errorf("unknown codec, channel: %s", channel)
+	}
+	return codec.Decode(d, r.TupleType(), b)
+}
@@ -0,0 +1,325 @@
+package gdec
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type transportTestMsg struct {
+	Addr string `gdec:"addr"`
+	From string
+	N    int
+}
+
+// Each D bounces messages back to their sender, until N reaches max.
+func transportTestInit(d *D, max int) *D {
+	ch := d.DeclareChannel("transportTestMsg", transportTestMsg{})
+	d.Join(ch, func(m *transportTestMsg) *transportTestMsg {
+		if m.Addr != d.Addr || m.N >= max {
+			return nil
+		}
+		return &transportTestMsg{m.From, d.Addr, m.N + 1}
+	}).IntoAsync(ch)
+	return d
+}
+
+// Ticks the D's until done() or a timeout.
+func tickUntil(t *testing.T, done func() bool, ds ...*D) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout")
+		}
+		for _, d := range ds {
+			d.Tick()
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestTCPFrame(t *testing.T) {
+	d := NewD("")
+	d.DeclareChannel("ch", transportTestMsg{})
+	d.DeclareChannel("ch2", "")
+	batch := []ChannelTuples{
+		{"ch", []interface{}{&transportTestMsg{"a", "b", 1}, &transportTestMsg{"a", "b", 2}}},
+		{"ch2", []interface{}{"x"}},
+	}
+	for _, compress := range []bool{false, true} {
+		frame, err := encodeTCPFrame(BinaryCodec, compress, batch)
+		if err != nil {
+			t.Fatalf("expected encode, got: %v", err)
+		}
+		codec, channels, err := readTCPFrame(bytes.NewReader(frame))
+		if err != nil || codec != BinaryCodec || len(channels) != 2 ||
+			channels[0].channel != "ch" || channels[1].channel != "ch2" {
+			t.Fatalf("expected frame, got: %v, %v", channels, err)
+		}
+		tuples, err := decodeTuples(d, codec, "ch", channels[0].raw)
+		if err != nil || len(tuples) != 2 ||
+			*tuples[1].(*transportTestMsg) != (transportTestMsg{"a", "b", 2}) {
+			t.Errorf("expected tuples, got: %#v, %v", tuples, err)
+		}
+		tuples, err = decodeTuples(d, codec, "ch2", channels[1].raw)
+		if err != nil || len(tuples) != 1 || tuples[0] != "x" {
+			t.Errorf("expected tuples, got: %#v, %v", tuples, err)
+		}
+		if _, _, err := readTCPFrame(bytes.NewReader(frame[:len(frame)-1])); err == nil {
+			t.Errorf("expected error on a short frame")
+		}
+	}
+}
+
+type transportTestBatches struct {
+	batches map[string][]ChannelTuples
+}
+
+func (b *transportTestBatches) Send(addr string, channel string, tuples []interface{}) error {
+	panic("expected SendBatch")
+}
+
+func (b *transportTestBatches) SendBatch(addr string, batch []ChannelTuples) error {
+	if b.batches[addr] != nil {
+		panic("expected one batch per addr")
+	}
+	b.batches[addr] = batch
+	return nil
+}
+
+func TestEmitBatches(t *testing.T) {
+	d := NewD("a")
+	ch := d.DeclareChannel("ch", transportTestMsg{})
+	ch2 := d.DeclareChannel("ch2", transportTestMsg{})
+	bt := &transportTestBatches{map[string][]ChannelTuples{}}
+	d.Transport = bt
+	for n := 0; n < 3; n++ {
+		d.AddNext(ch, &transportTestMsg{"b", "a", n})
+		d.AddNext(ch2, &transportTestMsg{"b", "a", n})
+		d.AddNext(ch2, &transportTestMsg{"c", "a", n})
+	}
+	d.AddNext(ch, &transportTestMsg{"a", "a", 0}) // Local.
+	d.Tick()
+	b, c := bt.batches["b"], bt.batches["c"]
+	if len(bt.batches) != 2 || len(b) != 2 || len(c) != 1 ||
+		b[0].Channel != "ch" || len(b[0].Tuples) != 3 || len(b[1].Tuples) != 3 ||
+		c[0].Channel != "ch2" || len(c[0].Tuples) != 3 {
+		t.Errorf("expected a batch per addr, got: %#v", bt.batches)
+	}
+}
+
+type transportTestSendOnly struct{ Transport }
+
+func TestEmitErrors(t *testing.T) {
+	lt := NewLocalTransport()
+	for _, tr := range []Transport{lt, transportTestSendOnly{lt}} {
+		d := transportTestInit(NewD("a"), 5)
+		d.Transport = tr
+		var errs []*TupleError
+		d.OnError = func(e *TupleError) { errs = append(errs, e) }
+		d.AddNext(d.Relations["transportTestMsg"], &transportTestMsg{"nobody", "a", 0})
+		d.Tick()
+		if len(errs) != 1 || errs[0].Relation != "transport" ||
+			!strings.Contains(errs[0].Err, "unknown addr: nobody") {
+			t.Errorf("expected a transport error, got: %#v", errs)
+		}
+	}
+}
+
+func TestTCPTransport(t *testing.T) {
+	a := transportTestInit(NewD("127.0.0.1:0"), 5)
+	b := transportTestInit(NewD("127.0.0.1:0"), 5)
+	ta, err := NewTCPTransport(a)
+	if err != nil {
+		t.Fatalf("expected listen, got: %v", err)
+	}
+	defer ta.Close()
+	tb, err := NewTCPTransport(b)
+	if err != nil {
+		t.Fatalf("expected listen, got: %v", err)
+	}
+	defer tb.Close()
+	ta.Compress = true
+
+	a.AddNext(a.Relations["transportTestMsg"], &transportTestMsg{b.Addr, a.Addr, 0})
+	got := map[int]string{} // Key: N, val: receiver.
+	tickUntil(t, func() bool {
+		for _, d := range []*D{a, b} {
+			for x := range d.Relations["transportTestMsg"].Scan() {
+				if m := x.(*transportTestMsg); m.Addr == d.Addr {
+					got[m.N] = d.Addr
+				}
+			}
+		}
+		return got[5] != ""
+	}, a, b)
+	for n := 0; n <= 5; n++ {
+		if (n%2 == 0 && got[n] != b.Addr) || (n%2 == 1 && got[n] != a.Addr) {
+			t.Errorf("expected messages to alternate, got: %#v", got)
+		}
+	}
+	if len(ta.queues) != 1 || len(tb.queues) != 1 {
+		t.Errorf("expected one persistent connection each")
+	}
+	if s := ta.Stats()[b.Addr]; s.Sent < 2 || s.Dropped != 0 || s.Bytes <= 0 {
+		t.Errorf("expected queue stats, got: %#v", s)
+	}
+}
+
+func TestUDPPack(t *testing.T) {
+	tuples := []interface{}{}
+	for i := 0; i < 100; i++ {
+		tuples = append(tuples, &transportTestMsg{"127.0.0.1:1", "x", i})
+	}
+	datagrams, err := packUDPDatagrams(BinaryCodec, "ch", tuples, 200)
+	if err != nil || len(datagrams) < 2 {
+		t.Fatalf("expected several datagrams, got: %v, %v", len(datagrams), err)
+	}
+	d := NewD("")
+	d.DeclareChannel("ch", transportTestMsg{})
+	n := 0
+	for _, b := range datagrams {
+		if len(b) > 200 {
+			t.Errorf("expected datagram within MTU, got: %v", len(b))
+		}
+		channel, got, err := unpackUDPDatagram(d, b)
+		if err != nil || channel != "ch" {
+			t.Errorf("expected decode, got: %v", err)
+		}
+		n += len(got)
+	}
+	if n != 100 {
+		t.Errorf("expected 100 tuples, got: %v", n)
+	}
+	if _, err := packUDPDatagrams(BinaryCodec, "ch", tuples[:1], 20); err == nil {
+		t.Errorf("expected error for a tuple larger than MTU")
+	}
+}
+
+func TestUDPTransport(t *testing.T) {
+	a := transportTestInit(NewD("127.0.0.1:0"), 5)
+	b := transportTestInit(NewD("127.0.0.1:0"), 5)
+	b.DeclareReliableChannel("transportTestReliable", transportTestMsg{})
+	a.DeclareReliableChannel("transportTestReliable", transportTestMsg{})
+	ta, err := NewUDPTransport(a)
+	if err != nil {
+		t.Fatalf("expected listen, got: %v", err)
+	}
+	defer ta.Close()
+	tb, err := NewUDPTransport(b)
+	if err != nil {
+		t.Fatalf("expected listen, got: %v", err)
+	}
+	defer tb.Close()
+
+	a.AddNext(a.Relations["transportTestMsg"], &transportTestMsg{b.Addr, a.Addr, 0})
+	got := map[int]string{} // Key: N, val: receiver.
+	tickUntil(t, func() bool {
+		for _, d := range []*D{a, b} {
+			for x := range d.Relations["transportTestMsg"].Scan() {
+				if m := x.(*transportTestMsg); m.Addr == d.Addr {
+					got[m.N] = d.Addr
+				}
+			}
+		}
+		return got[5] != ""
+	}, a, b)
+
+	// With the first sends lost, only the reliable channel delivers.
+	var m sync.Mutex
+	dropped, lose := 0, false
+	ta.drop = func(b []byte) bool {
+		m.Lock()
+		defer m.Unlock()
+		if dropped < 4 || lose {
+			dropped++
+			return true
+		}
+		return false
+	}
+	ta.RetransmitInterval = 5 * time.Millisecond
+	a.AddNext(a.Relations["transportTestMsg"], &transportTestMsg{b.Addr, a.Addr, 100})
+	a.AddNext(a.Relations["transportTestReliable"], &transportTestMsg{b.Addr, a.Addr, 200})
+	a.Tick()
+	received := map[int]int{}
+	tickUntil(t, func() bool {
+		for _, r := range []string{"transportTestMsg", "transportTestReliable"} {
+			for x := range b.Relations[r].Scan() {
+				received[x.(*transportTestMsg).N]++
+			}
+		}
+		return received[200] > 0
+	}, b)
+	time.Sleep(50 * time.Millisecond)
+	b.Tick()
+	b.Tick()
+	for x := range b.Relations["transportTestReliable"].Scan() {
+		t.Errorf("expected no duplicates, got: %#v", x)
+	}
+	if received[100] != 0 || received[200] != 1 {
+		t.Errorf("expected only the reliable tuple, once, got: %#v", received)
+	}
+	ta.m.Lock()
+	if len(ta.unacked) != 0 {
+		t.Errorf("expected reliable datagram acked")
+	}
+	ta.m.Unlock()
+
+	// Once retransmits run out, the loss shows in the stats.
+	m.Lock()
+	lose = true
+	m.Unlock()
+	ta.m.Lock()
+	ta.MaxRetransmits = 2
+	ta.m.Unlock()
+	a.AddNext(a.Relations["transportTestReliable"], &transportTestMsg{b.Addr, a.Addr, 300})
+	a.Tick()
+	tickUntil(t, func() bool { return ta.Stats()[b.Addr].Dropped > 0 }, a)
+	if s := ta.Stats()[b.Addr]; s.Queued != 0 || s.MaxQueued < 1 || s.Sent <= 0 {
+		t.Errorf("expected nothing queued after the drop, got: %#v", s)
+	}
+}
+
+func TestReceiveOnlyChannels(t *testing.T) {
+	d := KVInit(NewD("r"), "")
+	d.Receive("KVMember", []interface{}{"evil"})
+	d.Receive("kvMap", []interface{}{&LMapEntry{"k", NewLMax(d, 1)}, &LMapEntry{"j", NewLMax(d, 1)}})
+	d.Receive("nope", []interface{}{"x"})
+	d.Receive("KVPut", []interface{}{&KVPut{ReqId: 1, Addr: "r", ClientAddr: "c",
+		Key: "k", Val: NewLMax(d, 2)}})
+	d.Tick()
+	if d.Relations["KVMember"].(*LSet).Size() != 0 {
+		t.Errorf("expected no members from the network")
+	}
+	if v := d.Relations["kvMap"].(*LMap).At("k"); !LatticeEqual(v, NewLMax(d, 2)) {
+		t.Errorf("expected only the put, got: %#v", v)
+	}
+	if n := d.ReceiveDropped(); n != 4 {
+		t.Errorf("expected 4 dropped tuples, got: %d", n)
+	}
+	if _, err := decodeTuples(d, JSONCodec, "kvMap", []byte(`[]`)); err == nil {
+		t.Errorf("expected no decoding for a non-channel")
+	}
+}
+
+func TestRaftHeartbeatTransport(t *testing.T) {
+	lt := NewLocalTransport()
+	a := lt.Register(raftTestLeader("a", "a", "b", "c"))
+	b := lt.Register(RaftInit(NewD("b"), ""))
+	c := lt.Register(RaftInit(NewD("c"), ""))
+	acks := map[string]int{}
+	a.Watch(a.Relations["RaftAddEntryRes"], func(added []interface{}) {
+		for _, x := range added {
+			if r := x.(*RaftAddEntryRes); r.Ok && r.Round > 0 {
+				acks[r.From] = r.Round
+			}
+		}
+	})
+	a.AddNext(a.Relations["raftHeartbeat"], true)
+	tickUntil(t, func() bool { return len(acks) == 2 }, a, b, c)
+	if acks["b"] != 1 || acks["c"] != 1 {
+		t.Errorf("expected heartbeat round 1 acked by b and c, got: %v", acks)
+	}
+}
@@ -0,0 +1,357 @@
+package gdec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Transport over UDP, with at-most-once delivery, for protocols like
+// heartbeats and gossip that tolerate loss.  Tuples are packed into
+// datagrams of up to MTU bytes.  Datagrams for reliable channels, see
+// DeclareReliableChannel(), are retransmitted until acked, up to
+// MaxRetransmits times, after which they're given up on, and counted
+// as Dropped in Stats().  The receiver drops duplicates.
+//
+// A datagram is a kind byte, a big-endian uint64 seq, which is 0
+// unless reliable, the Codec's id, a uint16 length prefixed channel
+// name, and the tuples, each encoded alone with a uvarint length
+// prefix.  Acks are a kind byte and the acked seq.
+type UDPTransport struct {
+	d    *D
+	conn *net.UDPConn
+
+	Codec              Codec // For sending; datagrams name their codec.
+	MTU                int
+	RetransmitInterval time.Duration
+	MaxRetransmits     int
+
+	m       sync.Mutex
+	seq     uint64
+	unacked map[uint64]*udpUnacked
+	seen    map[string]time.Time // Key: "addr/seq" of reliable datagrams.
+	stats   map[string]*QueueStats
+	pruned  time.Time
+	closed  bool
+	done    chan struct{}
+	wg      sync.WaitGroup
+
+	retransmitOnce sync.Once // Started on the first reliable Send().
+
+	drop func(b []byte) bool // For tests, to simulate loss of data.
+}
+
+type udpUnacked struct {
+	addr  *net.UDPAddr
+	b     []byte
+	sent  time.Time
+	tries int
+}
+
+const (
+	udpKindData         = byte(1)
+	udpKindDataReliable = byte(2)
+	udpKindAck          = byte(3)
+
+	udpHeaderLen = 1 + 8 + 1 + 2
+)
+
+// Listens on d.Addr and becomes d's Transport.  When d.Addr has port
+// 0, d.Addr is updated with the port that was picked.
+func NewUDPTransport(d *D) (*UDPTransport, error) {
+	la, err := net.ResolveUDPAddr("udp", d.Addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", la)
+	if err != nil {
+		return nil, err
+	}
+	d.Addr = conn.LocalAddr().String()
+
+	t := &UDPTransport{
+		d:                  d,
+		conn:               conn,
+		Codec:              JSONCodec,
+		MTU:                1400,
+		RetransmitInterval: 100 * time.Millisecond,
+		MaxRetransmits:     10,
+		seq:                uint64(time.Now().UnixNano()),
+		unacked:            map[uint64]*udpUnacked{},
+		seen:               map[string]time.Time{},
+		stats:              map[string]*QueueStats{},
+		done:               make(chan struct{}),
+	}
+	d.Transport = t
+
+	t.wg.Add(1)
+	go t.receive()
+
+	return t, nil
+}
+
+// Returns an error when a tuple doesn't fit in a datagram, in which
+// case the tuples that fit are still sent.
+func (t *UDPTransport) Send(addr string, channel string, tuples []interface{}) error {
+	ua, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	reliable := false
+	if c, ok := t.d.Relations[channel].(*LSet); ok {
+		reliable = c.reliable
+	}
+	datagrams, err := packUDPDatagrams(t.Codec, channel, tuples, t.MTU)
+	if reliable && len(datagrams) > 0 {
+		t.retransmitOnce.Do(func() {
+			t.m.Lock()
+			if !t.closed {
+				t.wg.Add(1)
+				go t.retransmit()
+			}
+			t.m.Unlock()
+		})
+	}
+	for _, b := range datagrams {
+		if reliable {
+			t.m.Lock()
+			t.seq++
+			b[0] = udpKindDataReliable
+			binary.BigEndian.PutUint64(b[1:9], t.seq)
+			t.unacked[t.seq] = &udpUnacked{addr: ua, b: b, sent: time.Now()}
+			t.queued(ua, 1)
+			t.m.Unlock()
+		}
+		t.write(b, ua)
+	}
+	return err
+}
+
+func (t *UDPTransport) write(b []byte, ua *net.UDPAddr) {
+	if t.drop == nil || !t.drop(b) {
+		if _, err := t.conn.WriteToUDP(b, ua); err != nil {
+			t.m.Lock()
+			t.stat(ua).Dropped++
+			t.m.Unlock()
+			return
+		}
+	}
+	t.m.Lock()
+	s := t.stat(ua)
+	s.Sent++
+	s.Bytes += int64(len(b))
+	t.m.Unlock()
+}
+
+// Invoked with t.m held.
+func (t *UDPTransport) stat(ua *net.UDPAddr) *QueueStats {
+	s := t.stats[ua.String()]
+	if s == nil {
+		s = &QueueStats{}
+		t.stats[ua.String()] = s
+	}
+	return s
+}
+
+// Returns stats by peer addr, where the batches are datagrams, Queued
+// is the reliable datagrams not yet acked, and Dropped includes those
+// given up on after MaxRetransmits.
+func (t *UDPTransport) Stats() map[string]QueueStats {
+	t.m.Lock()
+	defer t.m.Unlock()
+	res := map[string]QueueStats{}
+	for addr, s := range t.stats {
+		res[addr] = *s
+	}
+	return res
+}
+
+// Packs tuples into as few datagrams of up to mtu bytes as it can.
+func packUDPDatagrams(codec Codec, channel string, tuples []interface{}, mtu int) ([][]byte, error) {
+	if len(channel) > 0xffff {
+		return nil, fmt.Errorf("UDPTransport: channel name too long")
+	}
+	var res [][]byte
+	var err error
+	var b []byte
+	var n [binary.MaxVarintLen64]byte
+	for _, x := range tuples {
+		e, eerr := codec.Encode([]interface{}{x})
+		if eerr != nil {
+			err = eerr
+			continue
+		}
+		e = append(n[:binary.PutUvarint(n[:], uint64(len(e)))], e...)
+		if b != nil && len(b)+len(e) > mtu {
+			res = append(res, b)
+			b = nil
+		}
+		if b == nil {
+			b = make([]byte, udpHeaderLen, mtu)
+			b[0] = udpKindData
+			b[9] = codec.Id()
+			binary.BigEndian.PutUint16(b[10:12], uint16(len(channel)))
+			b = append(b, channel...)
+			if len(b)+len(e) > mtu {
+				err = fmt.Errorf("UDPTransport: tuple larger than MTU, channel: %s", channel)
+				b = nil
+				continue
+			}
+		}
+		b = append(b, e...)
+	}
+	if b != nil {
+		res = append(res, b)
+	}
+	return res, err
+}
+
+// Decodes the tuples of a data datagram, returning its channel.
+func unpackUDPDatagram(d *D, b []byte) (string, []interface{}, error) {
+	if len(b) < udpHeaderLen {
+		return "", nil, fmt.Errorf("UDPTransport: short datagram")
+	}
+	nc := int(binary.BigEndian.Uint16(b[10:12]))
+	if udpHeaderLen+nc > len(b) {
+		return "", nil, fmt.Errorf("UDPTransport: bad channel length: %d", nc)
+	}
+	codec := CodecById(b[9])
+	channel := string(b[udpHeaderLen : udpHeaderLen+nc])
+	var res []interface{}
+	for b = b[udpHeaderLen+nc:]; len(b) > 0; {
+		n, k := binary.Uvarint(b)
+		if k <= 0 || uint64(len(b)-k) < n {
+			return "", nil, fmt.Errorf("UDPTransport: bad tuple length")
+		}
+		tuples, err := decodeTuples(d, codec, channel, b[k:k+int(n)])
+		if err != nil {
+			return channel, nil, err
+		}
+		res = append(res, tuples...)
+		b = b[k+int(n):]
+	}
+	return channel, res, nil
+}
+
+func (t *UDPTransport) receive() {
+	defer t.wg.Done()
+	buf := make([]byte, 64*1024)
+	for {
+		n, ua, err := t.conn.ReadFromUDP(buf)
+		if err != nil {
+			t.m.Lock()
+			closed := t.closed
+			t.m.Unlock()
+			if closed {
+				return
+			}
+			continue
+		}
+		b := buf[:n]
+		if n < 9 {
+			continue
+		}
+		seq := binary.BigEndian.Uint64(b[1:9])
+		switch b[0] {
+		case udpKindAck:
+			t.m.Lock()
+			if u := t.unacked[seq]; u != nil {
+				delete(t.unacked, seq)
+				t.queued(u.addr, -1)
+			}
+			t.m.Unlock()
+			continue
+		case udpKindDataReliable:
+			ack := make([]byte, 9)
+			ack[0] = udpKindAck
+			binary.BigEndian.PutUint64(ack[1:9], seq)
+			t.conn.WriteToUDP(ack, ua)
+			k := fmt.Sprintf("%s/%d", ua, seq)
+			t.m.Lock()
+			dup := !t.seen[k].IsZero()
+			t.seen[k] = time.Now()
+			t.pruneSeen()
+			t.m.Unlock()
+			if dup {
+				continue
+			}
+		case udpKindData:
+		default:
+			continue
+		}
+		if channel, tuples, err := unpackUDPDatagram(t.d, b); err == nil {
+			t.d.Receive(channel, tuples)
+		} else {
+			t.d.receiveError(channel, err)
+		}
+	}
+}
+
+// Invoked with t.m held.
+func (t *UDPTransport) queued(ua *net.UDPAddr, n int) {
+	s := t.stat(ua)
+	s.Queued += n
+	if s.MaxQueued < s.Queued {
+		s.MaxQueued = s.Queued
+	}
+}
+
+// Forgets duplicate detection state for datagrams that can no longer
+// be retransmitted.  Invoked with t.m held.
+func (t *UDPTransport) pruneSeen() {
+	now := time.Now()
+	forget := time.Duration(t.MaxRetransmits+1) * t.RetransmitInterval * 2
+	if now.Sub(t.pruned) < forget {
+		return
+	}
+	t.pruned = now
+	for k, at := range t.seen {
+		if now.Sub(at) > forget {
+			delete(t.seen, k)
+		}
+	}
+}
+
+func (t *UDPTransport) retransmit() {
+	defer t.wg.Done()
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-time.After(t.RetransmitInterval):
+		}
+		now := time.Now()
+		resend := []*udpUnacked{}
+		t.m.Lock()
+		for seq, u := range t.unacked {
+			if now.Sub(u.sent) < t.RetransmitInterval {
+				continue
+			}
+			if u.tries >= t.MaxRetransmits {
+				delete(t.unacked, seq)
+				t.queued(u.addr, -1)
+				t.stat(u.addr).Dropped++
+				continue
+			}
+			u.tries++
+			u.sent = now
+			resend = append(resend, u)
+		}
+		t.m.Unlock()
+		for _, u := range resend {
+			t.write(u.b, u.addr)
+		}
+	}
+}
+
+func (t *UDPTransport) Close() error {
+	t.m.Lock()
+	t.closed = true
+	t.m.Unlock()
+	close(t.done)
+	err := t.conn.Close()
+	t.wg.Wait()
+	return err
+}
@@ -0,0 +1,169 @@
+package gdec
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Declares relations that a join's select func reads other than its
+// sources, such as via At() or Size(), for Validate().
+func (jd *joinDeclaration) Reads(rs ...Relation) *joinDeclaration {
+	jd.reads = append(jd.reads, rs...)
+	return jd
+}
+
+// Declares relations that a join's select func writes as side-effects,
+// such as via d.Add(), for Validate().  Each tick then checks the
+// join's writes, reporting a call's writes to undeclared relations, or
+// of tuples of the wrong type, as an error, and dropping all of that
+// call's writes.  Joins without Writes() aren't checked.
+func (jd *joinDeclaration) Writes(rs ...Relation) *joinDeclaration {
+	jd.writes = append(jd.writes, rs...)
+	return jd
+}
+
+// Marks a relation as read and written from outside the D's joins,
+// such as config or base facts, without making it scratch.
+func (d *D) External(r Relation) Relation {
+	if d.externals == nil {
+		d.externals = map[Relation]bool{}
+	}
+	d.externals[r] = true
+	return r
+}
+
+// Checks a fully declared D, returning any collected declaration
+// errors, joins without a destination, relations that are never read
+// or never written, and inputs written or outputs read by joins in
+// their own scope.  Inputs, externals and relations fed by the engine,
+// like channels and periodics, count as written, while outputs,
+// externals, channels and watched relations count as read.
+//
+// A relation's scope is its name's prefix through the last "/", as
+// from a prefix passed to an XInit(), and a join's scope is the
+// longest scope shared by all its relations.  So a parent may write
+// the inputs and read the outputs of a sub-module.
+func (d *D) Validate() error {
+	var errs []error
+	if err := d.Err(); err != nil {
+		errs = append(errs, err)
+	}
+
+	read, written := map[Relation]bool{}, map[Relation]bool{}
+	for _, jd := range d.Joins {
+		if jd.invalid {
+			continue
+		}
+		if jd.into == nil && !jd.sideEffectOnly() {
+			errs = append(errs, fmt.Errorf("join has no Into(), join: %s", jd.validateName()))
+		}
+		scope := d.joinScope(jd)
+		for _, r := range append(append([]Relation(nil), jd.sources...), jd.reads...) {
+			read[r] = true
+			if d.outputs[r] && d.inScope(scope, r) {
+				errs = append(errs, fmt.Errorf("output relation read by join,"+
+					" relation: %s, join: %s", d.relationName(r), jd.validateName()))
+			}
+		}
+		for _, r := range append(append([]Relation(nil), jd.into), jd.writes...) {
+			if r == nil {
+				continue
+			}
+			written[r] = true
+			if d.inputs[r] && d.inScope(scope, r) {
+				errs = append(errs, fmt.Errorf("input relation written by join,"+
+					" relation: %s, join: %s", d.relationName(r), jd.validateName()))
+			}
+		}
+	}
+	for r := range d.inputs {
+		written[r] = true
+	}
+	for r := range d.outputs {
+		read[r] = true
+	}
+	for r := range d.externals {
+		read[r], written[r] = true, true
+	}
+	for _, p := range d.periodics {
+		written[p.r] = true
+	}
+	if d.errRelation != nil {
+		written[d.errRelation] = true
+	}
+	d.watchM.Lock()
+	for r := range d.watched {
+		read[r] = true
+	}
+	d.watchM.Unlock()
+
+	names := make([]string, 0, len(d.Relations))
+	for name := range d.Relations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		r := d.Relations[name]
+		if s, ok := r.(*LSet); ok && s.channel {
+			continue
+		}
+		if !read[r] {
+			errs = append(errs, fmt.Errorf("relation never read: %s", name))
+		}
+		if !written[r] {
+			errs = append(errs, fmt.Errorf("relation never written: %s", name))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func relationScope(name string) string {
+	return name[:strings.LastIndex(name, "/")+1]
+}
+
+func (d *D) joinScope(jd *joinDeclaration) string {
+	scope, first := "", true
+	for _, rs := range [][]Relation{jd.sources, jd.reads, {jd.into}, jd.writes} {
+		for _, r := range rs {
+			if r == nil {
+				continue
+			}
+			s := relationScope(d.relationName(r))
+			if first {
+				scope, first = s, false
+			}
+			for !strings.HasPrefix(s, scope) {
+				scope = relationScope(strings.TrimSuffix(scope, "/"))
+			}
+		}
+	}
+	return scope
+}
+
+// True when the join scope is within the relation's scope.
+func (d *D) inScope(scope string, r Relation) bool {
+	return strings.HasPrefix(scope, relationScope(d.relationName(r)))
+}
+
+// True when the join's select func returns nothing, so only has
+// side-effects.
+func (jd *joinDeclaration) sideEffectOnly() bool {
+	return jd.selectWhereFunc != nil &&
+		reflect.TypeOf(jd.selectWhereFunc).NumOut() == 0
+}
+
+func (jd *joinDeclaration) validateName() string {
+	if jd.name != "" {
+		return jd.name
+	}
+	for i, x := range jd.d.Joins {
+		if x == jd {
+			return fmt.Sprintf("#%d", i)
+		}
+	}
+	return "?"
+}
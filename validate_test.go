@@ -0,0 +1,85 @@
+package gdec
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	d := NewD("")
+	in := d.Input(d.DeclareLSet("in", ""))
+	out := d.Output(d.DeclareLSet("out", ""))
+	mid := d.DeclareLSet("mid", "")
+	d.DeclareLSet("unused", "")
+	d.Join(in).Into(mid)
+	d.Join(mid, func(x *string) *string { return x }) // No Into().
+	d.Join(mid).Into(in)
+	d.Join(out).Into(mid)
+	d.Join(mid, func(x *string) { d.Add(out, *x) })
+
+	err := d.Validate()
+	if err == nil {
+		t.Fatalf("expected errors")
+	}
+	for _, s := range []string{
+		"join has no Into(), join: #1",
+		"input relation written by join, relation: in, join: #2",
+		"output relation read by join, relation: out, join: #3",
+		"relation never read: unused",
+		"relation never written: unused",
+		"relation never written: out",
+	} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("expected: %s, got: %v", s, err)
+		}
+	}
+	if strings.Contains(err.Error(), "join: #0") || strings.Contains(err.Error(), "#4") {
+		t.Errorf("expected valid joins to pass, got: %v", err)
+	}
+
+	d = NewD("")
+	in = d.Input(d.DeclareLSet("in", ""))
+	out = d.Output(d.DeclareLSet("out", ""))
+	d.Join(in, func(x *string) { d.Add(out, *x) }).Writes(out)
+	if err := d.Validate(); err != nil {
+		t.Errorf("expected Writes() to count, got: %v", err)
+	}
+}
+
+func TestValidateSubModule(t *testing.T) {
+	d := NewD("")
+	vote := d.Input(d.DeclareLSet("vote", "voterString"))
+	TallyInit(d, "sub/")
+	d.Join(vote).Into(d.Relations["sub/TallyVote"])
+	d.Join(d.Relations["sub/TallyDone"], func(b *bool) bool { return *b }).
+		Into(d.Output(d.DeclareLBool("done")))
+	if err := d.Validate(); err != nil {
+		t.Errorf("expected a parent to use a sub-module's ports, got: %v", err)
+	}
+	d.Join(d.Relations["sub/tallyTotal"]).Into(d.Relations["sub/TallyVote"])
+	if err := d.Validate(); err == nil || !strings.Contains(err.Error(), "sub/TallyVote") {
+		t.Errorf("expected an input written within its module, got: %v", err)
+	}
+}
+
+func TestValidateExamples(t *testing.T) {
+	for name, d := range map[string]*D{
+		"ShortestPath":  ShortestPathInit(NewD(""), ""),
+		"Tally":         TallyInit(NewD(""), ""),
+		"MultiTally":    MultiTallyInit(NewD(""), ""),
+		"ReplicatedKV":  ReplicatedKVInit(NewD(""), ""),
+		"PartitionedKV": PartitionedKVInit(NewD(""), ""),
+		"QuorumKV":      QuorumKVInit(NewD(""), ""),
+	} {
+		if err := d.Validate(); err != nil {
+			t.Errorf("expected %s to validate, got: %v", name, err)
+		}
+	}
+
+	// Raft has no joins yet to maintain its log state and next indexes.
+	err := RaftInit(NewD(""), "").Validate()
+	if err == nil || err.Error() != "relation never written: raftLogState\n"+
+		"relation never written: raftNextIndex" {
+		t.Errorf("expected Raft's unwritten relations, got: %v", err)
+	}
+}
@@ -0,0 +1,283 @@
+package gdec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Write-ahead log for a D's persistent relations, see
+// DeclarePersistent().  The changes that each tick applies to
+// persistent relations are appended as one record and fsync'ed before
+// the tick emits any network tuples.  Once the log grows past
+// CheckpointBytes, snapshots of the persistent relations are written
+// to a checkpoint file, and the log is truncated.  Since changes are
+// lattice merges, replaying a log over a checkpoint that already has
+// some of its changes is harmless.
+//
+// Removals, like by garbage collection, aren't logged, so they're
+// only durable once checkpointed.  Lattices within tuples must have
+// registered types, see RegisterType().
+//
+// Records are a big-endian uint32 length, a uint32 CRC-32 of the
+// payload, and the payload, in the encoding of BinaryCodec.
+type WAL struct {
+	d   *D
+	dir string
+	f   *os.File
+
+	CheckpointBytes int64
+
+	size    int64
+	pending []interface{} // Wire values of the current tick's changes.
+}
+
+const (
+	walLogFile        = "wal"
+	walCheckpointFile = "checkpoint"
+	walMaxRecord      = 1 << 30
+)
+
+// Marks a relation as persistent, so its changes are logged once the
+// D has a WAL.
+func (d *D) DeclarePersistent(r Relation) Relation {
+	if d.persistent == nil {
+		d.persistent = map[Relation]string{}
+	}
+	for name, x := range d.Relations {
+		if x == r {
+			d.persistent[r] = name
+			return r
+		}
+	}
+	d.declError("DeclarePersistent() of an undeclared relation: %#v", r)
+	return r
+}
+
+// Restores the persistent relations from the checkpoint and log in
+// dir, and then logs their changes there.  Invoke after the D's
+// relations are declared, and before its first Tick().
+func (d *D) OpenWAL(dir string) (*WAL, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	w := &WAL{d: d, dir: dir, CheckpointBytes: 4 * 1024 * 1024}
+
+	if _, err := w.replay(walCheckpointFile, w.restoreCheckpoint); err != nil {
+		return nil, err
+	}
+	good, err := w.replay(walLogFile, w.restoreLog)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, walLogFile), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = f.Truncate(good); err == nil { // Drops any torn record.
+		_, err = f.Seek(good, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	w.f, w.size = f, good
+	d.wal = w
+	return w, nil
+}
+
+func (w *WAL) Close() error {
+	w.d.tickM.Lock()
+	defer w.d.tickM.Unlock()
+	if w.d.wal == w {
+		w.d.wal = nil
+	}
+	return w.f.Close()
+}
+
+// Invoked as changes are applied during a tick.
+func (w *WAL) log(c relationChange) {
+	name, ok := w.d.persistent[c.into]
+	if !ok {
+		return
+	}
+	v, err := changeToWire(name, c)
+	if err != nil {
+		panic(fmt.Sprintf("WAL %v", err))
+	}
+	w.pending = append(w.pending, v)
+}
+
+// Invoked at the end of each tick, before network emission.  Returns
+// false when the tick's changes aren't durable, in which case they're
+// retried at the next tick.
+func (w *WAL) sync() bool {
+	if len(w.pending) <= 0 {
+		return true
+	}
+	size := w.size
+	err := w.append(w.f, w.pending)
+	if err == nil {
+		err = w.f.Sync()
+	}
+	if err != nil {
+		w.size = size
+		if w.f.Truncate(size) == nil { // Drops any torn record.
+			w.f.Seek(size, io.SeekStart)
+		}
+		w.d.runtimeError("WAL", nil, fmt.Errorf("WAL append failed, err: %v", err))
+		return false
+	}
+	w.pending = w.pending[0:0]
+	if w.size > w.CheckpointBytes {
+		if err := w.checkpoint(); err != nil {
+			w.d.runtimeError("WAL", nil, fmt.Errorf("WAL checkpoint failed, err: %v", err))
+		}
+	}
+	return true
+}
+
+func (w *WAL) append(f io.Writer, v interface{}) error {
+	payload, err := binaryAppend(nil, v)
+	if err != nil {
+		return err
+	}
+	var hdr [8]byte
+	binary.BigEndian.PutUint32(hdr[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(hdr[4:8], crc32.ChecksumIEEE(payload))
+	if _, err = f.Write(append(hdr[:], payload...)); err == nil {
+		w.size += int64(len(hdr) + len(payload))
+	}
+	return err
+}
+
+// Writes snapshots of the persistent relations to the checkpoint
+// file, and then truncates the log.  Safe to call while the D is
+// Run(), but not during a tick.
+func (w *WAL) Checkpoint() error {
+	w.d.tickM.Lock()
+	defer w.d.tickM.Unlock()
+	return w.checkpoint()
+}
+
+func (w *WAL) checkpoint() error {
+	tmp := filepath.Join(w.dir, walCheckpointFile+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	for r, name := range w.d.persistent {
+		tuples, err := relationToWire(r)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		if err = w.append(bw, []interface{}{name, tuples}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err = bw.Flush(); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(w.dir, walCheckpointFile))
+	}
+	if err == nil {
+		err = syncDir(w.dir)
+	}
+	if err == nil {
+		err = w.f.Truncate(0)
+	}
+	if err == nil {
+		_, err = w.f.Seek(0, io.SeekStart)
+	}
+	if err == nil {
+		err = w.f.Sync()
+	}
+	w.size = 0
+	return err
+}
+
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// Reads the records of a file in dir, until the end or a torn
+// record, returning the length of the good records.
+func (w *WAL) replay(file string, restore func(interface{}) error) (int64, error) {
+	f, err := os.Open(filepath.Join(w.dir, file))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	good := int64(0)
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return good, nil
+		}
+		n := binary.BigEndian.Uint32(hdr[0:4])
+		if n > walMaxRecord {
+			return good, nil
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(r, payload); err != nil ||
+			crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(hdr[4:8]) {
+			return good, nil
+		}
+		v, rest, err := binaryRead(payload)
+		if err != nil || len(rest) > 0 {
+			return good, nil
+		}
+		if err := restore(v); err != nil {
+			return good, fmt.Errorf("WAL replay of: %s, err: %v", file, err)
+		}
+		good += int64(len(hdr)) + int64(n)
+	}
+}
+
+func (w *WAL) restoreLog(v interface{}) error {
+	changes, _ := v.([]interface{})
+	for _, x := range changes {
+		r, c, err := changeFromWire(w.d, x)
+		if err != nil {
+			return err
+		}
+		if _, ok := w.d.persistent[r]; ok {
+			w.d.applyChange(c)
+		}
+	}
+	return nil
+}
+
+func (w *WAL) restoreCheckpoint(v interface{}) error {
+	c, _ := v.([]interface{})
+	if len(c) != 2 {
+		return fmt.Errorf("bad checkpoint: %#v", v)
+	}
+	name, _ := c[0].(string)
+	r := w.d.Relations[name]
+	if _, ok := w.d.persistent[r]; !ok {
+		return nil // No longer persistent.
+	}
+	return relationFromWire(w.d, r, c[1])
+}
@@ -0,0 +1,111 @@
+package gdec
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type walTestVote struct {
+	Term int
+	Addr string
+}
+
+func walTestInit(d *D) *D {
+	d.DeclarePersistent(d.DeclareLMax("term"))
+	d.DeclarePersistent(d.DeclareLSet("vote", walTestVote{}))
+	d.DeclarePersistent(d.DeclareLMap("log")) // Val: LSet of strings.
+	d.DeclareLSet("volatile", "")
+	return d
+}
+
+func walTestChange(d *D, n int) {
+	d.AddNext(d.Relations["term"], n)
+	d.AddNext(d.Relations["vote"], &walTestVote{n, "a"})
+	d.AddNext(d.Relations["log"], &LMapEntry{"1", NewLSetOne(d, string(rune('a'+n)))})
+	d.AddNext(d.Relations["volatile"], "x")
+	d.Tick()
+}
+
+func walTestCheck(t *testing.T, d *D, n int) {
+	if x := d.Relations["term"].(*LMax).Int(); x != n {
+		t.Errorf("expected term: %d, got: %d", n, x)
+	}
+	if x := d.Relations["vote"].(*LSet); x.Size() != n ||
+		!x.Contains(&walTestVote{n, "a"}) {
+		t.Errorf("expected %d votes, got: %#v", n, x.m)
+	}
+	if x, _ := d.Relations["log"].(*LMap).At("1").(*LSet); x == nil || x.Size() != n {
+		t.Errorf("expected %d log entries, got: %#v", n, x)
+	}
+	if x := d.Relations["volatile"].(*LSet); x.Size() != 0 {
+		t.Errorf("expected volatile relation to not be restored, got: %#v", x.m)
+	}
+}
+
+func TestWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gdec-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := walTestInit(NewD(""))
+	w, err := d.OpenWAL(dir)
+	if err != nil {
+		t.Fatalf("expected open, got: %v", err)
+	}
+	for n := 1; n <= 3; n++ {
+		walTestChange(d, n)
+	}
+	d.Tick() // Changes nothing, so logs nothing.
+	w.Close()
+
+	d = walTestInit(NewD(""))
+	if w, err = d.OpenWAL(dir); err != nil {
+		t.Fatalf("expected replay, got: %v", err)
+	}
+	walTestCheck(t, d, 3)
+
+	w.CheckpointBytes = 0 // Checkpoints at the next change.
+	walTestChange(d, 4)
+	if fi, err := os.Stat(filepath.Join(dir, walLogFile)); err != nil || fi.Size() != 0 {
+		t.Errorf("expected a truncated log, got: %v, %v", fi, err)
+	}
+	w.CheckpointBytes = 1 << 20
+	walTestChange(d, 5)
+	w.Close()
+
+	// A torn record, like from a crash during a write, is dropped.
+	f, err := os.OpenFile(filepath.Join(dir, walLogFile), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 9, 1, 2})
+	f.Close()
+
+	d = walTestInit(NewD(""))
+	if w, err = d.OpenWAL(dir); err != nil {
+		t.Fatalf("expected replay, got: %v", err)
+	}
+	walTestCheck(t, d, 5)
+	walTestChange(d, 6)
+	w.Close()
+
+	d = walTestInit(NewD(""))
+	if w, err = d.OpenWAL(dir); err != nil {
+		t.Fatalf("expected replay, got: %v", err)
+	}
+	defer w.Close()
+	walTestCheck(t, d, 6)
+}
+
+func TestRaftPersistent(t *testing.T) {
+	d := RaftInit(NewD(""), "")
+	for _, name := range []string{"raftCurTerm", "raftVotedFor", "raftEntry"} {
+		if _, ok := d.persistent[d.Relations[name]]; !ok {
+			t.Errorf("expected persistent: %s", name)
+		}
+	}
+}
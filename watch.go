@@ -0,0 +1,142 @@
+package gdec
+
+// Watches deliver the tuples that changed in a relation during each
+// tick, once the tick completes, so application code can react to
+// outputs, like KV responses, without polling.  Added is the new
+// tuples of an LSet, the changed entries of an LMap, with their
+// merged values, or the new value of an LMax, LMaxString or LBool.
+// Watch funcs run in the ticking goroutine, and may AddNext().
+// Watches may be added and canceled from any goroutine.
+
+type watchState struct {
+	r      Relation
+	funcs  map[int]func(added []interface{})
+	tuples []interface{}   // For an LSet.
+	keys   map[string]bool // For an LMap.
+	order  []string        // Keys, in the order they changed.
+	scalar bool            // For scalar relations, whether changed.
+}
+
+// Returns a func to cancel the watch.
+func (d *D) Watch(r Relation, f func(added []interface{})) func() {
+	d.watchM.Lock()
+	defer d.watchM.Unlock()
+	if d.watched == nil {
+		d.watched = map[Relation]*watchState{}
+	}
+	w := d.watched[r]
+	if w == nil {
+		w = &watchState{r: r, funcs: map[int]func([]interface{}){}, keys: map[string]bool{}}
+		d.watched[r] = w
+	}
+	d.lastWatchId++
+	id := d.lastWatchId
+	w.funcs[id] = f
+	return func() {
+		d.watchM.Lock()
+		defer d.watchM.Unlock()
+		delete(w.funcs, id)
+		if len(w.funcs) <= 0 && d.watched[r] == w {
+			delete(d.watched, r)
+		}
+	}
+}
+
+func (d *D) watch(r Relation) *watchState {
+	d.watchM.Lock()
+	defer d.watchM.Unlock()
+	return d.watched[r]
+}
+
+// Like Watch(), but sends to a channel of the given buffer size.
+// Ticks block while the channel is full, so receive promptly, and
+// not from the ticking goroutine unless the buffer suffices.
+func (d *D) WatchChan(r Relation, size int) (<-chan []interface{}, func()) {
+	ch := make(chan []interface{}, size)
+	cancel := d.Watch(r, func(added []interface{}) { ch <- added })
+	return ch, cancel
+}
+
+// Applies a change to a watched relation, recording what changed.
+// Merges are applied as adds, so only their new parts are recorded.
+func (w *watchState) apply(d *D, c relationChange) bool {
+	if !c.add {
+		changed := false
+		switch x := c.arg.(type) {
+		case *LSet:
+			x.each(func(v interface{}) {
+				changed = w.apply(d, relationChange{c.into, v, true}) || changed
+			})
+			return changed
+		case *LMap:
+			x.each(func(k string, v Lattice) {
+				changed = w.apply(d, relationChange{c.into, &LMapEntry{k, v}, true}) || changed
+			})
+			return changed
+		}
+	}
+	if !d.applyChange(c) {
+		return false
+	}
+	switch c.into.(type) {
+	case *LSet:
+		if c.add {
+			w.tuples = append(w.tuples, c.arg)
+		}
+	case *LMap:
+		if e, ok := c.arg.(*LMapEntry); ok && !w.keys[e.Key] {
+			w.keys[e.Key] = true
+			w.order = append(w.order, e.Key)
+		}
+	default:
+		w.scalar = true
+	}
+	return true
+}
+
+// Invoked at the end of each tick.  Watch funcs are invoked without
+// d.watchM held, so they may add or cancel watches.
+func (d *D) notifyWatches() {
+	d.watchM.Lock()
+	ws := make([]*watchState, 0, len(d.watched))
+	funcs := make([][]func([]interface{}), 0, len(d.watched))
+	for _, w := range d.watched {
+		fs := make([]func([]interface{}), 0, len(w.funcs))
+		for _, f := range w.funcs {
+			fs = append(fs, f)
+		}
+		ws, funcs = append(ws, w), append(funcs, fs)
+	}
+	d.watchM.Unlock()
+
+	for i, w := range ws {
+		var added []interface{}
+		switch x := w.r.(type) {
+		case *LSet:
+			added = w.tuples
+		case *LMap:
+			for _, k := range w.order {
+				added = append(added, &LMapEntry{k, x.At(k)})
+			}
+		case *LMax:
+			if w.scalar {
+				added = []interface{}{x.v}
+			}
+		case *LMaxString:
+			if w.scalar {
+				added = []interface{}{x.v}
+			}
+		case *LBool:
+			if w.scalar {
+				added = []interface{}{x.v}
+			}
+		}
+		w.tuples, w.keys, w.order, w.scalar = nil, map[string]bool{}, nil, false
+		if len(added) <= 0 {
+			continue
+		}
+		for _, f := range funcs[i] {
+			f(added)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package gdec
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	d := ShortestPathInit(NewD(""), "")
+	link := d.Relations["ShortestPathLink"]
+	var added [][]interface{}
+	cancel := d.Watch(d.Relations["ShortestPath"], func(x []interface{}) {
+		added = append(added, x)
+	})
+	d.AddNext(link, &ShortestPathLink{"a", "b", 1})
+	d.AddNext(link, &ShortestPathLink{"b", "c", 1})
+	d.Tick()
+	if len(added) != 1 || len(added[0]) != 3 {
+		t.Errorf("expected one delivery of 3 paths, got: %v", added)
+	}
+	d.Tick()
+	if len(added) != 1 {
+		t.Errorf("expected no delivery without changes, got: %v", added)
+	}
+	d.AddNext(link, &ShortestPathLink{"c", "d", 1})
+	d.Tick()
+	if len(added) != 2 || len(added[1]) != 3 {
+		t.Errorf("expected only the new paths, got: %v", added)
+	}
+	cancel()
+	d.AddNext(link, &ShortestPathLink{"d", "e", 1})
+	d.Tick()
+	if len(added) != 2 || len(d.watched) != 0 {
+		t.Errorf("expected no delivery after cancel, got: %v", added)
+	}
+}
+
+func TestWatchLattices(t *testing.T) {
+	d := NewD("")
+	m := d.DeclareLMap("m")
+	x := d.DeclareLMax("x")
+	var gotM, gotX []interface{}
+	d.Watch(m, func(a []interface{}) { gotM = a })
+	d.Watch(x, func(a []interface{}) { gotX = a })
+
+	d.AddNext(m, &LMapEntry{"k", NewLMax(d, 1)})
+	d.AddNext(m, &LMapEntry{"k", NewLMax(d, 5)})
+	other := d.NewLMap()
+	other.DirectAdd(&LMapEntry{"j", NewLMax(d, 2)})
+	other.DirectAdd(&LMapEntry{"k", NewLMax(d, 3)})
+	d.MergeNext(m, other)
+	d.AddNext(x, 2)
+	d.AddNext(x, 7)
+	d.Tick()
+	if len(gotM) != 2 || len(gotX) != 1 || gotX[0] != 7 {
+		t.Fatalf("expected changed entries and value, got: %v, %v", gotM, gotX)
+	}
+	for _, a := range gotM {
+		e := a.(*LMapEntry)
+		if (e.Key == "k" && e.Val.(*LMax).Int() != 5) || (e.Key == "j" && e.Val.(*LMax).Int() != 2) {
+			t.Errorf("expected merged values, got: %v %v", e.Key, e.Val)
+		}
+	}
+
+	gotM, gotX = nil, nil
+	d.MergeNext(m, other) // Nothing new.
+	d.AddNext(x, 3)
+	d.Tick()
+	if gotM != nil || gotX != nil {
+		t.Errorf("expected no deliveries, got: %v, %v", gotM, gotX)
+	}
+}
+
+func TestWatchChanKV(t *testing.T) {
+	d := KVInit(NewD("r"), "")
+	ch, cancel := d.WatchChan(d.Relations["KVPutResponse"], 1)
+	defer cancel()
+	d.AddNext(d.Relations["KVPut"], &KVPut{ReqId: 1, Addr: "r",
+		ClientAddr: "c", Key: "k", Val: NewLMax(d, 1)})
+	d.Tick()
+	d.Tick() // Responses are async, so arrive the next tick.
+	select {
+	case added := <-ch:
+		if r, ok := added[0].(*KVPutResponse); !ok || r.ReqId != 1 {
+			t.Errorf("expected put response, got: %#v", added)
+		}
+	default:
+		t.Errorf("expected a delivery")
+	}
+}
+
+func TestWatchWhileRun(t *testing.T) {
+	d := ShortestPathInit(NewD(""), "")
+	link := d.Relations["ShortestPathLink"]
+	paths := d.Relations["ShortestPath"]
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- d.Run(ctx, RunOptions{}) }()
+
+	for i := 0; i < 100; i++ {
+		ch, stop := d.WatchChan(paths, 100)
+		d.Inject(link, &ShortestPathLink{"a", fmt.Sprintf("n%d", i), 1})
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected a delivery")
+		}
+		stop()
+	}
+	cancel()
+	<-done
+	if len(d.watched) != 0 {
+		t.Errorf("expected no watches left")
+	}
+}